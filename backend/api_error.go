@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Error codes of the JSON error envelope. Clients switch on the code, the
+// message is meant for humans and may change.
+const (
+	errCodeMissingParameter   = "missing_parameter"
+	errCodeInvalidParameter   = "invalid_parameter"
+	errCodeInvalidDate        = "invalid_date"
+	errCodeInvalidDateRange   = "invalid_date_range"
+	errCodeNotFound           = "not_found"
+	errCodeServiceUnavailable = "service_unavailable"
+	errCodeQueryTimeout       = "query_timeout"
+	errCodeScanFailed         = "scan_failed"
+	errCodeInternal           = "internal_error"
+)
+
+// requestIDHeader carries the request ID to and from the client
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits client-supplied request IDs to what is safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// APIError is the JSON body of every error response
+type APIError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+}
+
+// ValidationError reports an invalid request, e.g. a missing parameter or a
+// malformed date. Handlers answer it with 400 Bad Request.
+type ValidationError struct {
+	Code    string
+	Fields  map[string]string // offending parameter -> reason, if known
+	Message string
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// NotFoundError reports that the station or line named by a parameter does
+// not exist. Handlers answer it with 404 Not Found.
+type NotFoundError struct {
+	Param   string
+	Value   string
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+// invalidParamError reports a parameter with an unusable value, reason
+// completes a sentence starting with the parameter name
+func invalidParamError(param, reason string, args ...interface{}) error {
+	reason = fmt.Sprintf(reason, args...)
+	return &ValidationError{
+		Code:    errCodeInvalidParameter,
+		Fields:  map[string]string{param: reason},
+		Message: "invalid parameter: " + param + " " + reason,
+	}
+}
+
+type requestIDKey struct{}
+
+// withRequestID assigns every request an ID, which is echoed in the
+// X-Request-ID response header, included in error bodies and logged with
+// server errors. A well-formed ID sent by the client or a proxy is kept.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom returns the request ID of ctx or an empty string
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// writeError writes apiErr as JSON with the given status
+func writeError(w http.ResponseWriter, r *http.Request, status int, apiErr APIError) {
+	apiErr.RequestID = requestIDFrom(r.Context())
+
+	// Drop headers meant for a successful response, like http.Error does
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	setCORSHeaders(h)
+	h.Set("Cache-Control", "no-store")
+
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiErr); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding error response failed", "error", err)
+	}
+}
+
+// writeValidationError answers an invalid request with 400 Bad Request.
+// Errors that are not a *ValidationError count as invalid parameters.
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := APIError{Code: errCodeInvalidParameter, Message: err.Error()}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		apiErr.Code = validationErr.Code
+		apiErr.Message = validationErr.Message
+		apiErr.Details = validationErr.Fields
+	}
+	writeError(w, r, http.StatusBadRequest, apiErr)
+}
+
+// writeServiceUnavailable reports that ClickHouse is not connected
+func writeServiceUnavailable(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusServiceUnavailable, APIError{
+		Code:    errCodeServiceUnavailable,
+		Message: "Database service unavailable",
+	})
+}
+
+// writeNotFound answers requests for unknown API routes
+func writeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, APIError{
+		Code:    errCodeNotFound,
+		Message: "no such endpoint: " + r.URL.Path,
+	})
+}
+
+// writeInternalError logs err and sends a sanitized 500 Internal Server Error,
+// database errors may contain queries or hostnames
+func writeInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	httpLog.ErrorContext(r.Context(), message, "error", err)
+	writeError(w, r, http.StatusInternalServerError, APIError{
+		Code:    errCodeInternal,
+		Message: message,
+	})
+}
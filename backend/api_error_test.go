@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	// Generated when missing
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	assert.NotEmpty(t, seen)
+	assert.Equal(t, seen, w.Header().Get(requestIDHeader))
+
+	// Kept when sent by a proxy
+	req := httptest.NewRequest("GET", "/api/health", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, "abc-123", w.Header().Get(requestIDHeader))
+
+	// Replaced when it is unsafe to log
+	req = httptest.NewRequest("GET", "/api/health", nil)
+	req.Header.Set(requestIDHeader, "abc\n123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEqual(t, "abc\n123", seen)
+	assert.Equal(t, seen, w.Header().Get(requestIDHeader))
+}
+
+func TestWriteValidationError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected APIError
+	}{
+		{
+			"Invalid parameter",
+			invalidParamError("limit", "must be between 1 and %d", 50),
+			APIError{Code: errCodeInvalidParameter, Message: "invalid parameter: limit must be between 1 and 50", Details: map[string]string{"limit": "must be between 1 and 50"}},
+		},
+		{
+			"Wrapped date error",
+			fmt.Errorf("invalid date range: %w", validateDateRange("2024-13-01", "2024-12-31")),
+			APIError{Code: errCodeInvalidDate, Message: "invalid start date format '2024-13-01', expected YYYY-MM-DD", Details: map[string]string{"startDate": "must be a date in YYYY-MM-DD format"}},
+		},
+		{
+			"Plain error",
+			errors.New("bad input"),
+			APIError{Code: errCodeInvalidParameter, Message: "bad input"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requestID string
+			w := httptest.NewRecorder()
+			withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestID = requestIDFrom(r.Context())
+				writeValidationError(w, r, tt.err)
+			})).ServeHTTP(w, httptest.NewRequest("GET", "/api/line_delay", nil))
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, exposedHeaders, w.Header().Get("Access-Control-Expose-Headers"))
+
+			var apiErr APIError
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+			tt.expected.RequestID = requestID
+			assert.Equal(t, tt.expected, apiErr)
+		})
+	}
+}
+
+func TestValidateDateRangeErrors(t *testing.T) {
+	tests := []struct {
+		start, end string
+		code       string
+	}{
+		{"2024-01-01", "2024-02-01", ""},
+		{"01.01.2024", "2024-02-01", errCodeInvalidDate},
+		{"2024-01-01", "tomorrow", errCodeInvalidDate},
+		{"2024-02-01", "2024-01-01", errCodeInvalidDateRange},
+		{"2022-01-01", "2024-01-01", errCodeInvalidDateRange},
+	}
+
+	for _, tt := range tests {
+		err := validateDateRange(tt.start, tt.end)
+		if tt.code == "" {
+			assert.NoError(t, err)
+			continue
+		}
+
+		var validationErr *ValidationError
+		if assert.ErrorAs(t, err, &validationErr, "%s - %s", tt.start, tt.end) {
+			assert.Equal(t, tt.code, validationErr.Code)
+		}
+	}
+}
+
+func TestUnknownAPIRoute(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeNotFound(w, httptest.NewRequest("GET", "/api/nope", nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, errCodeNotFound, apiErr.Code)
+}
+
+func TestHandlerErrorEnvelope(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/line_delay?date=2023-12-25&interval=60", nil)
+	w := httptest.NewRecorder()
+
+	withRequestID(http.HandlerFunc(lineDelayHandler)).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, errCodeMissingParameter, apiErr.Code)
+	assert.Equal(t, map[string]string{
+		"realtime":  "is required",
+		"threshold": "is required",
+		"label":     "is required",
+		"south":     "is required",
+	}, apiErr.Details)
+	assert.Equal(t, w.Header().Get(requestIDHeader), apiErr.RequestID)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// redisCacheKeyPrefix namespaces cached results in Redis
+	redisCacheKeyPrefix = "mvg-observer:cache:"
+
+	defaultCacheSize       = 1000
+	defaultCacheTTLPast    = 7 * 24 * time.Hour
+	defaultCacheTTLCurrent = time.Minute
+
+	// cacheSettleTime is how long after the end of a range late departures may
+	// still arrive. Ranges are only considered final after it has passed.
+	cacheSettleTime = time.Hour
+)
+
+// queryCache caches query results of the API handlers, nil disables caching
+var queryCache *QueryCache
+
+// cacheBackend stores encoded query results
+type cacheBackend interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// CacheStats contains the hit and miss counts of one endpoint
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// cacheCounters are the live counters behind CacheStats
+type cacheCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// QueryCache caches encoded query results and collapses concurrent
+// computations of the same key into one
+type QueryCache struct {
+	backend    cacheBackend
+	ttlPast    time.Duration
+	ttlCurrent time.Duration
+	group      singleflight.Group
+	counters   sync.Map // endpoint -> *cacheCounters
+}
+
+// NewQueryCache creates a cache on top of backend. ttlPast applies to
+// results of finished days, ttlCurrent to results that may still change.
+func NewQueryCache(backend cacheBackend, ttlPast, ttlCurrent time.Duration) *QueryCache {
+	return &QueryCache{
+		backend:    backend,
+		ttlPast:    ttlPast,
+		ttlCurrent: ttlCurrent,
+	}
+}
+
+// newQueryCacheFromConfig creates the cache selected by config.Backend,
+// "memory", "redis" or "none". The cache is nil for "none".
+func newQueryCacheFromConfig(config CacheConfig, redisClient redisCacheClient) (*QueryCache, error) {
+	switch config.Backend {
+	case "none":
+		return nil, nil
+	case "memory":
+		if config.Size < 1 {
+			return nil, fmt.Errorf("invalid cache size %d: must be positive", config.Size)
+		}
+		return NewQueryCache(newMemoryCache(config.Size), config.TTLPast, config.TTLCurrent), nil
+	case "redis":
+		return NewQueryCache(newRedisCache(redisClient), config.TTLPast, config.TTLCurrent), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.Backend)
+	}
+}
+
+// TTL returns how long a result covering data up to rangeEnd may be cached
+func (c *QueryCache) TTL(rangeEnd time.Time) time.Duration {
+	if c == nil {
+		return 0
+	}
+	if isFinalRange(rangeEnd) {
+		return c.ttlPast
+	}
+	return c.ttlCurrent
+}
+
+// Stats returns the hit and miss counts per endpoint
+func (c *QueryCache) Stats() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	c.counters.Range(func(key, value interface{}) bool {
+		counters := value.(*cacheCounters)
+		stats[key.(string)] = CacheStats{
+			Hits:   counters.hits.Load(),
+			Misses: counters.misses.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+// countersFor returns the counters of the endpoint a cache key belongs to
+func (c *QueryCache) countersFor(key string) *cacheCounters {
+	endpoint, _, _ := strings.Cut(key, "?")
+	counters, _ := c.counters.LoadOrStore(endpoint, &cacheCounters{})
+	return counters.(*cacheCounters)
+}
+
+// cachedResult is the outcome of a computation shared between callers
+type cachedResult struct {
+	encoded []byte
+	scans   *ScanReport
+}
+
+// cachedQuery returns the cached result for key or computes it. Concurrent
+// calls for the same key share a single computation. Errors and partial
+// results with skipped rows are not cached. A nil cache calls compute directly.
+func cachedQuery[T any](ctx context.Context, c *QueryCache, key string, ttl time.Duration, compute func(context.Context) (T, error)) (T, error) {
+	var result T
+	if c == nil {
+		return compute(ctx)
+	}
+
+	counters := c.countersFor(key)
+	if encoded, ok, err := c.backend.Get(ctx, key); err != nil {
+		cacheLog.WarnContext(ctx, "cache lookup failed", "key", key, "error", err)
+	} else if ok {
+		if err := json.Unmarshal(encoded, &result); err == nil {
+			counters.hits.Add(1)
+			return result, nil
+		} else {
+			cacheLog.WarnContext(ctx, "cached result is unreadable", "key", key, "error", err)
+			jsonDecodeFailures.WithLabelValues("cache").Inc()
+		}
+	}
+	counters.misses.Add(1)
+
+	for retried := false; ; retried = true {
+		// The leader runs compute and keeps its value, only the callers
+		// sharing it decode a copy of the encoded result
+		var leader bool
+		var computed T
+		ch := c.group.DoChan(key, func() (interface{}, error) {
+			leader = true
+			// Skipped rows are collected separately, so that every caller
+			// sharing the result learns about them
+			computeCtx, scans := withScanReport(ctx, false)
+			value, err := compute(computeCtx)
+			if err != nil {
+				return nil, err
+			}
+
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode result: %w", err)
+			}
+			if !scans.Partial() {
+				if err := c.backend.Set(ctx, key, encoded, ttl); err != nil {
+					cacheLog.WarnContext(ctx, "cache store failed", "key", key, "error", err)
+				}
+			}
+			computed = value
+			return cachedResult{encoded: encoded, scans: scans}, nil
+		})
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case res := <-ch:
+			// The request computing the shared result went away or ran out of
+			// time, compute it once more under our own context and deadline
+			if !leader && !retried && res.Shared && ctx.Err() == nil &&
+				(errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+				continue
+			}
+			if res.Err != nil {
+				return result, res.Err
+			}
+
+			shared := res.Val.(cachedResult)
+			if err := scanReportFrom(ctx).merge(shared.scans); err != nil {
+				return result, err
+			}
+			if leader {
+				return computed, nil
+			}
+			// Every waiter decodes its own copy, so results are never shared
+			if err := json.Unmarshal(shared.encoded, &result); err != nil {
+				jsonDecodeFailures.WithLabelValues("cache").Inc()
+				return result, fmt.Errorf("failed to decode result: %w", err)
+			}
+			return result, nil
+		}
+	}
+}
+
+// cacheKey builds a normalized cache key from an endpoint name and its
+// parameters given as alternating names and values
+func cacheKey(endpoint string, params ...string) string {
+	values := url.Values{}
+	for i := 0; i+1 < len(params); i += 2 {
+		values.Set(params[i], params[i+1])
+	}
+	// Encode sorts by parameter name, so the order of params does not matter
+	return endpoint + "?" + values.Encode()
+}
+
+// rangeEnd returns the exclusive end of a range ending at the start of
+// the service day of date, falling back to now for unparsable dates
+func rangeEnd(date string, dayStartHour int) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return time.Now()
+	}
+	return t.Add(time.Duration(dayStartHour) * time.Hour)
+}
+
+// memoryCache is a size bounded in-memory LRU cache
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+// memoryCacheEntry is the value of a memoryCache list element
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		m.order.Remove(element)
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+
+	m.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (m *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &memoryCacheEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if element, ok := m.entries[key]; ok {
+		element.Value = entry
+		m.order.MoveToFront(element)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(entry)
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+// redisCacheClient defines the Redis operations used by redisCache
+type redisCacheClient interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+}
+
+// redisCache stores results in Redis, sharing them between instances
+type redisCache struct {
+	client redisCacheClient
+}
+
+func newRedisCache(client redisCacheClient) *redisCache {
+	return &redisCache{client: client}
+}
+
+func (r *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := r.client.Get(ctx, redisCacheKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (r *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, redisCacheKeyPrefix+key, value, ttl).Err()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache(2)
+
+	cache.Set(ctx, "a", []byte("1"), time.Minute)
+	cache.Set(ctx, "b", []byte("2"), time.Minute)
+
+	// Reading a makes b the least recently used entry
+	_, ok, _ := cache.Get(ctx, "a")
+	assert.True(t, ok)
+
+	cache.Set(ctx, "c", []byte("3"), time.Minute)
+
+	_, ok, _ = cache.Get(ctx, "b")
+	assert.False(t, ok)
+	value, ok, _ := cache.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	_, ok, _ = cache.Get(ctx, "c")
+	assert.True(t, ok)
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache(10)
+
+	cache.Set(ctx, "a", []byte("1"), -time.Second)
+
+	_, ok, _ := cache.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.order.Len())
+}
+
+func TestCachedQuery(t *testing.T) {
+	ctx := context.Background()
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	var calls atomic.Int32
+	compute := func(context.Context) (LineStats, error) {
+		calls.Add(1)
+		return LineStats{AvgDelay: 1.5, Departures: 10}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := cachedQuery(ctx, cache, "line_stats?label=U1", time.Minute, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, LineStats{AvgDelay: 1.5, Departures: 10}, result)
+	}
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, map[string]CacheStats{"line_stats": {Hits: 2, Misses: 1}}, cache.Stats())
+}
+
+func TestCachedQueryErrorsAreNotCached(t *testing.T) {
+	ctx := context.Background()
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	var calls atomic.Int32
+	compute := func(context.Context) (LineStats, error) {
+		calls.Add(1)
+		return LineStats{}, errors.New("query failed")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := cachedQuery(ctx, cache, "line_stats?label=U1", time.Minute, compute)
+		assert.EqualError(t, err, "query failed")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCachedQueryCollapsesConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	compute := func(context.Context) ([]DelayBucket, error) {
+		calls.Add(1)
+		<-release
+		return []DelayBucket{{Range: "On Time", Count: 1}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := cachedQuery(ctx, cache, "station_stats?station=1", time.Minute, compute)
+			assert.NoError(t, err)
+			assert.Len(t, result, 1)
+		}()
+	}
+
+	// Give all goroutines the chance to join the in-flight computation
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCachedQueryRetriesAfterLeaderTimeout(t *testing.T) {
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	var calls atomic.Int32
+	compute := func(ctx context.Context) (int, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return 0, fmt.Errorf("query failed: %w", ctx.Err())
+		}
+		return 42, nil
+	}
+
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := cachedQuery(leaderCtx, cache, "rankings?", time.Minute, compute)
+		leaderErr <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The waiter has time left when the leader's deadline passes
+	result, err := cachedQuery(context.Background(), cache, "rankings?", time.Minute, compute)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+	assert.ErrorIs(t, <-leaderErr, context.DeadlineExceeded)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCachedQueryDoesNotRetryQueryTimeouts(t *testing.T) {
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	compute := func(context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		// ClickHouse or the socket deadline aborted the query, not a context
+		return 0, fmt.Errorf("query failed: %w", os.ErrDeadlineExceeded)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cachedQuery(context.Background(), cache, "rankings?", time.Minute, compute)
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Neither the leader nor the waiters run the heavy query again
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCachedQueryReturnsComputedValueToLeader(t *testing.T) {
+	cache := NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+
+	computed := &LineStats{Departures: 10}
+	result, err := cachedQuery(context.Background(), cache, "line_stats?label=U1", time.Minute, func(context.Context) (*LineStats, error) {
+		return computed, nil
+	})
+	assert.NoError(t, err)
+	assert.Same(t, computed, result, "the leader does not decode its own result")
+
+	result, err = cachedQuery(context.Background(), cache, "line_stats?label=U1", time.Minute, func(context.Context) (*LineStats, error) {
+		return nil, errors.New("not called on a hit")
+	})
+	assert.NoError(t, err)
+	assert.NotSame(t, computed, result)
+	assert.Equal(t, computed, result)
+}
+
+func TestCachedQueryWithoutCache(t *testing.T) {
+	result, err := cachedQuery(context.Background(), nil, "rankings?", time.Minute, func(context.Context) (int, error) {
+		return 42, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+}
+
+func TestCacheKey(t *testing.T) {
+	assert.Equal(t,
+		cacheKey("line_delay", "date", "2024-01-01", "label", "U1"),
+		cacheKey("line_delay", "label", "U1", "date", "2024-01-01"),
+	)
+	assert.NotEqual(t,
+		cacheKey("line_delay", "label", "U1"),
+		cacheKey("global_delay", "label", "U1"),
+	)
+	assert.Equal(t, "rankings?limit=10&minDepartures=100", cacheKey("rankings", "minDepartures", "100", "limit", "10"))
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	cache := NewQueryCache(newMemoryCache(1), time.Hour, time.Minute)
+
+	assert.Equal(t, time.Hour, cache.TTL(rangeEnd("2023-12-25", 0)))
+	assert.Equal(t, time.Minute, cache.TTL(time.Now()))
+	assert.Equal(t, time.Minute, cache.TTL(time.Now().Add(-30*time.Minute)))
+	assert.Equal(t, time.Minute, cache.TTL(rangeEnd("invalid", 0)))
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	client := &EnhancedMockRedisClient{}
+	cache := newRedisCache(client)
+
+	client.On("Get", ctx, redisCacheKeyPrefix+"hit").Return(NewMockStringCmd("value", nil))
+	client.On("Get", ctx, redisCacheKeyPrefix+"miss").Return(NewMockStringCmd("", redis.Nil))
+	client.On("Set", ctx, redisCacheKeyPrefix+"key", []byte("value"), time.Minute).Return(redis.NewStatusResult("OK", nil))
+
+	value, ok, err := cache.Get(ctx, "hit")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+
+	_, ok, err = cache.Get(ctx, "miss")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, cache.Set(ctx, "key", []byte("value"), time.Minute))
+	client.AssertExpectations(t)
+}
+
+func TestNewQueryCacheFromConfig(t *testing.T) {
+	config := defaultConfig().Cache
+	config.Backend = "none"
+	cache, err := newQueryCacheFromConfig(config, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, cache)
+
+	config.Backend = "memory"
+	config.Size = 5
+	cache, err = newQueryCacheFromConfig(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cache.backend.(*memoryCache).size)
+	assert.Equal(t, defaultCacheTTLPast, cache.ttlPast)
+
+	config.Size = 0
+	_, err = newQueryCacheFromConfig(config, nil)
+	assert.Error(t, err)
+
+	config.Backend = "memcached"
+	_, err = newQueryCacheFromConfig(config, nil)
+	assert.Error(t, err)
+}
+
+// Ensure the mock keeps satisfying the interface used by the Redis backend
+var _ redisCacheClient = (*EnhancedMockRedisClient)(nil)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
@@ -9,16 +11,24 @@ type ClickHouseService struct {
 	conn        driver.Conn
 	stationStats *StationStatsService
 	lineQueries  *LineQueryService
+	lineStats    *LineStatsService
+	departures   *DepartureService
 }
 
 // NewClickHouseService creates a new service with database connection
-func NewClickHouseService() *ClickHouseService {
-	conn := connectClickhouse()
+func NewClickHouseService(config DatabaseConfig) (*ClickHouseService, error) {
+	conn, err := connectClickhouse(config)
+	if err != nil {
+		return nil, err
+	}
+	conn = instrumentConn(conn)
 	return &ClickHouseService{
 		conn:         conn,
 		stationStats: NewStationStatsService(conn),
 		lineQueries:  NewLineQueryService(conn),
-	}
+		lineStats:    NewLineStatsService(conn),
+		departures:   NewDepartureService(conn),
+	}, nil
 }
 
 // StationStats returns the station statistics service
@@ -31,6 +41,21 @@ func (s *ClickHouseService) LineQueries() *LineQueryService {
 	return s.lineQueries
 }
 
+// LineStats returns the line statistics service
+func (s *ClickHouseService) LineStats() *LineStatsService {
+	return s.lineStats
+}
+
+// Departures returns the raw departure service
+func (s *ClickHouseService) Departures() *DepartureService {
+	return s.departures
+}
+
+// Ping checks that ClickHouse answers
+func (s *ClickHouseService) Ping(ctx context.Context) error {
+	return s.conn.Ping(ctx)
+}
+
 // Close closes the database connection
 func (s *ClickHouseService) Close() error {
 	if s.conn != nil {
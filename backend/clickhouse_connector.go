@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Delays between connection attempts, doubled after every failure
+const (
+	clickhouseMinBackoff = time.Second
+	clickhouseMaxBackoff = time.Minute
+)
+
+// clickhouseConnector connects clickhouseService, readiness reports its
+// progress. main sets connect from the configuration.
+var clickhouseConnector = &ClickHouseConnector{
+	minBackoff: clickhouseMinBackoff,
+	maxBackoff: clickhouseMaxBackoff,
+}
+
+// ClickHouseConnector keeps trying to connect to ClickHouse with exponential
+// backoff, so that an instance started during a database outage recovers on
+// its own instead of staying in static-only mode.
+type ClickHouseConnector struct {
+	connect    func() (*ClickHouseService, error)
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu          sync.Mutex
+	attempts    int
+	lastErr     error
+	nextAttempt time.Time
+}
+
+// run connects and publishes the service in clickhouseService. It returns
+// once connected or when ctx is done.
+func (c *ClickHouseConnector) run(ctx context.Context) {
+	backoff := c.minBackoff
+	for {
+		service, err := c.connect()
+		if err == nil {
+			if ctx.Err() != nil {
+				// Connected during shutdown, nobody would close it
+				service.Close()
+				return
+			}
+			clickhouseService.Store(service)
+			c.record(nil, time.Time{})
+			clickhouseLog.Info("connected")
+			return
+		}
+
+		c.record(err, time.Now().Add(backoff))
+		clickhouseLog.Warn("connection failed, retrying", "backoff", backoff, "error", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, c.maxBackoff)
+	}
+}
+
+func (c *ClickHouseConnector) record(err error, nextAttempt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.attempts++
+	c.lastErr = err
+	c.nextAttempt = nextAttempt
+}
+
+// status describes the connection attempts for the health check, it is empty
+// before the first attempt failed. The error itself is only logged by run.
+func (c *ClickHouseConnector) status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lastErr == nil {
+		return ""
+	}
+	return fmt.Sprintf("connecting, attempt %d failed; next attempt at %s",
+		c.attempts, c.nextAttempt.UTC().Format(time.RFC3339))
+}
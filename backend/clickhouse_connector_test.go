@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClickHouseConnectorRetries(t *testing.T) {
+	originalService := clickhouseService.Load()
+	defer func() { clickhouseService.Store(originalService) }()
+	clickhouseService.Store(nil)
+
+	service := &ClickHouseService{}
+	var delays []time.Time
+	connector := &ClickHouseConnector{
+		connect: func() (*ClickHouseService, error) {
+			delays = append(delays, time.Now())
+			if len(delays) < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return service, nil
+		},
+		minBackoff: 5 * time.Millisecond,
+		maxBackoff: 8 * time.Millisecond,
+	}
+
+	connector.run(context.Background())
+
+	assert.Same(t, service, clickhouseService.Load())
+	assert.Len(t, delays, 3)
+	assert.GreaterOrEqual(t, delays[1].Sub(delays[0]), 5*time.Millisecond)
+	assert.GreaterOrEqual(t, delays[2].Sub(delays[1]), 8*time.Millisecond, "backoff doubles up to the maximum")
+	assert.Empty(t, connector.status())
+}
+
+func TestClickHouseConnectorStopsOnShutdown(t *testing.T) {
+	originalService := clickhouseService.Load()
+	defer func() { clickhouseService.Store(originalService) }()
+	clickhouseService.Store(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connector := &ClickHouseConnector{
+		connect: func() (*ClickHouseService, error) {
+			cancel()
+			return nil, errors.New("connection refused")
+		},
+		minBackoff: time.Hour,
+		maxBackoff: time.Hour,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connector.run(ctx)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connector kept waiting after shutdown")
+	}
+	assert.Nil(t, clickhouseService.Load())
+	assert.Contains(t, connector.status(), "attempt 1 failed")
+	assert.NotContains(t, connector.status(), "connection refused")
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
@@ -9,7 +11,9 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
-// MockDriver implements the driver.Conn interface for testing
+// MockDriver implements the driver.Conn interface for testing. Query and
+// QueryRow also accept a function of the query context as return value, to
+// simulate latency or failures that depend on the context.
 type MockDriver struct {
 	mock.Mock
 }
@@ -18,6 +22,9 @@ func (m *MockDriver) Query(ctx context.Context, query string, args ...interface{
 	mockArgs := []interface{}{ctx, query}
 	mockArgs = append(mockArgs, args...)
 	results := m.Called(mockArgs...)
+	if fn, ok := results.Get(0).(func(context.Context) (driver.Rows, error)); ok {
+		return fn(ctx)
+	}
 	return results.Get(0).(driver.Rows), results.Error(1)
 }
 
@@ -25,6 +32,9 @@ func (m *MockDriver) QueryRow(ctx context.Context, query string, args ...interfa
 	mockArgs := []interface{}{ctx, query}
 	mockArgs = append(mockArgs, args...)
 	results := m.Called(mockArgs...)
+	if fn, ok := results.Get(0).(func(context.Context) driver.Row); ok {
+		return fn(ctx)
+	}
 	return results.Get(0).(driver.Row)
 }
 
@@ -98,17 +108,18 @@ func (m *MockRows) Scan(dest ...interface{}) error {
 	if m.pos == 0 || m.pos > len(m.data) {
 		return assert.AnError
 	}
-	row := m.data[m.pos-1]
+	return assignMockRow(m.data[m.pos-1], dest)
+}
+
+// assignMockRow copies the values of a canned row into dest. An error in
+// place of a value simulates a column that cannot be scanned.
+func assignMockRow(row []interface{}, dest []interface{}) error {
 	for i, val := range row {
+		if err, ok := val.(error); ok {
+			return err
+		}
 		if i < len(dest) {
-			switch d := dest[i].(type) {
-			case *string:
-				*d = val.(string)
-			case *[]map[string]string:
-				*d = val.([]map[string]string)
-			case *int32:
-				*d = val.(int32)
-			}
+			reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(val))
 		}
 	}
 	return nil
@@ -144,6 +155,42 @@ func (m *MockRows) Err() error {
 	return results.Error(0)
 }
 
+// newMockRows returns rows with the given data that can be iterated to the end
+func newMockRows(data ...[]interface{}) *MockRows {
+	rows := &MockRows{data: data}
+	rows.On("Err").Return(nil)
+	rows.On("Close").Return(nil)
+	return rows
+}
+
+// queryNamed matches the context of the query with the given name
+func queryNamed(name string) interface{} {
+	return mock.MatchedBy(func(ctx context.Context) bool { return queryNameFrom(ctx) == name })
+}
+
+// MockRow implements the driver.Row interface for testing
+type MockRow struct {
+	mock.Mock
+	data []interface{}
+	err  error
+}
+
+func (m *MockRow) Err() error {
+	return m.err
+}
+
+func (m *MockRow) Scan(dest ...interface{}) error {
+	if m.err != nil {
+		return m.err
+	}
+	return assignMockRow(m.data, dest)
+}
+
+func (m *MockRow) ScanStruct(dest interface{}) error {
+	results := m.Called(dest)
+	return results.Error(0)
+}
+
 func TestGetDayRange(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -194,6 +241,67 @@ func TestGetDayRange(t *testing.T) {
 	}
 }
 
+func TestGetServiceDayRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		startHour   int
+		expectStart string
+		expectEnd   string
+		expectError bool
+	}{
+		{
+			name:        "Calendar day",
+			input:       "2023-12-25",
+			startHour:   0,
+			expectStart: "2023-12-25",
+			expectEnd:   "2023-12-26",
+		},
+		{
+			name:        "Service day starting at 03:00",
+			input:       "2023-12-25",
+			startHour:   3,
+			expectStart: "2023-12-25 03:00:00",
+			expectEnd:   "2023-12-26 03:00:00",
+		},
+		{
+			name:        "Service day across month boundary",
+			input:       "2023-12-31",
+			startHour:   3,
+			expectStart: "2023-12-31 03:00:00",
+			expectEnd:   "2024-01-01 03:00:00",
+		},
+		{
+			name:        "Invalid start hour",
+			input:       "2023-12-25",
+			startHour:   24,
+			expectError: true,
+		},
+		{
+			name:        "Invalid date format",
+			input:       "2023/12/25",
+			startHour:   3,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := getServiceDayRange(tt.input, tt.startHour)
+
+			if tt.expectError {
+				assert.Error(t, err)
+				assert.Empty(t, start)
+				assert.Empty(t, end)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectStart, start)
+				assert.Equal(t, tt.expectEnd, end)
+			}
+		})
+	}
+}
+
 func TestGetGlobalDelay(t *testing.T) {
 	mockConn := &MockDriver{}
 	mockRows := &MockRows{
@@ -209,7 +317,7 @@ func TestGetGlobalDelay(t *testing.T) {
 	}
 
 	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"), 
-		"2023-12-25", "2023-12-26", "60", "5", "1").Return(mockRows, nil)
+		"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil)
 	mockRows.On("Err").Return(nil)
 	mockRows.On("Close").Return(nil)
 
@@ -217,7 +325,7 @@ func TestGetGlobalDelay(t *testing.T) {
 		conn: mockConn,
 		lineQueries: NewLineQueryService(mockConn),
 	}
-	results, err := service.LineQueries().GetGlobalDelay("2023-12-25", "60", "5", "1")
+	results, err := service.LineQueries().GetGlobalDelay(context.Background(), "2023-12-25", 60, 5, true, DelayQueryOptions{})
 	assert.NoError(t, err)
 
 	assert.Len(t, results, 2)
@@ -244,7 +352,7 @@ func TestGetDelayForLine(t *testing.T) {
 	}
 
 	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"), 
-		"2023-12-25", "2023-12-26", "60", "5", "U1", "1", "1").Return(mockRows, nil)
+		"2023-12-25", "2023-12-26", 60, 5, "U1", uint8(1), uint8(1)).Return(mockRows, nil)
 	mockRows.On("Err").Return(nil)
 	mockRows.On("Close").Return(nil)
 
@@ -252,7 +360,7 @@ func TestGetDelayForLine(t *testing.T) {
 		conn: mockConn,
 		lineQueries: NewLineQueryService(mockConn),
 	}
-	results, err := service.LineQueries().GetDelayForLine("2023-12-25", "60", "5", "U1", "1", "1")
+	results, err := service.LineQueries().GetDelayForLine(context.Background(), "2023-12-25", 60, 5, "U1", true, true, DelayQueryOptions{})
 	assert.NoError(t, err)
 
 	assert.Len(t, results, 2)
@@ -267,6 +375,270 @@ func TestGetDelayForLine(t *testing.T) {
 	mockRows.AssertExpectations(t)
 }
 
+func TestGetGlobalDelayExtended(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{
+		data: [][]interface{}{
+			{"de:09162:1", []map[string]string{
+				{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20.0",
+					"medianDelay": "1", "p90Delay": "6", "p95Delay": "8", "maxDelay": "40", "stddevDelay": "3.1"},
+			}},
+		},
+	}
+
+	extendedQuery := mock.MatchedBy(func(query string) bool {
+		return strings.Contains(query, "quantiles(0.5, 0.9, 0.95)(delayInMinutes)") &&
+			strings.Contains(query, "'stddevDelay'")
+	})
+	mockConn.On("Query", mock.Anything, extendedQuery,
+		"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil)
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	service := NewLineQueryService(mockConn)
+	results, err := service.GetGlobalDelay(context.Background(), "2023-12-25", 60, 5, true, DelayQueryOptions{Extended: true})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "40", results[0].Buckets[0]["maxDelay"])
+
+	mockConn.AssertExpectations(t)
+}
+
+func TestDelaySpreadScan(t *testing.T) {
+	scan := delaySpreadScan{quantiles: []float64{1, 6, 8}, max: 40, stddev: 3.5}
+	assert.Equal(t, &DelaySpread{Median: 1, P90: 6, P95: 8, Max: 40, StdDev: 3.5}, scan.spread())
+	assert.Len(t, scan.dest(), 3)
+
+	assert.Equal(t, "", optionalSQL(false, delaySpreadColumns))
+	assert.Equal(t, delaySpreadColumns, optionalSQL(true, delaySpreadColumns))
+}
+
+func TestGetLineStatsInvalidDateRange(t *testing.T) {
+	mockConn := &MockDriver{}
+	service := NewLineStatsService(mockConn)
+
+	_, err := service.GetLineStats(context.Background(), "U2", "2023-02-01", "2023-01-01", 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid date range")
+
+	// No query must reach the database for invalid input
+	mockConn.AssertExpectations(t)
+}
+
+func TestGetLineStats(t *testing.T) {
+	mockConn := &MockDriver{}
+
+	mockConn.On("QueryRow", queryNamed("line_station_count"), mock.Anything, "U2").
+		Return(&MockRow{data: []interface{}{uint64(27)}})
+	mockConn.On("QueryRow", queryNamed("line_basic_stats"), mock.Anything, delayedThresholdMinutes, "U2", "2023-01-01", "2023-02-01").
+		Return(&MockRow{data: []interface{}{1.4, uint64(1000), 87.5}})
+	mockConn.On("Query", queryNamed("line_monthly_stats"), mock.Anything, 0, delayedThresholdMinutes, "U2", "2023-01-01", "2023-02-01").
+		Return(newMockRows([]interface{}{"2023-01", 1.4, uint64(1000), 87.5}), nil)
+	mockConn.On("Query", queryNamed("line_hourly_stats"), mock.Anything, delayedThresholdMinutes, "U2", "2023-01-01", "2023-02-01").
+		Return(newMockRows([]interface{}{uint8(7), 2.0, uint64(400), 80.0}), nil)
+	mockConn.On("Query", queryNamed("line_worst_stations"), mock.Anything, delayedThresholdMinutes, "U2", "2023-01-01", "2023-02-01", worstStationsLimit).
+		Return(newMockRows([]interface{}{"de:09162:6", 3.5, uint64(80), 60.0}), nil)
+	mockConn.On("QueryRow", queryNamed("line_termini"), mock.Anything, "U2").
+		Return(&MockRow{data: []interface{}{"Feldmoching", "Messestadt Ost"}})
+
+	// Short workings are classified by stop order, so there are no rows per destination
+	directionArgs := []interface{}{queryNamed("line_direction_distribution"), mock.Anything, "U2"}
+	_, bucketArgs := delayBucketExpr(defaultDelayBucketEdges)
+	directionArgs = append(directionArgs, bucketArgs...)
+	directionArgs = append(directionArgs, "2023-01-01", "2023-02-01")
+	mockConn.On("Query", directionArgs...).Return(newMockRows(
+		[]interface{}{uint8(0), uint32(0), uint64(300), 0.0},
+		[]interface{}{uint8(0), uint32(2), uint64(100), 400.0},
+		[]interface{}{uint8(1), uint32(0), uint64(500), 0.0},
+		[]interface{}{uint8(1), uint32(4), uint64(100), 1500.0},
+		[]interface{}{uint8(1), uint32(9), uint64(1), 99.0}, // unknown bucket
+	), nil)
+
+	report, err := NewLineStatsService(mockConn).GetLineStats(context.Background(), "U2", "2023-01-01", "2023-02-01", 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "U2", report.Label)
+	assert.Equal(t, 1.4, report.AvgDelay)
+	assert.Equal(t, uint64(1000), report.TotalDepartures)
+	assert.Equal(t, 87.5, report.PunctualityPercentage)
+	assert.Equal(t, []LineMonthlyData{{Month: "2023-01", AvgDelay: 1.4, Departures: 1000, PunctualityPercentage: 87.5}}, report.MonthlyStats)
+	assert.Equal(t, []LineHourlyData{{Hour: 7, AvgDelay: 2.0, Departures: 400, PunctualityPercentage: 80.0}}, report.HourlyStats)
+	assert.Equal(t, []StationDelayData{{Station: "de:09162:6", Name: friendlyNames["de:09162:6"], AvgDelay: 3.5, Departures: 80, PunctualityPercentage: 60.0}}, report.WorstStations)
+
+	assert.Equal(t, []DirectionDelayData{
+		{
+			Direction:  "Feldmoching",
+			AvgDelay:   1.0,
+			Departures: 400,
+			Distribution: []DelayBucket{
+				{Range: "On Time", Count: 300},
+				{Range: "3-5 min", Count: 100},
+			},
+		},
+		{
+			Direction:  "Messestadt Ost",
+			Southbound: true,
+			AvgDelay:   2.5,
+			Departures: 600,
+			Distribution: []DelayBucket{
+				{Range: "On Time", Count: 500},
+				{Range: "10+ min", Count: 100},
+			},
+		},
+	}, report.DirectionDistribution)
+
+	mockConn.AssertExpectations(t)
+}
+
+func TestGetLineStatsDirectionsWithoutDepartures(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := newMockRows()
+
+	mockConn.On("QueryRow", mock.Anything, mock.Anything, "U2").
+		Return(&MockRow{data: []interface{}{"Feldmoching", "Messestadt Ost"}})
+	mockConn.On("Query", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(mockRows, nil)
+
+	directions, err := NewLineStatsService(mockConn).getDirectionDistribution(context.Background(), "U2", "2023-01-01", "2023-02-01")
+	assert.NoError(t, err)
+	assert.Equal(t, []DirectionDelayData{
+		{Direction: "Feldmoching", Distribution: []DelayBucket{}},
+		{Direction: "Messestadt Ost", Southbound: true, Distribution: []DelayBucket{}},
+	}, directions)
+}
+
+func TestRankBy(t *testing.T) {
+	entries := []RankingEntry{
+		{ID: "de:09162:1", AvgDelay: 1.5, Departures: 300, PunctualityPercentage: 90},
+		{ID: "de:09162:2", AvgDelay: 3.0, Departures: 100, PunctualityPercentage: 70},
+		{ID: "de:09162:5", AvgDelay: 0.5, Departures: 200, PunctualityPercentage: 98},
+		{ID: "de:09162:6", AvgDelay: 1.5, Departures: 150, PunctualityPercentage: 85},
+	}
+
+	rankings := rankEntries(entries, 2)
+
+	ids := func(list []RankingEntry) []string {
+		result := make([]string, len(list))
+		for i, entry := range list {
+			result[i] = entry.ID
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"de:09162:2", "de:09162:1"}, ids(rankings.AvgDelay.Top))
+	assert.Equal(t, []string{"de:09162:5", "de:09162:6"}, ids(rankings.AvgDelay.Bottom))
+	assert.Equal(t, []string{"de:09162:5", "de:09162:1"}, ids(rankings.Punctuality.Top))
+	assert.Equal(t, []string{"de:09162:2", "de:09162:6"}, ids(rankings.Punctuality.Bottom))
+	assert.Equal(t, []string{"de:09162:1", "de:09162:5"}, ids(rankings.Departures.Top))
+	assert.Equal(t, []string{"de:09162:2", "de:09162:6"}, ids(rankings.Departures.Bottom))
+
+	// Limits larger than the number of entries return everything
+	all := rankBy(entries, 10, func(e RankingEntry) float64 { return e.AvgDelay })
+	assert.Len(t, all.Top, 4)
+	assert.Len(t, all.Bottom, 4)
+
+	empty := rankBy(nil, 10, func(e RankingEntry) float64 { return e.AvgDelay })
+	assert.Empty(t, empty.Top)
+	assert.Empty(t, empty.Bottom)
+}
+
+func TestGetRankings(t *testing.T) {
+	mockConn := &MockDriver{}
+
+	stationQuery := mock.MatchedBy(func(query string) bool { return strings.Contains(query, "station as id") })
+	lineQuery := mock.MatchedBy(func(query string) bool { return strings.Contains(query, "label as id") })
+	mockConn.On("Query", mock.Anything, stationQuery, delayedThresholdMinutes, "2023-01-01", "2023-02-01", uint64(100)).
+		Return(newMockRows(
+			[]interface{}{"de:09162:1", 1.5, uint64(300), 10.0},
+			[]interface{}{"de:09162:2", 3.0, uint64(100), 30.0},
+			[]interface{}{"de:09162:5", 0.5, uint64(200), 2.0},
+		), nil)
+	mockConn.On("Query", mock.Anything, lineQuery, delayedThresholdMinutes, "2023-01-01", "2023-02-01", uint64(100)).
+		Return(newMockRows(
+			[]interface{}{"U1", 1.2, uint64(5000), 12.0},
+			[]interface{}{"U2", 2.4, uint64(4000), 25.0},
+		), nil)
+
+	rankings, err := NewStationStatsService(mockConn).GetRankings(context.Background(), "2023-01-01", "2023-02-01", 2, 100)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "2023-01-01", rankings.StartDate)
+	assert.Equal(t, "2023-02-01", rankings.EndDate)
+	assert.Equal(t, uint64(100), rankings.MinDepartures)
+
+	// The limit cuts three stations down to two per list
+	assert.Equal(t, []RankingEntry{
+		{ID: "de:09162:2", Name: friendlyNames["de:09162:2"], AvgDelay: 3.0, Departures: 100, PunctualityPercentage: 70},
+		{ID: "de:09162:1", Name: friendlyNames["de:09162:1"], AvgDelay: 1.5, Departures: 300, PunctualityPercentage: 90},
+	}, rankings.Stations.AvgDelay.Top)
+	assert.Equal(t, []RankingEntry{
+		{ID: "de:09162:5", Name: friendlyNames["de:09162:5"], AvgDelay: 0.5, Departures: 200, PunctualityPercentage: 98},
+		{ID: "de:09162:1", Name: friendlyNames["de:09162:1"], AvgDelay: 1.5, Departures: 300, PunctualityPercentage: 90},
+	}, rankings.Stations.AvgDelay.Bottom)
+	assert.Equal(t, "de:09162:1", rankings.Stations.Departures.Top[0].ID)
+	assert.Equal(t, "de:09162:5", rankings.Stations.Punctuality.Top[0].ID)
+
+	// Lines carry no friendly name
+	assert.Equal(t, []RankingEntry{
+		{ID: "U2", AvgDelay: 2.4, Departures: 4000, PunctualityPercentage: 75},
+		{ID: "U1", AvgDelay: 1.2, Departures: 5000, PunctualityPercentage: 88},
+	}, rankings.Lines.AvgDelay.Top)
+	assert.Equal(t, "U1", rankings.Lines.Punctuality.Top[0].ID)
+
+	mockConn.AssertExpectations(t)
+}
+
+func TestDelayBucketLabels(t *testing.T) {
+	// Default edges must keep the historical bucket names
+	assert.Equal(t,
+		[]string{"On Time", "1-2 min", "3-5 min", "6-10 min", "10+ min"},
+		delayBucketLabels(defaultDelayBucketEdges))
+
+	assert.Equal(t,
+		[]string{"On Time", "1 min", "2-3 min", "4-5 min", "6-10 min", "11-20 min", "20+ min"},
+		delayBucketLabels([]int{0, 1, 3, 5, 10, 20}))
+
+	assert.Equal(t,
+		[]string{"<=-1 min", "0-5 min", "5+ min"},
+		delayBucketLabels([]int{-1, 5}))
+}
+
+func TestDelayBucketExpr(t *testing.T) {
+	expr, args := delayBucketExpr([]int{0, 5})
+
+	assert.Equal(t, "toUInt32(multiIf(delayInMinutes <= ?, 0, delayInMinutes <= ?, 1, 2))", expr)
+	assert.Equal(t, []interface{}{0, 5}, args)
+}
+
+func TestParseBucketEdges(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    []int
+		expectError bool
+	}{
+		{name: "Valid edges", input: "0,1,3,5,10,20", expected: []int{0, 1, 3, 5, 10, 20}},
+		{name: "Whitespace", input: "0, 2, 5", expected: []int{0, 2, 5}},
+		{name: "Negative edge", input: "-2,0", expected: []int{-2, 0}},
+		{name: "Not increasing", input: "0,5,5", expectError: true},
+		{name: "Not a number", input: "0,a", expectError: true},
+		{name: "Empty", input: "", expectError: true},
+		{name: "Too many edges", input: "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edges, err := parseBucketEdges(tt.input)
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, edges)
+			}
+		})
+	}
+}
+
 // Benchmark tests for performance
 func BenchmarkGetDayRange(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -301,7 +673,7 @@ func BenchmarkGetGlobalDelayParsing(b *testing.B) {
 			conn: mockConn,
 			lineQueries: NewLineQueryService(mockConn),
 		}
-		_, err := service.LineQueries().GetGlobalDelay("2023-12-25", "60", "5", "1")
+		_, err := service.LineQueries().GetGlobalDelay(context.Background(), "2023-12-25", 60, 5, true, DelayQueryOptions{})
 		if err == nil {
 			b.Errorf("Expected error but got none")
 		}
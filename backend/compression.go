@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the body size below which compression costs more than it saves
+const minCompressSize = 1024
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+)
+
+// supportedEncodings lists the content codings we produce, in order of
+// preference when a client accepts several with the same quality
+var supportedEncodings = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+// zstdEncoder is shared between requests, EncodeAll is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// negotiateEncoding picks the content coding for a response based on the
+// Accept-Encoding request header. Without the header, or when no supported
+// coding is acceptable, the body is sent uncompressed.
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		quality := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		qualities[name] = quality
+	}
+
+	best, bestQuality := encodingIdentity, 0.0
+	for _, encoding := range supportedEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressBody encodes body with the given content coding
+func compressBody(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case encodingIdentity:
+		return body, nil
+	case encodingZstd:
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4)), nil
+	}
+
+	var buf bytes.Buffer
+	cw, err := compressWriter(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressWriter returns a writer encoding everything written to it with the
+// given content coding. Closing it flushes the encoder but does not close w.
+func compressWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingIdentity:
+		return nopWriteCloser{w}, nil
+	case encodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case encodingBrotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// nopWriteCloser adds a no-op Close to an io.Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
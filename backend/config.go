@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server. Every setting is read from, in
+// increasing precedence, its default, the YAML file named by -config or
+// CONFIG_FILE, the environment variables in its env tag and the command line
+// flag named after its YAML path, e.g. -clickhouse.host. The first of several
+// environment variables is the preferred name, the others are aliases.
+//
+// Supported field types are string, []string, int, int64, bool and
+// time.Duration, lists are comma-separated in the environment and in flags.
+// The env tag of a nested struct is a prefix for the env tags of its fields.
+// Settings tagged secret are neither printed nor accepted as flags.
+type Config struct {
+	Listen          string        `yaml:"listen" env:"LISTEN_ADDR" help:"address the HTTP server listens on"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" help:"how long a shutdown waits for running requests"`
+
+	ClickHouse    DatabaseConfig     `yaml:"clickhouse"`
+	Redis         RedisConfig        `yaml:"redis"`
+	Cache         CacheConfig        `yaml:"cache"`
+	QueryTimeouts QueryTimeoutConfig `yaml:"queryTimeouts"`
+	Log           LogConfig          `yaml:"log"`
+}
+
+// RedisConfig configures the Redis connection and the live departure events
+type RedisConfig struct {
+	Host string `yaml:"host" env:"REDIS_HOST" help:"Redis host in standalone mode"`
+	Port string `yaml:"port" env:"REDIS_PORT" help:"Redis port in standalone mode"`
+	DB   int    `yaml:"db" env:"REDIS_DB" help:"Redis database of the station keys"`
+
+	Mode             string   `yaml:"mode" env:"REDIS_MODE" help:"standalone, sentinel or cluster"`
+	Addresses        []string `yaml:"addresses" env:"REDIS_ADDRESSES" help:"host:port of the sentinels or cluster nodes"`
+	MasterName       string   `yaml:"masterName" env:"REDIS_SENTINEL_MASTER" help:"name of the master monitored by the sentinels"`
+	Username         string   `yaml:"username" env:"REDIS_USERNAME" help:"Redis ACL user"`
+	Password         string   `yaml:"password" env:"REDIS_PASSWORD" secret:"true" help:"Redis password"`
+	SentinelPassword string   `yaml:"sentinelPassword" env:"REDIS_SENTINEL_PASSWORD" secret:"true" help:"password of the sentinels"`
+
+	TLS TLSConfig `yaml:"tls" env:"REDIS_TLS_"`
+
+	KeyPrefix               string        `yaml:"keyPrefix" env:"REDIS_KEY_PREFIX" help:"prefix of the station keys, any if empty"`
+	KeySeparator            string        `yaml:"keySeparator" env:"REDIS_KEY_SEPARATOR" help:"separator between key prefix and station ID"`
+	ConfigureKeyspaceEvents bool          `yaml:"configureKeyspaceEvents" env:"REDIS_CONFIGURE_KEYSPACE_EVENTS" help:"turn on the keyevents for string commands in Redis"`
+	StreamMaxLen            int64         `yaml:"streamMaxLen" env:"REDIS_STREAM_MAX_LEN" help:"number of departure updates kept in the event stream"`
+	EventMaxAge             time.Duration `yaml:"eventMaxAge" env:"HEALTH_EVENT_MAX_AGE" help:"time without departure updates after which readiness warns"`
+}
+
+// keyPattern returns the pattern of the station keys
+func (c RedisConfig) keyPattern() KeyPattern {
+	return KeyPattern{Prefix: c.KeyPrefix, Separator: c.KeySeparator, DB: c.DB}
+}
+
+// CacheConfig configures the query result cache
+type CacheConfig struct {
+	Backend    string        `yaml:"backend" env:"CACHE_BACKEND" help:"memory, redis or none"`
+	Size       int           `yaml:"size" env:"CACHE_SIZE" help:"results kept by the memory backend"`
+	TTLPast    time.Duration `yaml:"ttlPast" env:"CACHE_TTL_PAST" help:"cache lifetime of results for finished days"`
+	TTLCurrent time.Duration `yaml:"ttlCurrent" env:"CACHE_TTL_CURRENT" help:"cache lifetime of results that may still change"`
+}
+
+// QueryTimeoutConfig overrides the query timeouts of the endpoints. Zero
+// keeps the built-in timeout of an endpoint, see defaultQueryTimeouts.
+type QueryTimeoutConfig struct {
+	Default          time.Duration `yaml:"default" env:"QUERY_TIMEOUT" help:"query timeout of every endpoint without its own setting"`
+	LineDelay        time.Duration `yaml:"lineDelay" env:"QUERY_TIMEOUT_LINE_DELAY" help:"query timeout of /api/line_delay"`
+	GlobalDelay      time.Duration `yaml:"globalDelay" env:"QUERY_TIMEOUT_GLOBAL_DELAY" help:"query timeout of /api/global_delay"`
+	StationStats     time.Duration `yaml:"stationStats" env:"QUERY_TIMEOUT_STATION_STATS" help:"query timeout of /api/station_stats"`
+	LineStats        time.Duration `yaml:"lineStats" env:"QUERY_TIMEOUT_LINE_STATS" help:"query timeout of /api/line_stats"`
+	Rankings         time.Duration `yaml:"rankings" env:"QUERY_TIMEOUT_RANKINGS" help:"query timeout of /api/rankings"`
+	ExportDepartures time.Duration `yaml:"exportDepartures" env:"QUERY_TIMEOUT_EXPORT_DEPARTURES" help:"query timeout of /api/export/departures"`
+}
+
+// resolve returns the effective timeout of every endpoint
+func (c QueryTimeoutConfig) resolve() map[string]time.Duration {
+	overrides := map[string]time.Duration{
+		"line_delay":        c.LineDelay,
+		"global_delay":      c.GlobalDelay,
+		"station_stats":     c.StationStats,
+		"line_stats":        c.LineStats,
+		"rankings":          c.Rankings,
+		"export_departures": c.ExportDepartures,
+	}
+
+	timeouts := make(map[string]time.Duration, len(defaultQueryTimeouts))
+	for endpoint, timeout := range defaultQueryTimeouts {
+		if c.Default > 0 {
+			timeout = c.Default
+		}
+		if override := overrides[endpoint]; override > 0 {
+			timeout = override
+		}
+		timeouts[endpoint] = timeout
+	}
+	return timeouts
+}
+
+// defaultConfig returns the configuration used without any settings
+func defaultConfig() Config {
+	return Config{
+		Listen:          "127.0.0.1:8080",
+		ShutdownTimeout: 8 * time.Second, // below the 10 seconds docker stop grants
+		ClickHouse: DatabaseConfig{
+			Host:             "clickhouse.auch.cool",
+			Protocol:         "native",
+			Database:         "mvg",
+			Username:         "mvgobserver",
+			MaxExecutionTime: defaultMaxExecutionTime,
+		},
+		Redis: RedisConfig{
+			Host:                    "127.0.0.1",
+			Port:                    "6379",
+			Mode:                    "standalone",
+			KeySeparator:            "_",
+			ConfigureKeyspaceEvents: true,
+			StreamMaxLen:            200,
+			EventMaxAge:             defaultEventMaxAge,
+		},
+		Cache: CacheConfig{
+			Backend:    "memory",
+			Size:       defaultCacheSize,
+			TTLPast:    defaultCacheTTLPast,
+			TTLCurrent: defaultCacheTTLCurrent,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// setting is a single leaf of the configuration
+type setting struct {
+	path   string   // YAML path, also the flag name
+	env    []string // preferred name first
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+// loadConfig builds the configuration from args, the command line without the
+// program name, the environment and the configuration file. printConfig is
+// set when the configuration should be printed instead of serving.
+func loadConfig(args []string) (cfg Config, printConfig bool, err error) {
+	cfg = defaultConfig()
+
+	fs := flag.NewFlagSet("mvg-live", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (env CONFIG_FILE)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+
+	// Flags win over file and environment, so they are applied last
+	var flagValues []func() error
+	walkConfig(reflect.ValueOf(&cfg).Elem(), "", "", func(s setting) {
+		if s.secret {
+			return
+		}
+		usage := fmt.Sprintf("%s (env %s)", s.help, strings.Join(s.env, ", "))
+		if value := formatSetting(s.value); value != "" {
+			usage = fmt.Sprintf("%s (default %s, env %s)", s.help, value, strings.Join(s.env, ", "))
+		}
+		record := func(raw string) error {
+			if err := setSetting(reflect.New(s.value.Type()).Elem(), raw); err != nil {
+				return err
+			}
+			flagValues = append(flagValues, func() error { return setSetting(s.value, raw) })
+			return nil
+		}
+		if s.value.Kind() == reflect.Bool {
+			fs.BoolFunc(s.path, usage, record) // -redis.tls.enabled without a value
+		} else {
+			fs.Func(s.path, usage, record)
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *configFile != "" {
+		if err := loadConfigFile(&cfg, *configFile); err != nil {
+			return cfg, false, err
+		}
+	}
+
+	var errs []error
+	walkConfig(reflect.ValueOf(&cfg).Elem(), "", "", func(s setting) {
+		if err := applyEnv(s); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	for _, apply := range flagValues {
+		errs = append(errs, apply())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return cfg, false, err
+	}
+
+	return cfg, printConfig, cfg.validate()
+}
+
+// loadConfigFile overlays cfg with the settings in the YAML file at path.
+// Other formats, including TOML, are not supported. They are rejected by
+// their extension rather than failing with a YAML syntax error.
+func loadConfigFile(cfg *Config, path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		return fmt.Errorf("unsupported configuration file %s: only YAML files (.yaml, .yml) are supported, TOML is not", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// walkConfig calls fn for every setting in v. pathPrefix and envPrefix are
+// the YAML path and env prefix of v.
+func walkConfig(v reflect.Value, pathPrefix, envPrefix string, fn func(setting)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := pathPrefix + name
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			walkConfig(v.Field(i), path+".", envPrefix+field.Tag.Get("env"), fn)
+			continue
+		}
+
+		var env []string
+		for _, key := range strings.Split(field.Tag.Get("env"), ",") {
+			if key != "" {
+				env = append(env, envPrefix+key)
+			}
+		}
+		fn(setting{
+			path:   path,
+			env:    env,
+			help:   field.Tag.Get("help"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+}
+
+// applyEnv sets a setting from its environment variables. Empty variables
+// count as unset, aliases must agree with each other.
+func applyEnv(s setting) error {
+	var name, raw string
+	for _, key := range s.env {
+		envValue := os.Getenv(key)
+		if envValue == "" {
+			continue
+		}
+		if name != "" && envValue != raw {
+			return fmt.Errorf("%s and %s are both set but differ", name, key)
+		}
+		name, raw = key, envValue
+	}
+
+	if name == "" {
+		return nil
+	}
+	if err := setSetting(s.value, raw); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// setSetting parses raw into value
+func setSetting(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	default:
+		panic(fmt.Sprintf("setSetting: unsupported type %s", value.Type()))
+	}
+	return nil
+}
+
+// formatSetting is the inverse of setSetting
+func formatSetting(value reflect.Value) string {
+	switch setting := value.Interface().(type) {
+	case time.Duration:
+		return setting.String()
+	case []string:
+		return strings.Join(setting, ",")
+	default:
+		return fmt.Sprint(setting)
+	}
+}
+
+// validate reports every invalid setting
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen must be a host:port address, got %q", c.Listen)
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+
+	check(c.ClickHouse.Host != "", "clickhouse.host must not be empty")
+	check(c.ClickHouse.Port == "" || validPort(c.ClickHouse.Port), "clickhouse.port must be a port number, got %q", c.ClickHouse.Port)
+	check(c.ClickHouse.Protocol == "native" || c.ClickHouse.Protocol == "http",
+		"clickhouse.protocol must be native or http, got %q", c.ClickHouse.Protocol)
+	check(c.ClickHouse.Database != "", "clickhouse.database must not be empty")
+	check(c.ClickHouse.MaxExecutionTime > 0, "clickhouse.maxExecutionTime must be positive")
+	if err := c.ClickHouse.TLS.validate("clickhouse.tls"); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.Redis.Mode {
+	case "standalone":
+		check(c.Redis.Host != "", "redis.host must not be empty")
+		check(validPort(c.Redis.Port), "redis.port must be a port number, got %q", c.Redis.Port)
+		check(len(c.Redis.Addresses) == 0, "redis.addresses is only used in sentinel and cluster mode, set redis.host and redis.port")
+	case "sentinel":
+		check(len(c.Redis.Addresses) > 0, "redis.addresses must list the sentinels")
+		check(c.Redis.MasterName != "", "redis.masterName must not be empty in sentinel mode")
+	case "cluster":
+		check(len(c.Redis.Addresses) > 0, "redis.addresses must list the cluster nodes")
+		// Redis Cluster only has database 0
+		check(c.Redis.DB == 0, "redis.db must be 0 in cluster mode")
+	default:
+		errs = append(errs, fmt.Errorf("redis.mode must be standalone, sentinel or cluster, got %q", c.Redis.Mode))
+	}
+	for _, address := range c.Redis.Addresses {
+		_, port, err := net.SplitHostPort(address)
+		check(err == nil && validPort(port), "redis.addresses must contain host:port addresses, got %q", address)
+	}
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+	if err := c.Redis.keyPattern().validate(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.Redis.StreamMaxLen > 0, "redis.streamMaxLen must be positive")
+	check(c.Redis.EventMaxAge > 0, "redis.eventMaxAge must be positive")
+	if err := c.Redis.TLS.validate("redis.tls"); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.Cache.Backend {
+	case "memory":
+		check(c.Cache.Size > 0, "cache.size must be positive")
+	case "redis", "none":
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend must be memory, redis or none, got %q", c.Cache.Backend))
+	}
+	check(c.Cache.TTLPast > 0, "cache.ttlPast must be positive")
+	check(c.Cache.TTLCurrent > 0, "cache.ttlCurrent must be positive")
+
+	walkConfig(reflect.ValueOf(c.QueryTimeouts), "queryTimeouts.", "", func(s setting) {
+		check(s.value.Int() >= 0, "%s must not be negative", s.path)
+	})
+
+	if _, _, err := c.Log.levels(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json, got %q", c.Log.Format)
+
+	return errors.Join(errs...)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// writeConfig prints cfg as YAML, durations in Go notation and secrets redacted
+func writeConfig(w io.Writer, cfg Config) error {
+	// Mappings by YAML path, created in field order on first use
+	mappings := map[string]*yaml.Node{"": {Kind: yaml.MappingNode}}
+	var mapping func(path string) *yaml.Node
+	mapping = func(path string) *yaml.Node {
+		if node, ok := mappings[path]; ok {
+			return node
+		}
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		parent, name := splitPath(path)
+		parentNode := mapping(parent)
+		parentNode.Content = append(parentNode.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, node)
+		mappings[path] = node
+		return node
+	}
+
+	var errs []error
+	walkConfig(reflect.ValueOf(cfg), "", "", func(s setting) {
+		var value interface{} = s.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if s.secret && !s.value.IsZero() {
+			value = "<redacted>"
+		}
+
+		node := &yaml.Node{}
+		errs = append(errs, node.Encode(value))
+		parent, name := splitPath(s.path)
+		parentNode := mapping(parent)
+		parentNode.Content = append(parentNode.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, node)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(mappings[""]); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// splitPath splits a YAML path into the path of the parent and the last name
+func splitPath(path string) (parent, name string) {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return "", path
+}
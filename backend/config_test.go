@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, printConfig, err := loadConfig(nil)
+	require.NoError(t, err)
+	assert.False(t, printConfig)
+	assert.Equal(t, defaultConfig(), cfg)
+	assert.Equal(t, defaultQueryTimeouts, cfg.QueryTimeouts.resolve())
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen: 0.0.0.0:9090
+clickhouse:
+  host: clickhouse.internal
+  port: "9440"
+redis:
+  db: 2
+  streamMaxLen: 500
+cache:
+  ttlCurrent: 30s
+queryTimeouts:
+  default: 10s
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("CLICKHOUSE_HOST", "clickhouse.env")
+	t.Setenv("REDIS_DB", "3")
+	t.Setenv("QUERY_TIMEOUT_STATION_STATS", "90s")
+
+	cfg, _, err := loadConfig([]string{"-redis.db", "4", "-cache.backend=none"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "0.0.0.0:9090", cfg.Listen, "file over default")
+	assert.Equal(t, "9440", cfg.ClickHouse.Port)
+	assert.Equal(t, "clickhouse.env", cfg.ClickHouse.Host, "env over file")
+	assert.Equal(t, 4, cfg.Redis.DB, "flag over env")
+	assert.Equal(t, int64(500), cfg.Redis.StreamMaxLen)
+	assert.Equal(t, "none", cfg.Cache.Backend)
+	assert.Equal(t, 30*time.Second, cfg.Cache.TTLCurrent)
+	assert.Equal(t, defaultCacheTTLPast, cfg.Cache.TTLPast)
+
+	timeouts := cfg.QueryTimeouts.resolve()
+	assert.Equal(t, 10*time.Second, timeouts["line_delay"])
+	assert.Equal(t, 90*time.Second, timeouts["station_stats"])
+}
+
+func TestLoadConfigFileFlag(t *testing.T) {
+	path := writeConfigFile(t, "shutdownTimeout: 20s\n")
+	cfg, _, err := loadConfig([]string{"-config", path})
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Second, cfg.ShutdownTimeout)
+
+	_, _, err = loadConfig([]string{"-config", writeConfigFile(t, "redis:\n  hots: localhost\n")})
+	assert.ErrorContains(t, err, "field hots not found")
+
+	_, _, err = loadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	assert.ErrorContains(t, err, "reading configuration file")
+
+	tomlPath := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tomlPath, []byte("shutdownTimeout = \"20s\"\n"), 0o600))
+	_, _, err = loadConfig([]string{"-config", tomlPath})
+	assert.ErrorContains(t, err, "only YAML files (.yaml, .yml) are supported")
+}
+
+func TestLoadConfigEnvAliases(t *testing.T) {
+	t.Setenv("CLICKHOUSE_DB", "mvg_test")
+	t.Setenv("CLICKHOUSE_USERNAME", "reader")
+	cfg, _, err := loadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "mvg_test", cfg.ClickHouse.Database)
+	assert.Equal(t, "reader", cfg.ClickHouse.Username)
+
+	t.Setenv("CLICKHOUSE_DATABASE", "mvg_test")
+	_, _, err = loadConfig(nil)
+	assert.NoError(t, err, "aliases with the same value agree")
+
+	t.Setenv("CLICKHOUSE_DATABASE", "mvg")
+	_, _, err = loadConfig(nil)
+	assert.EqualError(t, err, "CLICKHOUSE_DATABASE and CLICKHOUSE_DB are both set but differ")
+}
+
+func TestLoadConfigConnectionSettings(t *testing.T) {
+	t.Setenv("CLICKHOUSE_PROTOCOL", "http")
+	t.Setenv("CLICKHOUSE_TLS_ENABLED", "true")
+	t.Setenv("CLICKHOUSE_TLS_SERVER_NAME", "clickhouse.internal")
+	t.Setenv("REDIS_MODE", "sentinel")
+	t.Setenv("REDIS_ADDRESSES", "10.0.0.1:26379, 10.0.0.2:26379")
+	t.Setenv("REDIS_SENTINEL_MASTER", "mvg")
+	t.Setenv("REDIS_PASSWORD", "secret")
+
+	cfg, _, err := loadConfig([]string{"-redis.tls.enabled", "-redis.username=observer"})
+	require.NoError(t, err)
+	assert.Equal(t, TLSConfig{Enabled: true, ServerName: "clickhouse.internal"}, cfg.ClickHouse.TLS)
+	assert.Equal(t, "clickhouse.auch.cool:8443", cfg.ClickHouse.address())
+	assert.Equal(t, []string{"10.0.0.1:26379", "10.0.0.2:26379"}, cfg.Redis.Addresses)
+	assert.Equal(t, "mvg", cfg.Redis.MasterName)
+	assert.Equal(t, "observer", cfg.Redis.Username)
+	assert.Equal(t, "secret", cfg.Redis.Password)
+	assert.True(t, cfg.Redis.TLS.Enabled)
+}
+
+func TestDatabaseConfigAddress(t *testing.T) {
+	cfg := defaultConfig().ClickHouse
+	assert.Equal(t, "clickhouse.auch.cool:9000", cfg.address())
+	cfg.TLS.Enabled = true
+	assert.Equal(t, "clickhouse.auch.cool:9440", cfg.address())
+	cfg.Protocol = "http"
+	assert.Equal(t, "clickhouse.auch.cool:8443", cfg.address())
+	cfg.TLS.Enabled = false
+	assert.Equal(t, "clickhouse.auch.cool:8123", cfg.address())
+	cfg.Port = "18123"
+	assert.Equal(t, "clickhouse.auch.cool:18123", cfg.address())
+}
+
+func TestLoadConfigInvalidValues(t *testing.T) {
+	t.Setenv("QUERY_TIMEOUT", "soon")
+	t.Setenv("REDIS_CONFIGURE_KEYSPACE_EVENTS", "maybe")
+	_, _, err := loadConfig(nil)
+	assert.ErrorContains(t, err, `QUERY_TIMEOUT: invalid duration "soon"`)
+	assert.ErrorContains(t, err, `REDIS_CONFIGURE_KEYSPACE_EVENTS: invalid boolean "maybe"`)
+
+	t.Setenv("QUERY_TIMEOUT", "")
+	t.Setenv("REDIS_CONFIGURE_KEYSPACE_EVENTS", "")
+	_, _, err = loadConfig([]string{"-redis.db", "two"})
+	assert.ErrorContains(t, err, `invalid integer "two"`)
+
+	_, _, err = loadConfig([]string{"-clickhouse.password", "secret"})
+	assert.ErrorContains(t, err, "flag provided but not defined")
+
+	_, _, err = loadConfig([]string{"-h"})
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, defaultConfig().validate())
+
+	cfg := defaultConfig()
+	cfg.Listen = "8080"
+	cfg.ShutdownTimeout = 0
+	cfg.ClickHouse.Port = "native"
+	cfg.ClickHouse.Protocol = "grpc"
+	cfg.ClickHouse.TLS.CAFile = "ca.pem"
+	cfg.Redis.DB = -1
+	cfg.Redis.KeyPrefix = "mvg_departures"
+	cfg.Redis.StreamMaxLen = 0
+	cfg.Cache.Backend = "memcached"
+	cfg.QueryTimeouts.Rankings = -time.Second
+
+	err := cfg.validate()
+	for _, message := range []string{
+		`listen must be a host:port address, got "8080"`,
+		"shutdownTimeout must be positive",
+		`clickhouse.port must be a port number, got "native"`,
+		`clickhouse.protocol must be native or http, got "grpc"`,
+		"clickhouse.tls is configured but not enabled",
+		"redis.db must not be negative",
+		`redis.keyPrefix "mvg_departures" must not contain the separator "_"`,
+		"redis.streamMaxLen must be positive",
+		`cache.backend must be memory, redis or none, got "memcached"`,
+		"queryTimeouts.rankings must not be negative",
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+
+	cfg = defaultConfig()
+	cfg.Cache.Size = 0
+	assert.EqualError(t, cfg.validate(), "cache.size must be positive")
+	cfg.Cache.Backend = "redis"
+	assert.NoError(t, cfg.validate(), "the size only matters for the memory backend")
+
+	cfg = defaultConfig()
+	cfg.Redis.Mode = "sentinel"
+	assert.EqualError(t, cfg.validate(),
+		"redis.addresses must list the sentinels\nredis.masterName must not be empty in sentinel mode")
+	cfg.Redis.Mode = "cluster"
+	cfg.Redis.Addresses = []string{"10.0.0.1"}
+	cfg.Redis.DB = 1
+	assert.EqualError(t, cfg.validate(),
+		"redis.db must be 0 in cluster mode\nredis.addresses must contain host:port addresses, got \"10.0.0.1\"")
+	cfg.Redis.Mode = "standalone"
+	cfg.Redis.DB = 0
+	assert.EqualError(t, cfg.validate(),
+		"redis.addresses is only used in sentinel and cluster mode, set redis.host and redis.port\nredis.addresses must contain host:port addresses, got \"10.0.0.1\"")
+}
+
+func TestWriteConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ClickHouse.Password = "hunter2"
+
+	var out bytes.Buffer
+	require.NoError(t, writeConfig(&out, cfg))
+	assert.Contains(t, out.String(), "listen: 127.0.0.1:8080\nshutdownTimeout: 8s\nclickhouse:\n  host: clickhouse.auch.cool\n")
+	assert.Contains(t, out.String(), "  password: <redacted>\n")
+	assert.Contains(t, out.String(), "  ttlPast: 168h0m0s\n")
+	assert.NotContains(t, out.String(), "hunter2")
+
+	// The printed configuration loads back to the same settings
+	cfg.ClickHouse.Password = ""
+	cfg.ClickHouse.TLS = TLSConfig{Enabled: true, ServerName: "clickhouse.internal"}
+	cfg.Redis.Mode = "cluster"
+	cfg.Redis.Addresses = []string{"10.0.0.1:6379", "10.0.0.2:6379"}
+	out.Reset()
+	require.NoError(t, writeConfig(&out, cfg))
+	loaded, _, err := loadConfig([]string{"-config", writeConfigFile(t, out.String())})
+	require.NoError(t, err)
+	assert.Equal(t, cfg, loaded)
+
+	_, printConfig, err := loadConfig([]string{"-print-config"})
+	require.NoError(t, err)
+	assert.True(t, printConfig)
+}
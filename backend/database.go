@@ -2,62 +2,86 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"net"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
+// defaultMaxExecutionTime is the server-side query time limit in seconds
+const defaultMaxExecutionTime = 120
+
 // DatabaseConfig holds configuration for database connections
 type DatabaseConfig struct {
-	Host     string
-	Port     string
-	Database string
-	Username string
-	Password string
+	Host     string `yaml:"host" env:"CLICKHOUSE_HOST" help:"ClickHouse host"`
+	Port     string `yaml:"port" env:"CLICKHOUSE_PORT" help:"ClickHouse port, the default port of the protocol if empty"`
+	Protocol string `yaml:"protocol" env:"CLICKHOUSE_PROTOCOL" help:"ClickHouse protocol, native or http"`
+	Database string `yaml:"database" env:"CLICKHOUSE_DATABASE,CLICKHOUSE_DB" help:"ClickHouse database"`
+	Username string `yaml:"username" env:"CLICKHOUSE_USERNAME,CLICKHOUSE_USER" help:"ClickHouse user"`
+	Password string `yaml:"password" env:"CLICKHOUSE_PASSWORD" secret:"true" help:"ClickHouse password"`
+	// MaxExecutionTime caps the runtime of queries without a deadline, in seconds.
+	// Queries with a deadline get max_execution_time from the driver.
+	MaxExecutionTime int `yaml:"maxExecutionTime" env:"CLICKHOUSE_MAX_EXECUTION_TIME" help:"server-side time limit of queries without a deadline, in seconds"`
+
+	TLS TLSConfig `yaml:"tls" env:"CLICKHOUSE_TLS_"`
 }
 
-// NewDatabaseConfig creates a new database configuration from environment variables
-func NewDatabaseConfig() *DatabaseConfig {
-	return &DatabaseConfig{
-		Host:     getEnv("CLICKHOUSE_HOST", "clickhouse.auch.cool"),
-		Port:     getEnv("CLICKHOUSE_PORT", "9000"),
-		Database: getEnv("CLICKHOUSE_DB", "mvg"),
-		Username: getEnv("CLICKHOUSE_USER", "mvgobserver"),
-		Password: os.Getenv("CLICKHOUSE_PASSWORD"),
+// address returns host and port of the server. Without a port, the default
+// port of the protocol is used: 9000 (9440 with TLS) for native and 8123
+// (8443 with TLS) for http.
+func (c DatabaseConfig) address() string {
+	port := c.Port
+	if port == "" {
+		switch {
+		case c.Protocol == "http" && c.TLS.Enabled:
+			port = "8443"
+		case c.Protocol == "http":
+			port = "8123"
+		case c.TLS.Enabled:
+			port = "9440"
+		default:
+			port = "9000"
+		}
 	}
+	return net.JoinHostPort(c.Host, port)
 }
 
 // connectClickhouse establishes a connection to ClickHouse database
-func connectClickhouse() driver.Conn {
-	config := NewDatabaseConfig()
-	
+func connectClickhouse(config DatabaseConfig) (driver.Conn, error) {
+	tlsConfig, err := config.TLS.load()
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := clickhouse.Native
+	if config.Protocol == "http" {
+		protocol = clickhouse.HTTP
+	}
+
 	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: []string{fmt.Sprintf("%s:%s", config.Host, config.Port)},
+		Addr:     []string{config.address()},
+		Protocol: protocol,
+		TLS:      tlsConfig,
 		Auth: clickhouse.Auth{
 			Database: config.Database,
 			Username: config.Username,
 			Password: config.Password,
 		},
+		Settings: clickhouse.Settings{
+			"max_execution_time": config.MaxExecutionTime,
+		},
 	})
 	if err != nil {
-		panic(fmt.Errorf("failed to connect to ClickHouse: %w", err))
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
 	}
-	
+
 	// Verify connection by getting server version
 	version, err := conn.ServerVersion()
 	if err != nil {
-		panic(fmt.Errorf("failed to get ClickHouse server version: %w", err))
+		conn.Close()
+		return nil, fmt.Errorf("failed to get ClickHouse server version: %w", err)
 	}
-	
-	fmt.Printf("Connected to ClickHouse server version: %s\n", version.String())
-	return conn
-}
 
-// getEnv returns environment variable value or default if not set
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
\ No newline at end of file
+	clickhouseLog.Info("connected to server", "version", version.String())
+	return conn, nil
+}
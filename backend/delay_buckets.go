@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxDelayBucketEdges limits the number of distribution buckets per request
+const maxDelayBucketEdges = 20
+
+// defaultDelayBucketEdges are the upper bounds (in minutes) of the default
+// delay distribution: On Time, 1-2 min, 3-5 min, 6-10 min and 10+ min
+var defaultDelayBucketEdges = []int{0, 2, 5, 10}
+
+// delayBucketExpr returns a ClickHouse expression assigning each departure
+// the index of its delay bucket, together with the placeholder arguments.
+// A departure falls into bucket i if its delay is at most edges[i] and above
+// edges[i-1]; delays above the last edge get index len(edges).
+func delayBucketExpr(edges []int) (string, []interface{}) {
+	conditions := make([]string, 0, len(edges))
+	args := make([]interface{}, 0, len(edges))
+	for i, edge := range edges {
+		conditions = append(conditions, fmt.Sprintf("delayInMinutes <= ?, %d", i))
+		args = append(args, edge)
+	}
+
+	expr := fmt.Sprintf("toUInt32(multiIf(%s, %d))", strings.Join(conditions, ", "), len(edges))
+	return expr, args
+}
+
+// delayBucketLabels returns a human readable label for every bucket produced
+// by delayBucketExpr, e.g. "On Time", "3-5 min" and "10+ min"
+func delayBucketLabels(edges []int) []string {
+	labels := make([]string, 0, len(edges)+1)
+	for i, edge := range edges {
+		switch {
+		case i == 0 && edge == 0:
+			labels = append(labels, "On Time")
+		case i == 0:
+			labels = append(labels, fmt.Sprintf("<=%d min", edge))
+		case edges[i-1]+1 == edge:
+			labels = append(labels, fmt.Sprintf("%d min", edge))
+		default:
+			labels = append(labels, fmt.Sprintf("%d-%d min", edges[i-1]+1, edge))
+		}
+	}
+	labels = append(labels, fmt.Sprintf("%d+ min", edges[len(edges)-1]))
+	return labels
+}
+
+// parseBucketEdges parses a comma separated list of strictly increasing
+// bucket edges such as "0,1,3,5,10,20"
+func parseBucketEdges(value string) ([]int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) > maxDelayBucketEdges {
+		return nil, fmt.Errorf("too many bucket edges: %d (max %d)", len(parts), maxDelayBucketEdges)
+	}
+
+	edges := make([]int, 0, len(parts))
+	for _, part := range parts {
+		edge, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket edge '%s': must be an integer", part)
+		}
+		if len(edges) > 0 && edge <= edges[len(edges)-1] {
+			return nil, fmt.Errorf("bucket edges must be strictly increasing, got %d after %d", edge, edges[len(edges)-1])
+		}
+		edges = append(edges, edge)
+	}
+
+	return edges, nil
+}
+
+// bucketEdges are the delay bucket edges of a request parameter, parsed with
+// parseBucketEdges
+type bucketEdges []int
+
+func (e *bucketEdges) UnmarshalText(text []byte) error {
+	edges, err := parseBucketEdges(string(text))
+	if err != nil {
+		return err
+	}
+	*e = edges
+	return nil
+}
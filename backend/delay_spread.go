@@ -0,0 +1,53 @@
+package main
+
+// delaySpreadColumns aggregates robust delay statistics for a group of
+// departures. It is appended to the SELECT list when extended statistics
+// are requested.
+const delaySpreadColumns = `,
+			quantiles(0.5, 0.9, 0.95)(delayInMinutes) as spreadQuantiles,
+			toFloat64(max(delayInMinutes)) as maxDelay,
+			stddevPop(delayInMinutes) as stddevDelay`
+
+// delaySpreadTupleFields extends the groupArray tuple of the line delay
+// queries with the columns of delaySpreadColumns
+const delaySpreadTupleFields = `, spreadQuantiles, maxDelay, stddevDelay`
+
+// delaySpreadMapEntries adds the delaySpreadTupleFields to a bucket map.
+// The tuple elements 5 to 7 follow bucket, avgDelay, numDepartures and percentageThreshold.
+const delaySpreadMapEntries = `,
+					'medianDelay', toString(arrayElement(x.5, 1)),
+					'p90Delay', toString(arrayElement(x.5, 2)),
+					'p95Delay', toString(arrayElement(x.5, 3)),
+					'maxDelay', toString(x.6),
+					'stddevDelay', toString(x.7)`
+
+// delaySpreadScan receives the delaySpreadColumns of a single row
+type delaySpreadScan struct {
+	quantiles []float64
+	max       float64
+	stddev    float64
+}
+
+// dest returns the scan destinations in the order of delaySpreadColumns
+func (d *delaySpreadScan) dest() []interface{} {
+	return []interface{}{&d.quantiles, &d.max, &d.stddev}
+}
+
+// spread converts the scanned columns into a DelaySpread
+func (d *delaySpreadScan) spread() *DelaySpread {
+	spread := &DelaySpread{Max: d.max, StdDev: d.stddev}
+	if len(d.quantiles) == 3 {
+		spread.Median = d.quantiles[0]
+		spread.P90 = d.quantiles[1]
+		spread.P95 = d.quantiles[2]
+	}
+	return spread
+}
+
+// optionalSQL returns fragment if enabled and an empty string otherwise
+func optionalSQL(enabled bool, fragment string) string {
+	if enabled {
+		return fragment
+	}
+	return ""
+}
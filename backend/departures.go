@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// DepartureService handles queries for raw departure rows
+type DepartureService struct {
+	conn driver.Conn
+}
+
+// DepartureFilter selects the departures of an export
+type DepartureFilter struct {
+	StartDate string // inclusive, 2006-01-02
+	EndDate   string // exclusive, 2006-01-02
+	Station   string // optional station ID
+	Label     string // optional line label
+	Limit     int    // maximum number of rows
+}
+
+// DepartureRecord is a single recorded departure
+type DepartureRecord struct {
+	Station              string    `json:"station" parquet:"station"`
+	Label                string    `json:"label" parquet:"label"`
+	Destination          string    `json:"destination" parquet:"destination"`
+	PlannedDepartureTime time.Time `json:"plannedDepartureTime" parquet:"plannedDepartureTime,timestamp(millisecond)"`
+	DelayInMinutes       int32     `json:"delayInMinutes" parquet:"delayInMinutes"`
+	Realtime             bool      `json:"realtime" parquet:"realtime"`
+}
+
+// NewDepartureService creates a new departure service
+func NewDepartureService(conn driver.Conn) *DepartureService {
+	return &DepartureService{conn: conn}
+}
+
+// StreamDepartures calls fn for every departure matching filter, ordered by
+// planned departure time. An error returned by fn stops the iteration.
+func (s *DepartureService) StreamDepartures(ctx context.Context, filter DepartureFilter, fn func(DepartureRecord) error) error {
+	// Validate inputs
+	if err := validateDateRange(filter.StartDate, filter.EndDate); err != nil {
+		return fmt.Errorf("invalid date range: %w", err)
+	}
+	if filter.Limit < 1 {
+		return fmt.Errorf("invalid limit %d, must be positive", filter.Limit)
+	}
+
+	query := `
+		SELECT
+			station,
+			label,
+			destination,
+			plannedDepartureTime,
+			toInt32(delayInMinutes),
+			realtime = 1
+		FROM mvg.responses_dedup
+		WHERE plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		AND (? = '' OR station = ?)
+		AND (? = '' OR label = ?)
+		ORDER BY plannedDepartureTime, station, label
+		LIMIT ?
+	`
+
+	rows, err := s.conn.Query(withQueryName(ctx, "departures"), query,
+		filter.StartDate, filter.EndDate,
+		filter.Station, filter.Station,
+		filter.Label, filter.Label,
+		filter.Limit,
+	)
+	if err != nil {
+		return fmt.Errorf("departures query failed: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record DepartureRecord
+		var realtime uint8
+
+		if err := rows.Scan(&record.Station, &record.Label, &record.Destination, &record.PlannedDepartureTime, &record.DelayInMinutes, &realtime); err != nil {
+			if err := skipRow(ctx, "departures", err); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Realtime = realtime == 1
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating departures: %w", err)
+	}
+
+	return nil
+}
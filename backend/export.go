@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	formatJSON    = "json"
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+)
+
+// parquetRowGroupSize bounds the rows buffered before a row group is written
+const parquetRowGroupSize = 64 * 1024
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFilename joins parts into a file name without the extension
+func exportFilename(parts ...string) string {
+	return unsafeFilenameChars.ReplaceAllString(strings.Join(parts, "_"), "-")
+}
+
+// exportWriter streams rows of type T as a JSON array, NDJSON, CSV or Parquet.
+// CSV and Parquet column names are taken from the parquet struct tags of T.
+// Only a single row is held in memory at a time, apart from Parquet row
+// groups. The response headers are only written with the first row, so
+// errors before it can still be reported with a proper status code.
+type exportWriter[T any] struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	format   string
+	filename string
+
+	scans *ScanReport
+
+	started bool
+	rows    int
+	out     io.WriteCloser
+	csv     *csv.Writer
+	json    *json.Encoder
+	parquet *parquet.GenericWriter[T]
+}
+
+// newExportWriter creates an export writer. Rows skipped according to scans
+// are reported in headers or, once the body has started, in trailers.
+func newExportWriter[T any](w http.ResponseWriter, r *http.Request, format, filename string, scans *ScanReport) *exportWriter[T] {
+	return &exportWriter[T]{w: w, r: r, format: format, filename: filename, scans: scans}
+}
+
+func (e *exportWriter[T]) start() error {
+	e.started = true
+
+	h := e.w.Header()
+	setCORSHeaders(h)
+	setPartialResultHeaders(h, e.scans)
+
+	if e.format == formatParquet {
+		// Parquet compresses its column chunks, so the response is sent as is
+		h.Set("Content-Type", "application/vnd.apache.parquet")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, e.filename, e.format))
+		e.out = nopWriteCloser{e.w}
+		e.parquet = parquet.NewGenericWriter[T](e.w, parquet.Compression(&parquet.Zstd))
+		return nil
+	}
+
+	encoding := negotiateEncoding(e.r.Header.Get("Accept-Encoding"))
+	out, err := compressWriter(e.w, encoding)
+	if err != nil {
+		return err
+	}
+	e.out = out
+
+	h.Add("Vary", "Accept-Encoding")
+	if encoding != encodingIdentity {
+		h.Set("Content-Encoding", encoding)
+	}
+
+	switch e.format {
+	case formatJSON:
+		h.Set("Content-Type", "application/json")
+		e.json = json.NewEncoder(out)
+		_, err := io.WriteString(out, "[")
+		return err
+	case formatNDJSON:
+		h.Set("Content-Type", "application/x-ndjson")
+		e.json = json.NewEncoder(out)
+		return nil
+	case formatCSV:
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, e.filename, e.format))
+		e.csv = csv.NewWriter(out)
+		return e.csv.Write(csvHeader(reflect.TypeFor[T]()))
+	default:
+		return fmt.Errorf("unsupported export format %q", e.format)
+	}
+}
+
+// Write appends a row to the export
+func (e *exportWriter[T]) Write(row T) error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	e.rows++
+
+	switch {
+	case e.csv != nil:
+		return e.csv.Write(csvRecord(reflect.ValueOf(row)))
+	case e.json != nil:
+		if e.format == formatJSON && e.rows > 1 {
+			if _, err := io.WriteString(e.out, ","); err != nil {
+				return err
+			}
+		}
+		return e.json.Encode(row)
+	}
+
+	if _, err := e.parquet.Write([]T{row}); err != nil {
+		return err
+	}
+	if e.rows%parquetRowGroupSize == 0 {
+		return e.parquet.Flush()
+	}
+	return nil
+}
+
+// Close completes the file, writing an empty one if there were no rows
+func (e *exportWriter[T]) Close() error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case e.csv != nil:
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	case e.format == formatJSON:
+		if _, err := io.WriteString(e.out, "]\n"); err != nil {
+			return err
+		}
+	case e.parquet != nil:
+		if err := e.parquet.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.out.Close(); err != nil {
+		return err
+	}
+	if e.scans.Partial() {
+		e.w.Header().Set(http.TrailerPrefix+"X-Partial-Result", "true")
+		for _, warning := range e.scans.Warnings() {
+			e.w.Header().Add(http.TrailerPrefix+"X-Result-Warning", warning)
+		}
+	}
+	return nil
+}
+
+// Finish closes the export after the rows have been produced. A query error
+// before the first row is reported like any other query error. Later errors
+// abort the response, so clients notice the export is incomplete.
+func (e *exportWriter[T]) Finish(message string, err error) {
+	if err != nil {
+		if !e.started {
+			writeQueryError(e.w, e.r, message, err)
+			return
+		}
+		httpLog.ErrorContext(e.r.Context(), message+": aborting export", "rows", e.rows, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := e.Close(); err != nil {
+		httpLog.WarnContext(e.r.Context(), message+": failed to complete export", "error", err)
+	}
+}
+
+// csvHeader returns the column names of a row type
+func csvHeader(t reflect.Type) []string {
+	header := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("parquet"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		header = append(header, name)
+	}
+	return header
+}
+
+// csvRecord formats the fields of a row struct. Nil pointers become empty cells.
+func csvRecord(v reflect.Value) []string {
+	record := make([]string, v.NumField())
+	for i := range record {
+		record[i] = csvValue(v.Field(i))
+	}
+	return record
+}
+
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// delayExportRow is a single bucket of a station's delay data
+type delayExportRow struct {
+	Station             string   `parquet:"station"`
+	Name                string   `parquet:"name"`
+	Stop                int32    `parquet:"stop"`
+	Bucket              string   `parquet:"bucket"`
+	AvgDelay            float64  `parquet:"avgDelay"`
+	NumDepartures       uint64   `parquet:"numDepartures"`
+	PercentageThreshold float64  `parquet:"percentageThreshold"`
+	MedianDelay         *float64 `parquet:"medianDelay,optional"`
+	P90Delay            *float64 `parquet:"p90Delay,optional"`
+	P95Delay            *float64 `parquet:"p95Delay,optional"`
+	MaxDelay            *float64 `parquet:"maxDelay,optional"`
+	StddevDelay         *float64 `parquet:"stddevDelay,optional"`
+}
+
+// delayExportRows flattens the buckets of a station into rows. The spread
+// columns are only set for extended queries.
+func delayExportRows(day LineDelayDay) []delayExportRow {
+	name := day.Name
+	if name == "" {
+		name = friendlyNames[day.Station]
+	}
+
+	rows := make([]delayExportRow, 0, len(day.Buckets))
+	for _, bucket := range day.Buckets {
+		numDepartures, _ := strconv.ParseUint(bucket["numDepartures"], 10, 64)
+		rows = append(rows, delayExportRow{
+			Station:             day.Station,
+			Name:                name,
+			Stop:                day.Stop,
+			Bucket:              bucket["bucket"],
+			AvgDelay:            parseBucketFloat(bucket["avgDelay"]),
+			NumDepartures:       numDepartures,
+			PercentageThreshold: parseBucketFloat(bucket["percentageThreshold"]),
+			MedianDelay:         optionalBucketFloat(bucket, "medianDelay"),
+			P90Delay:            optionalBucketFloat(bucket, "p90Delay"),
+			P95Delay:            optionalBucketFloat(bucket, "p95Delay"),
+			MaxDelay:            optionalBucketFloat(bucket, "maxDelay"),
+			StddevDelay:         optionalBucketFloat(bucket, "stddevDelay"),
+		})
+	}
+	return rows
+}
+
+func parseBucketFloat(value string) float64 {
+	parsed, _ := strconv.ParseFloat(value, 64)
+	return parsed
+}
+
+func optionalBucketFloat(bucket map[string]string, key string) *float64 {
+	value, ok := bucket[key]
+	if !ok {
+		return nil
+	}
+	parsed := parseBucketFloat(value)
+	return &parsed
+}
+
+// writeRowStream streams the rows produced by stream. stream runs the query,
+// calling its argument for every row.
+func writeRowStream[T any](w http.ResponseWriter, r *http.Request, format, filename, message string, scans *ScanReport, stream func(func(T) error) error) {
+	export := newExportWriter[T](w, r, format, filename, scans)
+	export.Finish(message, stream(export.Write))
+}
+
+// writeDelayExport streams delay data as one row per bucket. stream runs
+// the query, calling its argument for every station.
+func writeDelayExport(w http.ResponseWriter, r *http.Request, format, filename, message string, scans *ScanReport, stream func(func(LineDelayDay) error) error) {
+	export := newExportWriter[delayExportRow](w, r, format, filename, scans)
+	err := stream(func(day LineDelayDay) error {
+		for _, row := range delayExportRows(day) {
+			if err := export.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	export.Finish(message, err)
+}
+
+// stationStatsExportRow is a single value of the station statistics. Section
+// names the part of StationStats the row comes from, e.g. "monthly", and Key
+// the entry within it, e.g. the month.
+type stationStatsExportRow struct {
+	Section    string   `parquet:"section"`
+	Key        string   `parquet:"key"`
+	Line       string   `parquet:"line"`
+	AvgDelay   *float64 `parquet:"avgDelay,optional"`
+	Departures *uint64  `parquet:"departures,optional"`
+	Value      *float64 `parquet:"value,optional"`
+}
+
+// stationStatsExportRows flattens station statistics into rows
+func stationStatsExportRows(stats StationStats) []stationStatsExportRow {
+	rows := []stationStatsExportRow{
+		{Section: "summary", Key: "total", AvgDelay: &stats.AvgDelay, Departures: &stats.TotalDepartures},
+		{Section: "summary", Key: "delayPercentage", Value: &stats.DelayPercentage},
+		{Section: "percentile", Key: "p50", Value: &stats.Percentiles.P50},
+		{Section: "percentile", Key: "p90", Value: &stats.Percentiles.P90},
+		{Section: "percentile", Key: "p99", Value: &stats.Percentiles.P99},
+	}
+
+	if spread := stats.Spread; spread != nil {
+		rows = append(rows,
+			stationStatsExportRow{Section: "spread", Key: "median", Value: &spread.Median},
+			stationStatsExportRow{Section: "spread", Key: "p90", Value: &spread.P90},
+			stationStatsExportRow{Section: "spread", Key: "p95", Value: &spread.P95},
+			stationStatsExportRow{Section: "spread", Key: "max", Value: &spread.Max},
+			stationStatsExportRow{Section: "spread", Key: "stdDev", Value: &spread.StdDev},
+		)
+	}
+
+	for i := range stats.MonthlyStats {
+		month := &stats.MonthlyStats[i]
+		rows = append(rows, stationStatsExportRow{Section: "monthly", Key: month.Month, AvgDelay: &month.AvgDelay, Departures: &month.Departures})
+		rows = append(rows, lineStatsExportRows("monthly", month.Month, month.LineStats)...)
+	}
+
+	for i := range stats.HourlyStats {
+		hour := &stats.HourlyStats[i]
+		key := strconv.Itoa(int(hour.Hour))
+		rows = append(rows, stationStatsExportRow{Section: "hourly", Key: key, AvgDelay: &hour.AvgDelay, Departures: &hour.Departures})
+		rows = append(rows, lineStatsExportRows("hourly", key, hour.LineStats)...)
+	}
+
+	for i := range stats.DelayDistribution {
+		bucket := &stats.DelayDistribution[i]
+		rows = append(rows, stationStatsExportRow{Section: "distribution", Key: bucket.Range, Departures: &bucket.Count})
+	}
+
+	return rows
+}
+
+// lineStatsExportRows returns the per line rows of a period, sorted by line
+func lineStatsExportRows(section, key string, lineStats map[string]LineStats) []stationStatsExportRow {
+	labels := make([]string, 0, len(lineStats))
+	for label := range lineStats {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+
+	rows := make([]stationStatsExportRow, 0, len(labels))
+	for _, label := range labels {
+		stats := lineStats[label]
+		rows = append(rows, stationStatsExportRow{Section: section, Key: key, Line: label, AvgDelay: &stats.AvgDelay, Departures: &stats.Departures})
+	}
+	return rows
+}
+
+// writeExport writes rows that have already been computed
+func writeExport[T any](w http.ResponseWriter, r *http.Request, format, filename, message string, rows []T) {
+	export := newExportWriter[T](w, r, format, filename, nil)
+	var err error
+	for _, row := range rows {
+		if err = export.Write(row); err != nil {
+			break
+		}
+	}
+	export.Finish(message, err)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var exportTestDays = []LineDelayDay{
+	{Station: "de:09162:1", Name: "Marienplatz", Stop: 3, Buckets: []map[string]string{
+		{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20"},
+		{"bucket": "2023-12-25 11:00:00", "avgDelay": "0.5", "numDepartures": "12", "percentageThreshold": "0"},
+	}},
+	{Station: "de:09162:2", Buckets: []map[string]string{
+		{"bucket": "2023-12-25 10:00:00", "avgDelay": "1", "numDepartures": "4", "percentageThreshold": "25",
+			"medianDelay": "1", "p90Delay": "2", "p95Delay": "2.5", "maxDelay": "3", "stddevDelay": "0.75"},
+	}},
+}
+
+func streamExportTestDays(fn func(LineDelayDay) error) error {
+	for _, day := range exportTestDays {
+		if err := fn(day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWriteDelayExportCSV(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/line_delay?format=csv", nil)
+	w := httptest.NewRecorder()
+
+	writeDelayExport(w, req, formatCSV, exportFilename("line_delay", "U3", "2023-12-25"), "Error exporting", nil, streamExportTestDays)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="line_delay_U3_2023-12-25.csv"`, resp.Header.Get("Content-Disposition"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"station", "name", "stop", "bucket", "avgDelay", "numDepartures", "percentageThreshold", "medianDelay", "p90Delay", "p95Delay", "maxDelay", "stddevDelay"},
+		{"de:09162:1", "Marienplatz", "3", "2023-12-25 10:00:00", "2.5", "10", "20", "", "", "", "", ""},
+		{"de:09162:1", "Marienplatz", "3", "2023-12-25 11:00:00", "0.5", "12", "0", "", "", "", "", ""},
+		{"de:09162:2", friendlyNames["de:09162:2"], "0", "2023-12-25 10:00:00", "1", "4", "25", "1", "2", "2.5", "3", "0.75"},
+	}, records)
+}
+
+func TestWriteDelayExportParquet(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?format=parquet", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	writeDelayExport(w, req, formatParquet, "global_delay_2023-12-25", "Error exporting", nil, streamExportTestDays)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/vnd.apache.parquet", resp.Header.Get("Content-Type"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	body := w.Body.Bytes()
+	rows, err := parquet.Read[delayExportRow](bytes.NewReader(body), int64(len(body)))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, "de:09162:1", rows[0].Station)
+	assert.Equal(t, uint64(12), rows[1].NumDepartures)
+	assert.Nil(t, rows[1].MedianDelay)
+	assert.Equal(t, 0.75, *rows[2].StddevDelay)
+}
+
+func TestWriteDelayExportCompressedCSV(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?format=csv", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	w := httptest.NewRecorder()
+
+	writeDelayExport(w, req, formatCSV, "global_delay", "Error exporting", nil, streamExportTestDays)
+
+	resp := w.Result()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	records, err := csv.NewReader(bytes.NewReader(decodeBody(t, resp.Body, "br"))).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 4)
+}
+
+func TestWriteDelayExportQueryError(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?format=csv", nil)
+	w := httptest.NewRecorder()
+
+	writeDelayExport(w, req, formatCSV, "global_delay", "Error exporting global delay", nil, func(func(LineDelayDay) error) error {
+		return context.DeadlineExceeded
+	})
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Disposition"))
+}
+
+func TestWriteDelayExportAbortsOnLateError(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?format=csv", nil)
+	w := httptest.NewRecorder()
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		writeDelayExport(w, req, formatCSV, "global_delay", "Error exporting global delay", nil, func(fn func(LineDelayDay) error) error {
+			if err := fn(exportTestDays[0]); err != nil {
+				return err
+			}
+			return errors.New("connection reset")
+		})
+	})
+}
+
+func TestWriteExportEmpty(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/export/departures", nil)
+	w := httptest.NewRecorder()
+
+	writeExport[DepartureRecord](w, req, formatCSV, "departures", "Error exporting", nil)
+
+	records, err := csv.NewReader(w.Result().Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"station", "label", "destination", "plannedDepartureTime", "delayInMinutes", "realtime"}}, records)
+}
+
+func TestStationStatsExportRows(t *testing.T) {
+	stats := StationStats{
+		AvgDelay:        1.5,
+		TotalDepartures: 300,
+		DelayPercentage: 12,
+		Percentiles:     DelayPercentiles{P50: 1, P90: 4, P99: 9},
+		MonthlyStats: []MonthlyData{
+			{Month: "2023-11", AvgDelay: 1.2, Departures: 100, LineStats: map[string]LineStats{
+				"U2": {AvgDelay: 1.5, Departures: 40},
+				"U1": {AvgDelay: 1.0, Departures: 60},
+			}},
+		},
+		HourlyStats:       []HourlyData{{Hour: 7, AvgDelay: 2, Departures: 120}},
+		DelayDistribution: []DelayBucket{{Range: "On Time", Count: 200}},
+	}
+
+	w := httptest.NewRecorder()
+	writeExport(w, httptest.NewRequest("GET", "/", nil), formatCSV, "station_stats", "Error exporting", stationStatsExportRows(stats))
+
+	records, err := csv.NewReader(w.Result().Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"section", "key", "line", "avgDelay", "departures", "value"},
+		{"summary", "total", "", "1.5", "300", ""},
+		{"summary", "delayPercentage", "", "", "", "12"},
+		{"percentile", "p50", "", "", "", "1"},
+		{"percentile", "p90", "", "", "", "4"},
+		{"percentile", "p99", "", "", "", "9"},
+		{"monthly", "2023-11", "", "1.2", "100", ""},
+		{"monthly", "2023-11", "U1", "1", "60", ""},
+		{"monthly", "2023-11", "U2", "1.5", "40", ""},
+		{"hourly", "7", "", "2", "120", ""},
+		{"distribution", "On Time", "", "", "200", ""},
+	}, records)
+}
+
+func TestExportFilename(t *testing.T) {
+	assert.Equal(t, "station_stats_de-09162-1_2023-01-01", exportFilename("station_stats", "de:09162:1", "2023-01-01"))
+	assert.Equal(t, "line_delay_U3_..-x", exportFilename("line_delay", "U3", `../x`))
+}
+
+func TestGlobalDelayHandlerCSV(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{
+		data: [][]interface{}{
+			{"de:09162:1", []map[string]string{
+				{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20.0"},
+			}},
+		},
+	}
+
+	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"),
+		"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil)
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:        mockConn,
+		lineQueries: NewLineQueryService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&format=csv", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, []string{"de:09162:1", friendlyNames["de:09162:1"], "0", "2023-12-25 10:00:00", "2.5", "10", "20", "", "", "", "", ""}, records[1])
+}
+
+func TestGlobalDelayHandlerInvalidFormat(t *testing.T) {
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&format=xml", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "format must be one of json, ndjson, csv, parquet")
+}
+
+func TestExportDeparturesHandler(t *testing.T) {
+	planned := time.Date(2023, 12, 25, 10, 0, 0, 0, time.UTC)
+	conn := &MockDriver{}
+	conn.On("Query", queryNamed("departures"), mock.Anything,
+		"2023-12-25", "2023-12-26", "de:09162:1", "de:09162:1", "", "", 100000).
+		Return(newMockRows(
+			[]interface{}{"de:09162:1", "U3", "Fürstenried West", planned, int32(2), uint8(1)},
+			[]interface{}{"de:09162:1", "U6", "Garching", planned.Add(time.Minute), int32(0), uint8(0)},
+		), nil)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:       conn,
+		departures: NewDepartureService(conn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/export/departures?startDate=2023-12-25&endDate=2023-12-26&station=de:09162:1", nil)
+	w := httptest.NewRecorder()
+
+	exportDeparturesHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `attachment; filename="departures_2023-12-25_2023-12-26.csv"`, resp.Header.Get("Content-Disposition"))
+
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"station", "label", "destination", "plannedDepartureTime", "delayInMinutes", "realtime"},
+		{"de:09162:1", "U3", "Fürstenried West", "2023-12-25T10:00:00Z", "2", "true"},
+		{"de:09162:1", "U6", "Garching", "2023-12-25T10:01:00Z", "0", "false"},
+	}, records)
+}
+
+func TestExportDeparturesHandlerInvalidParams(t *testing.T) {
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	tests := []struct {
+		name  string
+		query string
+		error string
+	}{
+		{"missing end date", "startDate=2023-12-25", "endDate"},
+		{"limit too large", "startDate=2023-12-25&endDate=2023-12-26&limit=5000000", "limit must be between 1 and 1000000"},
+		{"invalid limit", "startDate=2023-12-25&endDate=2023-12-26&limit=abc", "limit must be between"},
+		{"json format", "startDate=2023-12-25&endDate=2023-12-26&format=json", "format must be one of csv, parquet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/export/departures?"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			exportDeparturesHandler(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+			assert.Contains(t, w.Body.String(), tt.error)
+		})
+	}
+}
+
+func TestWriteRowStreamJSON(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?stream=true", nil)
+	w := httptest.NewRecorder()
+
+	writeRowStream(w, req, formatJSON, "global_delay", "Error getting global delay", nil, streamExportTestDays)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Empty(t, resp.Header.Get("Content-Disposition"))
+
+	var days []LineDelayDay
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&days))
+	assert.Equal(t, exportTestDays, days)
+}
+
+func TestWriteRowStreamJSONEmpty(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?stream=true", nil)
+	w := httptest.NewRecorder()
+
+	writeRowStream(w, req, formatJSON, "global_delay", "Error getting global delay", nil, func(func(LineDelayDay) error) error {
+		return nil
+	})
+
+	assert.Equal(t, "[]\n", w.Body.String())
+}
+
+func TestWriteRowStreamNDJSON(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/global_delay?format=ndjson", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	writeRowStream(w, req, formatNDJSON, "global_delay", "Error getting global delay", nil, streamExportTestDays)
+
+	resp := w.Result()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	lines := strings.Split(strings.TrimSpace(string(decodeBody(t, resp.Body, "gzip"))), "\n")
+	assert.Len(t, lines, len(exportTestDays))
+	for i, line := range lines {
+		var day LineDelayDay
+		assert.NoError(t, json.Unmarshal([]byte(line), &day))
+		assert.Equal(t, exportTestDays[i], day)
+	}
+}
+
+func TestLineDelayHandlerStream(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{
+		data: [][]interface{}{
+			{"de:09162:1", "Marienplatz", int32(3), []map[string]string{
+				{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20.0"},
+			}},
+			{"de:09162:2", "Odeonsplatz", int32(4), []map[string]string{}},
+		},
+	}
+
+	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"),
+		"2023-12-25", "2023-12-26", 60, 5, "U3", uint8(1), uint8(1)).Return(mockRows, nil)
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:        mockConn,
+		lineQueries: NewLineQueryService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/line_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&label=U3&south=1&stream=1", nil)
+	w := httptest.NewRecorder()
+
+	lineDelayHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("ETag"))
+
+	var days []LineDelayDay
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&days))
+	assert.Len(t, days, 2)
+	assert.Equal(t, "Odeonsplatz", days[1].Name)
+	mockConn.AssertExpectations(t)
+}
+
+func TestLineDelayHandlerInvalidStream(t *testing.T) {
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/line_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&label=U3&south=1&stream=yes", nil)
+	w := httptest.NewRecorder()
+
+	lineDelayHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "stream must be 0, 1, true or false")
+}
@@ -1,90 +1,28 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
-func TestExtractRequiredParams(t *testing.T) {
-	tests := []struct {
-		name        string
-		queryParams map[string]string
-		requiredKeys []string
-		expectError bool
-		expectedParams map[string]string
-	}{
-		{
-			name: "All parameters present",
-			queryParams: map[string]string{
-				"date": "2023-12-25",
-				"interval": "60",
-				"threshold": "5",
-			},
-			requiredKeys: []string{"date", "interval", "threshold"},
-			expectError: false,
-			expectedParams: map[string]string{
-				"date": "2023-12-25",
-				"interval": "60", 
-				"threshold": "5",
-			},
-		},
-		{
-			name: "Missing parameter",
-			queryParams: map[string]string{
-				"date": "2023-12-25",
-				"interval": "60",
-			},
-			requiredKeys: []string{"date", "interval", "threshold"},
-			expectError: true,
-			expectedParams: nil,
-		},
-		{
-			name: "Empty parameter value",
-			queryParams: map[string]string{
-				"date": "2023-12-25",
-				"interval": "",
-				"threshold": "5",
-			},
-			requiredKeys: []string{"date", "interval", "threshold"},
-			expectError: true,
-			expectedParams: nil,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Create URL with query parameters
-			u := &url.URL{}
-			q := u.Query()
-			for key, value := range tt.queryParams {
-				q.Set(key, value)
-			}
-			u.RawQuery = q.Encode()
-
-			req := &http.Request{URL: u}
-			
-			result, err := extractRequiredParams(req, tt.requiredKeys)
-			
-			if tt.expectError {
-				assert.Error(t, err)
-				assert.Nil(t, result)
-			} else {
-				assert.NoError(t, err)
-				assert.Equal(t, tt.expectedParams, result)
-			}
-		})
-	}
-}
-
 func TestHealthHandler(t *testing.T) {
 	req := httptest.NewRequest("GET", "/health", nil)
 	w := httptest.NewRecorder()
@@ -110,18 +48,18 @@ func TestGlobalDelayHandler(t *testing.T) {
 	}
 
 	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"), 
-		"2023-12-25", "2023-12-26", "60", "5", "1").Return(mockRows, nil)
+		"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil)
 	mockRows.On("Err").Return(nil)
 	mockRows.On("Close").Return(nil)
 
 	// Temporarily replace the global clickhouseService variable
-	originalService := clickhouseService
-	clickhouseService = &ClickHouseService{
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
 		conn: mockConn,
 		stationStats: NewStationStatsService(mockConn),
 		lineQueries: NewLineQueryService(mockConn),
-	}
-	defer func() { clickhouseService = originalService }()
+	})
+	defer func() { clickhouseService.Store(originalService) }()
 
 	// Test successful request
 	req := httptest.NewRequest("GET", "/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5", nil)
@@ -133,12 +71,101 @@ func TestGlobalDelayHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
-	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "X-Partial-Result, X-Result-Warning, X-Request-ID", resp.Header.Get("Access-Control-Expose-Headers"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
 
 	mockConn.AssertExpectations(t)
 	mockRows.AssertExpectations(t)
 }
 
+func TestGlobalDelayHandlerCached(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{
+		data: [][]interface{}{
+			{"de:09162:1", []map[string]string{
+				{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20.0"},
+			}},
+		},
+	}
+
+	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"),
+		"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil).Once()
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:        mockConn,
+		lineQueries: NewLineQueryService(mockConn),
+	})
+	originalCache := queryCache
+	queryCache = NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+	defer func() {
+		clickhouseService.Store(originalService)
+		queryCache = originalCache
+	}()
+
+	// The second request only differs in parameter order and is served from the cache
+	for _, query := range []string{
+		"date=2023-12-25&interval=60&realtime=1&threshold=5",
+		"threshold=5&realtime=1&interval=60&date=2023-12-25",
+	} {
+		req := httptest.NewRequest("GET", "/global_delay?"+query, nil)
+		w := httptest.NewRecorder()
+
+		globalDelayGHandler(w, req)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	mockConn.AssertExpectations(t)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, queryCache.Stats()["global_delay"])
+}
+
+func TestGlobalDelayHandlerServiceDay(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{}
+
+	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"),
+		"2023-12-25 03:00:00", "2023-12-26 03:00:00", 60, 5, uint8(1)).Return(mockRows, nil)
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:         mockConn,
+		stationStats: NewStationStatsService(mockConn),
+		lineQueries:  NewLineQueryService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&serviceDay=1", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockConn.AssertExpectations(t)
+}
+
+func TestGlobalDelayHandlerInvalidServiceDay(t *testing.T) {
+	originalService := clickhouseService.Load()
+	mockConn := &MockDriver{}
+	clickhouseService.Store(&ClickHouseService{
+		conn:        mockConn,
+		lineQueries: NewLineQueryService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&serviceDay=maybe", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "serviceDay")
+}
+
 func TestGlobalDelayHandlerMissingParams(t *testing.T) {
 	req := httptest.NewRequest("GET", "/global_delay?date=2023-12-25", nil)
 	w := httptest.NewRecorder()
@@ -164,18 +191,18 @@ func TestLineDelayHandler(t *testing.T) {
 	}
 
 	mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"), 
-		"2023-12-25", "2023-12-26", "60", "5", "U1", "1", "1").Return(mockRows, nil)
+		"2023-12-25", "2023-12-26", 60, 5, "U1", uint8(1), uint8(1)).Return(mockRows, nil)
 	mockRows.On("Err").Return(nil)
 	mockRows.On("Close").Return(nil)
 
 	// Temporarily replace the global clickhouseService variable
-	originalService := clickhouseService
-	clickhouseService = &ClickHouseService{
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
 		conn: mockConn,
 		stationStats: NewStationStatsService(mockConn),
 		lineQueries: NewLineQueryService(mockConn),
-	}
-	defer func() { clickhouseService = originalService }()
+	})
+	defer func() { clickhouseService.Store(originalService) }()
 
 	// Test successful request
 	req := httptest.NewRequest("GET", "/line_delay?date=2023-12-25&south=1&interval=60&realtime=1&label=U1&threshold=5", nil)
@@ -187,7 +214,8 @@ func TestLineDelayHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
-	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
 
 	mockConn.AssertExpectations(t)
 	mockRows.AssertExpectations(t)
@@ -206,6 +234,213 @@ func TestLineDelayHandlerMissingParams(t *testing.T) {
 	assert.Contains(t, string(body), "missing parameter")
 }
 
+func TestLineStatsHandlerMissingParams(t *testing.T) {
+	originalService := clickhouseService.Load()
+	mockConn := &MockDriver{}
+	clickhouseService.Store(&ClickHouseService{
+		conn:      mockConn,
+		lineStats: NewLineStatsService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/line_stats?startDate=2023-01-01&endDate=2023-02-01", nil)
+	w := httptest.NewRecorder()
+
+	lineStatsHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing parameter")
+}
+
+func TestLineStatsHandlerServiceUnavailable(t *testing.T) {
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(nil)
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/line_stats?label=U2", nil)
+	w := httptest.NewRecorder()
+
+	lineStatsHandler(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestLineStatsHandlerUnknownLine(t *testing.T) {
+	originalService := clickhouseService.Load()
+	mockConn := &MockDriver{}
+	mockConn.On("QueryRow", queryNamed("line_station_count"), mock.Anything, "U9").
+		Return(&MockRow{data: []interface{}{uint64(0)}})
+	clickhouseService.Store(&ClickHouseService{
+		conn:      mockConn,
+		lineStats: NewLineStatsService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/line_stats?label=U9&startDate=2023-01-01&endDate=2023-02-01", nil)
+	w := httptest.NewRecorder()
+
+	lineStatsHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, errCodeNotFound, apiErr.Code)
+	assert.Equal(t, "unknown line U9", apiErr.Message)
+	assert.Equal(t, map[string]string{"label": "U9"}, apiErr.Details)
+	mockConn.AssertExpectations(t)
+}
+
+func TestHandlersValidateBeforeServiceUnavailable(t *testing.T) {
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(nil)
+	defer func() { clickhouseService.Store(originalService) }()
+
+	// A bad request is answered with 400 whether ClickHouse is connected or not
+	handlers := map[string]http.HandlerFunc{
+		"/api/line_delay?label=U2":                  lineDelayHandler,
+		"/api/global_delay?date=2023-12-25":         globalDelayGHandler,
+		"/api/station_stats?threshold=two":          stationStatsHandler,
+		"/api/line_stats?startDate=2023-01-01":      lineStatsHandler,
+		"/api/rankings?limit=0":                     rankingsHandler,
+		"/api/export/departures?startDate=tomorrow": exportDeparturesHandler,
+	}
+	for target, handler := range handlers {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+}
+
+func TestRankingsHandlerInvalidLimit(t *testing.T) {
+	originalService := clickhouseService.Load()
+	mockConn := &MockDriver{}
+	clickhouseService.Store(&ClickHouseService{
+		conn:         mockConn,
+		stationStats: NewStationStatsService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	for _, limit := range []string{"0", "51", "ten"} {
+		req := httptest.NewRequest("GET", "/rankings?limit="+limit, nil)
+		w := httptest.NewRecorder()
+
+		rankingsHandler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, "limit=%s", limit)
+	}
+	mockConn.AssertExpectations(t)
+}
+
+func TestStationStatsHandlerInvalidOptions(t *testing.T) {
+	originalService := clickhouseService.Load()
+	mockConn := &MockDriver{}
+	clickhouseService.Store(&ClickHouseService{
+		conn:         mockConn,
+		stationStats: NewStationStatsService(mockConn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	for _, query := range []string{"threshold=two", "buckets=5,2", "buckets=0,x"} {
+		req := httptest.NewRequest("GET", "/station_stats?station=de:09162:1&"+query, nil)
+		w := httptest.NewRecorder()
+
+		stationStatsHandler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	mockConn.AssertExpectations(t)
+}
+
+func TestStationStatsHandlerUnknownStation(t *testing.T) {
+	data := stationStatsRows()
+	delete(data, "station_exists")
+	conn := newStationStatsConn(0, data)
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:         conn,
+		stationStats: NewStationStatsService(conn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/station_stats?station=de:09162:1&startDate=2023-11-01&endDate=2024-01-01", nil)
+	w := httptest.NewRecorder()
+
+	stationStatsHandler(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, errCodeNotFound, apiErr.Code)
+	assert.Equal(t, "no data found for station de:09162:1", apiErr.Message)
+	assert.Equal(t, map[string]string{"station": "de:09162:1"}, apiErr.Details)
+}
+
+func TestStationStatsHandlerTimeout(t *testing.T) {
+	conn := newStationStatsConn(time.Second, stationStatsRows())
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:         conn,
+		stationStats: NewStationStatsService(conn),
+	})
+	originalTimeouts := queryTimeouts
+	queryTimeouts = map[string]time.Duration{"station_stats": 10 * time.Millisecond}
+	defer func() {
+		clickhouseService.Store(originalService)
+		queryTimeouts = originalTimeouts
+	}()
+
+	req := httptest.NewRequest("GET", "/station_stats?station=de:09162:1&startDate=2023-11-01&endDate=2024-01-01", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	stationStatsHandler(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "query timed out")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestWriteQueryError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"Deadline exceeded", fmt.Errorf("query failed: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, errCodeQueryTimeout},
+		{"Socket deadline", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), http.StatusGatewayTimeout, errCodeQueryTimeout},
+		{"ClickHouse timeout", fmt.Errorf("query failed: %w", &clickhouse.Exception{Code: 159}), http.StatusGatewayTimeout, errCodeQueryTimeout},
+		{"ClickHouse syntax error", fmt.Errorf("query failed: %w", &clickhouse.Exception{Code: 62, Message: "Syntax error near SELECT"}), http.StatusInternalServerError, errCodeInternal},
+		{"Other error", errors.New("dial tcp 10.0.0.5:9000: connection refused"), http.StatusInternalServerError, errCodeInternal},
+		{"Invalid date range", fmt.Errorf("invalid date range: %w", validateDateRange("2024-02-01", "2024-01-01")), http.StatusBadRequest, errCodeInvalidDateRange},
+		{"Unknown line", fmt.Errorf("line validation failed: %w", &NotFoundError{Param: "label", Value: "U9", Message: "unknown line U9"}), http.StatusNotFound, errCodeNotFound},
+		{"Invalid day", fmt.Errorf("invalid day format: %w", func() error { _, _, err := getDayRange("yesterday"); return err }()), http.StatusBadRequest, errCodeInvalidDate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/line_delay", nil)
+			w := httptest.NewRecorder()
+			writeQueryError(w, req, "Error getting line delay", tt.err)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var apiErr APIError
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+			assert.Equal(t, tt.expectedCode, apiErr.Code)
+			if tt.expectedStatus == http.StatusInternalServerError {
+				// Database errors must not leak to the client
+				assert.Equal(t, "Error getting line delay", apiErr.Message)
+			}
+		})
+	}
+
+	// Cancelled requests get no response
+	w := httptest.NewRecorder()
+	writeQueryError(w, httptest.NewRequest("GET", "/api/line_delay", nil), "Error getting line delay", context.Canceled)
+	assert.Empty(t, w.Body.String())
+}
+
 func TestFilterAndDedup(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -260,20 +495,162 @@ func TestFilterAndDedup(t *testing.T) {
 	}
 }
 
-func TestWriteGzippedJSON(t *testing.T) {
+func TestWriteCompressedJSON(t *testing.T) {
 	w := httptest.NewRecorder()
 	testData := map[string]interface{}{
 		"test": "data",
 		"number": 42,
 	}
 
-	err := writeGzippedJSON(w, testData)
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	err := writeCompressedJSON(w, req, testData, time.Now())
 	assert.NoError(t, err)
 
 	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
-	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	// Tiny bodies are sent uncompressed
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.JSONEq(t, `{"test": "data", "number": 42}`, string(body))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+	assert.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+	assert.Empty(t, resp.Header.Get("Last-Modified"))
+}
+
+func TestWriteCompressedJSONNegotiation(t *testing.T) {
+	testData := []DelayBucket{}
+	for i := 0; i < 100; i++ {
+		testData = append(testData, DelayBucket{Range: fmt.Sprintf("%d-%d min", i, i+1), Count: uint64(i)})
+	}
+	expected, _ := json.Marshal(testData)
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, br;q=0", ""},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "br"},
+		{"deflate", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			w := httptest.NewRecorder()
+			err := writeCompressedJSON(w, req, testData, time.Now())
+			assert.NoError(t, err)
+
+			resp := w.Result()
+			assert.Equal(t, tt.encoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+			body := decodeBody(t, resp.Body, tt.encoding)
+			assert.JSONEq(t, string(expected), string(body))
+			assert.Equal(t, strconv.Itoa(w.Body.Len()), resp.Header.Get("Content-Length"))
+		})
+	}
+}
+
+// decodeBody reverses the content coding of a response body
+func decodeBody(t *testing.T, body io.Reader, encoding string) []byte {
+	var reader io.Reader
+	switch encoding {
+	case "":
+		reader = body
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		assert.NoError(t, err)
+		reader = gz
+	case "br":
+		reader = brotli.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		assert.NoError(t, err)
+		defer zr.Close()
+		reader = zr
+	}
+
+	decoded, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func TestWriteCompressedJSONFinalDay(t *testing.T) {
+	testData := map[string]interface{}{"test": "data"}
+	dataEnd := time.Date(2023, 12, 26, 0, 0, 0, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	err := writeCompressedJSON(w, httptest.NewRequest("GET", "/api/test", nil), testData, dataEnd)
+	assert.NoError(t, err)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "public, max-age=86400", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "Tue, 26 Dec 2023 01:00:00 GMT", resp.Header.Get("Last-Modified"))
+	etag := resp.Header.Get("ETag")
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"etag in list", map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{"strong form of etag", map[string]string{"If-None-Match": strings.TrimPrefix(etag, "W/")}, http.StatusNotModified},
+		{"wildcard", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"stale etag", map[string]string{"If-None-Match": `W/"stale"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": "Wed, 27 Dec 2023 00:00:00 GMT"}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": "Mon, 25 Dec 2023 00:00:00 GMT"}, http.StatusOK},
+		{"etag takes precedence", map[string]string{
+			"If-None-Match":     `W/"stale"`,
+			"If-Modified-Since": "Wed, 27 Dec 2023 00:00:00 GMT",
+		}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			w := httptest.NewRecorder()
+			err := writeCompressedJSON(w, req, testData, dataEnd)
+			assert.NoError(t, err)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, etag, resp.Header.Get("ETag"))
+			if tt.status == http.StatusNotModified {
+				assert.Empty(t, body)
+			}
+		})
+	}
+}
+
+func TestWriteCompressedJSONCurrentDayIgnoresIfModifiedSince(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+
+	w := httptest.NewRecorder()
+	err := writeCompressedJSON(w, req, map[string]string{"test": "data"}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
 }
 
 func TestEventBroadcasterSSEHandler(t *testing.T) {
@@ -316,18 +693,52 @@ func TestEventBroadcasterSSEHandler(t *testing.T) {
 	mockRedis.AssertExpectations(t)
 }
 
+func TestEventBroadcasterSSEHandlerShutdown(t *testing.T) {
+	mockRedis := &EnhancedMockRedisClient{}
+	eb := newEventBroadcaster(mockRedis, defaultConfig().Redis)
+
+	statusCmd := redis.NewStatusCmd(context.Background())
+	statusCmd.SetVal("OK")
+	mockRedis.On("XGroupCreate", mock.Anything, redisStreamName, mock.AnythingOfType("string"), "0").Return(statusCmd)
+
+	// No new departures, the stream only ends because of the shutdown
+	streamCmd := redis.NewXStreamSliceCmd(context.Background())
+	streamCmd.SetErr(redis.Nil)
+	mockRedis.On("XReadGroup", mock.Anything, mock.AnythingOfType("*redis.XReadGroupArgs")).Return(streamCmd)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		eb.closeStreams()
+		eb.closeStreams() // Shutdown hooks may run more than once
+	}()
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		eb.sseHandler(w, httptest.NewRequest("GET", "/api/events", nil))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("event stream did not end on shutdown")
+	}
+	assert.Equal(t, "event: close\nretry: 5000\ndata: shutdown\n\n", w.Body.String())
+}
+
 // Integration tests
 func TestHTTPServerIntegration(t *testing.T) {
 	// This test would require setting up a test server
 	// For now, we'll test the handler registration
-	originalService := clickhouseService
+	originalService := clickhouseService.Load()
 	mockConn := &MockDriver{}
-	clickhouseService = &ClickHouseService{
+	clickhouseService.Store(&ClickHouseService{
 		conn: mockConn,
 		stationStats: NewStationStatsService(mockConn),
 		lineQueries: NewLineQueryService(mockConn),
-	}
-	defer func() { clickhouseService = originalService }()
+	})
+	defer func() { clickhouseService.Store(originalService) }()
 
 	// Test that handlers are properly registered by making requests
 	testCases := []struct {
@@ -368,16 +779,6 @@ func BenchmarkHealthHandler(b *testing.B) {
 	}
 }
 
-func BenchmarkExtractRequiredParams(b *testing.B) {
-	u, _ := url.Parse("http://example.com?date=2023-12-25&interval=60&threshold=5&realtime=1")
-	req := &http.Request{URL: u}
-	keys := []string{"date", "interval", "threshold", "realtime"}
-	
-	for i := 0; i < b.N; i++ {
-		extractRequiredParams(req, keys)
-	}
-}
-
 func BenchmarkFilterAndDedup(b *testing.B) {
 	departures := []Departure{
 		{Label: "U1"}, {Label: "U2"}, {Label: "16"}, {Label: "S1"},
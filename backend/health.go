@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Statuses of a health check and of the whole report. A failing check makes
+// the instance unready, a warning only flags it as degraded.
+const (
+	healthOK   = "ok"
+	healthWarn = "warn"
+	healthFail = "fail"
+)
+
+// healthCheckTimeout bounds every dependency check, the checks run in
+// parallel so that readiness answers well within the container healthcheck
+// timeout
+const healthCheckTimeout = 2 * time.Second
+
+// defaultEventMaxAge is how long the event stream may go without a departure
+// update before readiness warns about it
+const defaultEventMaxAge = 10 * time.Minute
+
+// HealthReport is the body of the liveness and readiness endpoints
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of checking a single dependency
+type HealthCheck struct {
+	Status     string   `json:"status"`
+	Message    string   `json:"message,omitempty"`
+	LatencyMs  float64  `json:"latencyMs"`
+	AgeSeconds *float64 `json:"ageSeconds,omitempty"` // last departure event
+	Length     *int64   `json:"length,omitempty"`     // event stream
+}
+
+// livenessHandler reports that the process is serving requests. It checks no
+// dependencies, an outage of ClickHouse or Redis is not fixed by a restart.
+// This includes the initial connection to ClickHouse, which the connector
+// keeps retrying in the background.
+func livenessHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealthReport(w, HealthReport{Status: healthOK})
+}
+
+// readinessHandler checks the dependencies of the API and the live event
+// stream. It answers 503 Service Unavailable when one of them failed.
+func (eb *EventBroadcaster) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, eb.checkHealth(r.Context()))
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if report.Status == healthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		httpLog.Warn("encoding health report failed", "error", err)
+	}
+}
+
+// checkHealth runs all dependency checks concurrently
+func (eb *EventBroadcaster) checkHealth(ctx context.Context) HealthReport {
+	checks := map[string]func(context.Context) HealthCheck{
+		"clickhouse":             checkClickHouse,
+		"redis":                  eb.checkRedis,
+		"keyspace_notifications": eb.checkKeyspaceNotifications,
+		"last_event":             eb.checkLastEvent,
+		"event_stream":           eb.checkEventStream,
+	}
+
+	report := HealthReport{Status: healthOK, Checks: make(map[string]HealthCheck, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			result := check(checkCtx)
+			result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, check := range report.Checks {
+		if check.Status == healthFail || (check.Status == healthWarn && report.Status == healthOK) {
+			report.Status = check.Status
+		}
+	}
+	return report
+}
+
+// checkClickHouse fails until the connector established the connection, the
+// data endpoints answer 503 until then. Ping errors are only logged, they may
+// name hosts and credentials of the database.
+func checkClickHouse(ctx context.Context) HealthCheck {
+	service := clickhouseService.Load()
+	if service == nil {
+		message := clickhouseConnector.status()
+		if message == "" {
+			message = "connecting"
+		}
+		return HealthCheck{Status: healthFail, Message: message}
+	}
+	if err := service.Ping(ctx); err != nil {
+		clickhouseLog.WarnContext(ctx, "health check ping failed", "error", err)
+		return HealthCheck{Status: healthFail, Message: "ping failed"}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+func (eb *EventBroadcaster) checkRedis(ctx context.Context) HealthCheck {
+	if err := eb.redisClient.Ping(ctx).Err(); err != nil {
+		redisLog.WarnContext(ctx, "health check ping failed", "error", err)
+		return HealthCheck{Status: healthFail, Message: "ping failed"}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// checkKeyspaceNotifications verifies that Redis publishes the keyevents
+// redisEventProcessor subscribes to. Without them the event stream stays
+// silent while every other check passes.
+func (eb *EventBroadcaster) checkKeyspaceNotifications(ctx context.Context) HealthCheck {
+	config, err := eb.redisClient.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		// Managed Redis offerings often disable CONFIG
+		redisLog.WarnContext(ctx, "health check cannot read notify-keyspace-events", "error", err)
+		return HealthCheck{Status: healthWarn, Message: "cannot read notify-keyspace-events"}
+	}
+
+	flags := config["notify-keyspace-events"]
+	if !keyeventsEnabled(flags) {
+		return HealthCheck{
+			Status:  healthFail,
+			Message: fmt.Sprintf("notify-keyspace-events is %q, keyevents for string commands need E and $ (or A)", flags),
+		}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+func (eb *EventBroadcaster) checkLastEvent(context.Context) HealthCheck {
+	last := eb.lastEvent.Load()
+	if last == 0 {
+		return HealthCheck{Status: healthWarn, Message: "no departure event processed since start"}
+	}
+
+	age := time.Since(time.Unix(0, last))
+	seconds := age.Seconds()
+	check := HealthCheck{Status: healthOK, AgeSeconds: &seconds}
+	if maxAge := eb.config.EventMaxAge; age > maxAge {
+		check.Status = healthWarn
+		check.Message = fmt.Sprintf("no departure event for more than %s", maxAge)
+	}
+	return check
+}
+
+func (eb *EventBroadcaster) checkEventStream(ctx context.Context) HealthCheck {
+	length, err := eb.redisClient.XLen(ctx, redisStreamName).Result()
+	if err != nil {
+		redisLog.WarnContext(ctx, "health check of the event stream failed", "error", err)
+		return HealthCheck{Status: healthFail, Message: "reading the stream length failed"}
+	}
+
+	check := HealthCheck{Status: healthOK, Length: &length}
+	if length == 0 {
+		check.Status = healthWarn
+		check.Message = "stream " + redisStreamName + " is empty"
+	}
+	return check
+}
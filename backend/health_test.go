@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	livenessHandler(w, httptest.NewRequest("GET", "/api/health/live", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+// newHealthyRedis returns a mock Redis that passes every readiness check
+func newHealthyRedis(keyspaceEvents string, streamLength int64) *EnhancedMockRedisClient {
+	mockRedis := &EnhancedMockRedisClient{}
+	mockRedis.On("Ping", mock.Anything).Return(redis.NewStatusResult("PONG", nil))
+	mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+		Return(redis.NewMapStringStringResult(map[string]string{"notify-keyspace-events": keyspaceEvents}, nil))
+	mockRedis.On("XLen", mock.Anything, redisStreamName).Return(redis.NewIntResult(streamLength, nil))
+	return mockRedis
+}
+
+func readiness(t *testing.T, eb *EventBroadcaster) (int, HealthReport) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	eb.readinessHandler(w, httptest.NewRequest("GET", "/api/health/ready", nil))
+
+	var report HealthReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	return w.Code, report
+}
+
+func TestReadinessHandler(t *testing.T) {
+	originalService := clickhouseService.Load()
+	defer func() { clickhouseService.Store(originalService) }()
+
+	mockConn := &MockDriver{}
+	mockConn.On("Ping", mock.Anything).Return(nil)
+	clickhouseService.Store(&ClickHouseService{conn: mockConn})
+
+	eb := newEventBroadcaster(newHealthyRedis("Ex$", 42), defaultConfig().Redis)
+	eb.lastEvent.Store(time.Now().Add(-30 * time.Second).UnixNano())
+
+	status, report := readiness(t, eb)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, healthOK, report.Status)
+	for _, name := range []string{"clickhouse", "redis", "keyspace_notifications", "last_event", "event_stream"} {
+		assert.Equal(t, healthOK, report.Checks[name].Status, name)
+	}
+	if assert.NotNil(t, report.Checks["event_stream"].Length) {
+		assert.Equal(t, int64(42), *report.Checks["event_stream"].Length)
+	}
+	if assert.NotNil(t, report.Checks["last_event"].AgeSeconds) {
+		assert.InDelta(t, 30, *report.Checks["last_event"].AgeSeconds, 5)
+	}
+}
+
+func TestReadinessHandlerFailures(t *testing.T) {
+	originalService := clickhouseService.Load()
+	defer func() { clickhouseService.Store(originalService) }()
+
+	t.Run("clickhouse ping fails", func(t *testing.T) {
+		mockConn := &MockDriver{}
+		mockConn.On("Ping", mock.Anything).Return(errors.New("connection refused"))
+		clickhouseService.Store(&ClickHouseService{conn: mockConn})
+		eb := newEventBroadcaster(newHealthyRedis("AE", 1), defaultConfig().Redis)
+		eb.lastEvent.Store(time.Now().UnixNano())
+
+		status, report := readiness(t, eb)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, healthFail, report.Checks["clickhouse"].Status)
+		assert.Equal(t, "ping failed", report.Checks["clickhouse"].Message, "driver errors are only logged")
+	})
+
+	t.Run("keyspace notifications disabled", func(t *testing.T) {
+		mockConn := &MockDriver{}
+		mockConn.On("Ping", mock.Anything).Return(nil)
+		clickhouseService.Store(&ClickHouseService{conn: mockConn})
+		eb := newEventBroadcaster(newHealthyRedis("Ex", 1), defaultConfig().Redis) // no string events
+		eb.lastEvent.Store(time.Now().UnixNano())
+
+		status, report := readiness(t, eb)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, healthFail, report.Checks["keyspace_notifications"].Status)
+		assert.Equal(t, healthOK, report.Checks["redis"].Status)
+	})
+}
+
+func TestReadinessHandlerWarnings(t *testing.T) {
+	originalService := clickhouseService.Load()
+	defer func() { clickhouseService.Store(originalService) }()
+
+	mockConn := &MockDriver{}
+	mockConn.On("Ping", mock.Anything).Return(nil)
+	clickhouseService.Store(&ClickHouseService{conn: mockConn})
+
+	config := defaultConfig().Redis
+	config.EventMaxAge = time.Minute
+	eb := newEventBroadcaster(newHealthyRedis("Ex$", 0), config)
+	eb.lastEvent.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+
+	// A silent event stream degrades the instance but keeps it ready
+	status, report := readiness(t, eb)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, healthWarn, report.Status)
+	assert.Equal(t, healthWarn, report.Checks["last_event"].Status)
+	assert.Equal(t, healthWarn, report.Checks["event_stream"].Status)
+
+	status, _ = readiness(t, newEventBroadcaster(newHealthyRedis("KEA", 3), defaultConfig().Redis))
+	assert.Equal(t, http.StatusOK, status, "no event since start is only a warning")
+}
+
+func TestReadinessWhileConnectingToClickHouse(t *testing.T) {
+	originalService := clickhouseService.Load()
+	originalConnector := clickhouseConnector
+	defer func() {
+		clickhouseService.Store(originalService)
+		clickhouseConnector = originalConnector
+	}()
+
+	clickhouseService.Store(nil)
+	clickhouseConnector = &ClickHouseConnector{}
+	eb := newEventBroadcaster(newHealthyRedis("AE", 1), defaultConfig().Redis)
+	eb.lastEvent.Store(time.Now().UnixNano())
+
+	// The data endpoints answer 503 until ClickHouse is connected
+	status, report := readiness(t, eb)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, healthFail, report.Status)
+	assert.Equal(t, healthFail, report.Checks["clickhouse"].Status)
+	assert.Equal(t, "connecting", report.Checks["clickhouse"].Message)
+
+	clickhouseConnector.record(errors.New("connection refused"), time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	_, report = readiness(t, eb)
+	assert.Equal(t, "connecting, attempt 1 failed; next attempt at 2025-01-01T12:00:00Z",
+		report.Checks["clickhouse"].Message)
+
+	// Liveness does not depend on ClickHouse, a restart would not help
+	rec := httptest.NewRecorder()
+	livenessHandler(rec, httptest.NewRequest(http.MethodGet, "/api/health/live", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestCheckKeyspaceNotificationsWithoutConfig(t *testing.T) {
+	mockRedis := &EnhancedMockRedisClient{}
+	mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+		Return(redis.NewMapStringStringResult(nil, errors.New("ERR unknown command 'CONFIG'")))
+	eb := newEventBroadcaster(mockRedis, defaultConfig().Redis)
+
+	check := eb.checkKeyspaceNotifications(context.Background())
+	assert.Equal(t, healthWarn, check.Status)
+	assert.Equal(t, "cannot read notify-keyspace-events", check.Message, "Redis errors are only logged")
+}
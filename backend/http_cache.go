@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxAgeFinal is the client cache lifetime of responses for finished days
+	maxAgeFinal = 24 * time.Hour
+	// maxAgeCurrent is the client cache lifetime of responses that still change
+	maxAgeCurrent = time.Minute
+)
+
+// isFinalRange reports whether data ending at end will no longer change
+func isFinalRange(end time.Time) bool {
+	return time.Now().After(end.Add(cacheSettleTime))
+}
+
+// responseETag computes a weak ETag over the uncompressed response body.
+// It is weak since the same body is served in different content codings.
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setCacheHeaders sets the validators and the caching policy of a response
+// covering data up to dataEnd. It returns the Last-Modified time, which is
+// zero for data that may still change. A Cache-Control header set before,
+// e.g. for partial results, is kept.
+func setCacheHeaders(h http.Header, etag string, dataEnd time.Time) time.Time {
+	h.Set("ETag", etag)
+
+	if h.Get("Cache-Control") != "" {
+		return time.Time{}
+	}
+	if !isFinalRange(dataEnd) {
+		h.Set("Cache-Control", formatCacheControl(maxAgeCurrent))
+		return time.Time{}
+	}
+
+	lastModified := dataEnd.Add(cacheSettleTime).UTC().Truncate(time.Second)
+	h.Set("Cache-Control", formatCacheControl(maxAgeFinal))
+	h.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	return lastModified
+}
+
+func formatCacheControl(maxAge time.Duration) string {
+	return "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+}
+
+// notModified evaluates the conditional headers of a GET request.
+// If-Modified-Since is only considered without If-None-Match, see RFC 9110 13.2.2.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+
+	if lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// etagMatches performs the weak comparison of If-None-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
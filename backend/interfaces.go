@@ -2,15 +2,28 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// RedisClientInterface defines the Redis operations used by EventBroadcaster
+// RedisClientInterface defines the Redis operations used by EventBroadcaster and its health checks
 type RedisClientInterface interface {
 	PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
 	Get(ctx context.Context, key string) *redis.StringCmd
 	XGroupCreate(ctx context.Context, stream, group, start string) *redis.StatusCmd
 	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
 	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XLen(ctx context.Context, stream string) *redis.IntCmd
+	Ping(ctx context.Context) *redis.StatusCmd
+	ConfigGet(ctx context.Context, parameter string) *redis.MapStringStringCmd
+	ConfigSet(ctx context.Context, parameter, value string) *redis.StatusCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+// PubSubInterface defines the *redis.PubSub operations used to receive keyevents
+type PubSubInterface interface {
+	ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error)
+	Ping(ctx context.Context, payload ...string) error
+	Close() error
 }
\ No newline at end of file
@@ -12,16 +12,45 @@ type LineQueryService struct {
 	conn driver.Conn
 }
 
+// DelayQueryOptions controls how delay buckets are aggregated
+type DelayQueryOptions struct {
+	DayStartHour int  // hour at which the day begins, 0 for midnight
+	Extended     bool // add median, p90, p95, max and standard deviation to every bucket
+}
+
 // NewLineQueryService creates a new line query service
 func NewLineQueryService(conn driver.Conn) *LineQueryService {
 	return &LineQueryService{conn: conn}
 }
 
+// sqlBool converts a flag to the 0/1 the queries compare against
+func sqlBool(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // GetGlobalDelay retrieves global delay data for all stations
-func (s *LineQueryService) GetGlobalDelay(day, interval, threshold, realtime string) ([]LineDelayDay, error) {
-	start, end, err := getDayRange(day)
+func (s *LineQueryService) GetGlobalDelay(ctx context.Context, day string, interval, threshold int, realtime bool, opts DelayQueryOptions) ([]LineDelayDay, error) {
+	var results []LineDelayDay
+	err := s.StreamGlobalDelay(ctx, day, interval, threshold, realtime, opts, func(result LineDelayDay) error {
+		results = append(results, result)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("invalid day format: %w", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// StreamGlobalDelay calls fn for the delay data of every station as the rows
+// arrive, without holding the whole result in memory. An error returned by
+// fn stops the iteration.
+func (s *LineQueryService) StreamGlobalDelay(ctx context.Context, day string, interval, threshold int, realtime bool, opts DelayQueryOptions, fn func(LineDelayDay) error) error {
+	start, end, err := getServiceDayRange(day, opts.DayStartHour)
+	if err != nil {
+		return fmt.Errorf("invalid day format: %w", err)
 	}
 
 	query := `
@@ -37,15 +66,15 @@ func (s *LineQueryService) GetGlobalDelay(day, interval, threshold, realtime str
 				'bucket', toString(x.1), 
 				'avgDelay', toString(x.2), 
 				'numDepartures', toString(x.3), 
-				'percentageThreshold', toString(x.4)
-			), groupArray((bucket, avgDelay, numDepartures, percentageThreshold))) AS buckets
+				'percentageThreshold', toString(x.4)` + optionalSQL(opts.Extended, delaySpreadMapEntries) + `
+			), groupArray((bucket, avgDelay, numDepartures, percentageThreshold` + optionalSQL(opts.Extended, delaySpreadTupleFields) + `))) AS buckets
 		FROM (
 			SELECT
 				responses_dedup.station AS station,
 				toStartOfInterval(plannedDepartureTime, toIntervalMinute(intervalMin)) AS bucket,
 				avg(delayInMinutes) AS avgDelay,
 				count() AS numDepartures,
-				(100.0 * countIf(delayInMinutes > thresholdMin)) / count() AS percentageThreshold
+				(100.0 * countIf(delayInMinutes > thresholdMin)) / count() AS percentageThreshold` + optionalSQL(opts.Extended, delaySpreadColumns) + `
 			FROM mvg.responses_dedup
 			WHERE (plannedDepartureTime >= startDate) 
 			AND (plannedDepartureTime < endDate) 
@@ -56,40 +85,59 @@ func (s *LineQueryService) GetGlobalDelay(day, interval, threshold, realtime str
 		GROUP BY station
 	`
 
-	rows, err := s.conn.Query(context.Background(), query, start, end, interval, threshold, realtime)
+	rows, err := s.conn.Query(withQueryName(ctx, "global_delay"), query, start, end, interval, threshold, sqlBool(realtime))
 	if err != nil {
-		return nil, fmt.Errorf("global delay query failed: %w", err)
+		return fmt.Errorf("global delay query failed: %w", err)
 	}
 	defer rows.Close()
 
-	var results []LineDelayDay
 	for rows.Next() {
 		var station string
 		var buckets []map[string]string
 
 		if err := rows.Scan(&station, &buckets); err != nil {
+			if err := skipRow(ctx, "global_delay", err); err != nil {
+				return err
+			}
 			continue
 		}
 
-		results = append(results, LineDelayDay{
+		err := fn(LineDelayDay{
 			Station:     station,
 			Buckets:     buckets,
 			Coordinates: coordinates[station],
 		})
+		if err != nil {
+			return err
+		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating global delay results: %w", err)
+		return fmt.Errorf("error iterating global delay results: %w", err)
 	}
 
-	return results, nil
+	return nil
 }
 
 // GetDelayForLine retrieves delay data for a specific subway line
-func (s *LineQueryService) GetDelayForLine(day, interval, threshold, label, isSouth, realtime string) ([]LineDelayDay, error) {
-	start, end, err := getDayRange(day)
+func (s *LineQueryService) GetDelayForLine(ctx context.Context, day string, interval, threshold int, label string, isSouth, realtime bool, opts DelayQueryOptions) ([]LineDelayDay, error) {
+	var results []LineDelayDay
+	err := s.StreamDelayForLine(ctx, day, interval, threshold, label, isSouth, realtime, opts, func(result LineDelayDay) error {
+		results = append(results, result)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("invalid day format: %w", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// StreamDelayForLine calls fn for the delay data of every station of a line
+// as the rows arrive. An error returned by fn stops the iteration.
+func (s *LineQueryService) StreamDelayForLine(ctx context.Context, day string, interval, threshold int, label string, isSouth, realtime bool, opts DelayQueryOptions, fn func(LineDelayDay) error) error {
+	start, end, err := getServiceDayRange(day, opts.DayStartHour)
+	if err != nil {
+		return fmt.Errorf("invalid day format: %w", err)
 	}
 
 	query := `
@@ -110,9 +158,9 @@ func (s *LineQueryService) GetDelayForLine(day, interval, threshold, label, isSo
 					'bucket', toString(x.1),
 					'avgDelay', toString(x.2),
 					'numDepartures', toString(x.3),
-					'percentageThreshold', toString(x.4)
+					'percentageThreshold', toString(x.4)` + optionalSQL(opts.Extended, delaySpreadMapEntries) + `
 				),
-				groupArray((bucket, avgDelay, numDepartures, percentageThreshold))
+				groupArray((bucket, avgDelay, numDepartures, percentageThreshold` + optionalSQL(opts.Extended, delaySpreadTupleFields) + `))
 			) AS buckets
 		FROM (
 			SELECT
@@ -122,7 +170,7 @@ func (s *LineQueryService) GetDelayForLine(day, interval, threshold, label, isSo
 				toStartOfInterval(plannedDepartureTime, toIntervalMinute(intervalMin)) AS bucket,
 				avg(delayInMinutes) AS avgDelay,
 				count() AS numDepartures,
-				(100.0 * countIf(delayInMinutes > thresholdMin)) / count() AS percentageThreshold
+				(100.0 * countIf(delayInMinutes > thresholdMin)) / count() AS percentageThreshold` + optionalSQL(opts.Extended, delaySpreadColumns) + `
 			FROM mvg.responses_dedup
 			INNER JOIN mvg.lines as thisStation ON (
 				responses_dedup.station = thisStation.station 
@@ -152,35 +200,40 @@ func (s *LineQueryService) GetDelayForLine(day, interval, threshold, label, isSo
 		ORDER BY stop
 	`
 
-	rows, err := s.conn.Query(context.Background(), query, start, end, interval, threshold, label, isSouth, realtime)
+	rows, err := s.conn.Query(withQueryName(ctx, "line_delay"), query, start, end, interval, threshold, label, sqlBool(isSouth), sqlBool(realtime))
 	if err != nil {
-		return nil, fmt.Errorf("line delay query failed: %w", err)
+		return fmt.Errorf("line delay query failed: %w", err)
 	}
 	defer rows.Close()
 
-	var results []LineDelayDay
 	for rows.Next() {
 		var station, name string
 		var stop int32
 		var buckets []map[string]string
 
 		if err := rows.Scan(&station, &name, &stop, &buckets); err != nil {
+			if err := skipRow(ctx, "line_delay", err); err != nil {
+				return err
+			}
 			continue
 		}
 
-		results = append(results, LineDelayDay{
+		err := fn(LineDelayDay{
 			Station: station,
 			Name:    name,
 			Stop:    stop,
 			Buckets: buckets,
 		})
+		if err != nil {
+			return err
+		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating line delay results: %w", err)
+		return fmt.Errorf("error iterating line delay results: %w", err)
 	}
 
-	return results, nil
+	return nil
 }
 
 
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// worstStationsLimit is the number of stations returned in LineStatsReport.WorstStations
+const worstStationsLimit = 5
+
+// LineStatsService handles all line statistics operations
+type LineStatsService struct {
+	conn driver.Conn
+}
+
+// NewLineStatsService creates a new line statistics service
+func NewLineStatsService(conn driver.Conn) *LineStatsService {
+	return &LineStatsService{conn: conn}
+}
+
+// GetLineStats retrieves comprehensive statistics for a line within a date range.
+// dayStartHour selects the hour at which days begin (0 for midnight).
+func (s *LineStatsService) GetLineStats(ctx context.Context, label, startDate, endDate string, dayStartHour int) (LineStatsReport, error) {
+	// Validate inputs
+	if err := validateDateRange(startDate, endDate); err != nil {
+		return LineStatsReport{}, fmt.Errorf("invalid date range: %w", err)
+	}
+
+	// Move the range boundaries to the start of the service day
+	startDate, err := shiftToServiceDay(startDate, dayStartHour)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("invalid date range: %w", err)
+	}
+	endDate, err = shiftToServiceDay(endDate, dayStartHour)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("invalid date range: %w", err)
+	}
+
+	// Check if the line is known
+	if err := s.validateLineExists(ctx, label); err != nil {
+		return LineStatsReport{}, fmt.Errorf("line validation failed: %w", err)
+	}
+
+	report := LineStatsReport{Label: label}
+
+	// Get basic statistics
+	if err := s.getBasicStats(ctx, label, startDate, endDate, &report); err != nil {
+		return LineStatsReport{}, fmt.Errorf("failed to get basic stats: %w", err)
+	}
+
+	// Get monthly statistics
+	report.MonthlyStats, err = s.getMonthlyStats(ctx, label, startDate, endDate, dayStartHour)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("failed to get monthly stats: %w", err)
+	}
+
+	// Get hourly statistics
+	report.HourlyStats, err = s.getHourlyStats(ctx, label, startDate, endDate)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("failed to get hourly stats: %w", err)
+	}
+
+	// Get stations with the highest average delay
+	report.WorstStations, err = s.getWorstStations(ctx, label, startDate, endDate)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("failed to get worst stations: %w", err)
+	}
+
+	// Get delay distribution per direction
+	report.DirectionDistribution, err = s.getDirectionDistribution(ctx, label, startDate, endDate)
+	if err != nil {
+		return LineStatsReport{}, fmt.Errorf("failed to get direction distribution: %w", err)
+	}
+
+	return report, nil
+}
+
+// validateLineExists checks if a line is part of the network
+func (s *LineStatsService) validateLineExists(ctx context.Context, label string) error {
+	var stationCount uint64
+	query := `SELECT count() FROM mvg.lines WHERE label = ?`
+
+	err := s.conn.QueryRow(withQueryName(ctx, "line_station_count"), query, label).Scan(&stationCount)
+	if err != nil {
+		return fmt.Errorf("failed to check line existence: %w", err)
+	}
+
+	if stationCount == 0 {
+		return &NotFoundError{Param: "label", Value: label, Message: "unknown line " + label}
+	}
+
+	return nil
+}
+
+// getBasicStats retrieves overall statistics for a line
+func (s *LineStatsService) getBasicStats(ctx context.Context, label, startDate, endDate string, report *LineStatsReport) error {
+	query := `
+		SELECT
+			avg(delayInMinutes) as avgDelay,
+			count() as totalDepartures,
+			CASE
+				WHEN count() = 0 THEN 0.0
+				ELSE (100.0 * countIf(delayInMinutes <= ?)) / count()
+			END as punctualityPercentage
+		FROM mvg.responses_dedup
+		WHERE label = ?
+		AND plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+	`
+
+	err := s.conn.QueryRow(withQueryName(ctx, "line_basic_stats"), query, delayedThresholdMinutes, label, startDate, endDate).Scan(
+		&report.AvgDelay, &report.TotalDepartures, &report.PunctualityPercentage)
+	if err != nil {
+		return fmt.Errorf("basic stats query failed: %w", err)
+	}
+
+	// Handle NaN values that might still occur from avg() with no data
+	if report.TotalDepartures == 0 {
+		report.AvgDelay = 0.0
+		report.PunctualityPercentage = 0.0
+	}
+
+	return nil
+}
+
+// getMonthlyStats retrieves monthly statistics for a line.
+// Departures before dayStartHour are attributed to the previous day.
+func (s *LineStatsService) getMonthlyStats(ctx context.Context, label, startDate, endDate string, dayStartHour int) ([]LineMonthlyData, error) {
+	query := `
+		SELECT
+			formatDateTime(toStartOfMonth(plannedDepartureTime - toIntervalHour(?)), '%Y-%m') as month,
+			avg(delayInMinutes) as avgDelay,
+			count() as departures,
+			(100.0 * countIf(delayInMinutes <= ?)) / count() as punctualityPercentage
+		FROM mvg.responses_dedup
+		WHERE label = ?
+		AND plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		GROUP BY month
+		ORDER BY month
+	`
+
+	rows, err := s.conn.Query(withQueryName(ctx, "line_monthly_stats"), query, dayStartHour, delayedThresholdMinutes, label, startDate, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("monthly stats query failed: %w", err)
+	}
+	defer rows.Close()
+
+	monthlyStats := []LineMonthlyData{}
+	for rows.Next() {
+		var data LineMonthlyData
+		if err := rows.Scan(&data.Month, &data.AvgDelay, &data.Departures, &data.PunctualityPercentage); err != nil {
+			if err := skipRow(ctx, "line_monthly_stats", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		monthlyStats = append(monthlyStats, data)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating monthly stats: %w", err)
+	}
+
+	return monthlyStats, nil
+}
+
+// getHourlyStats retrieves hourly statistics for a line
+func (s *LineStatsService) getHourlyStats(ctx context.Context, label, startDate, endDate string) ([]LineHourlyData, error) {
+	query := `
+		SELECT
+			toHour(plannedDepartureTime) as hour,
+			avg(delayInMinutes) as avgDelay,
+			count() as departures,
+			(100.0 * countIf(delayInMinutes <= ?)) / count() as punctualityPercentage
+		FROM mvg.responses_dedup
+		WHERE label = ?
+		AND plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		GROUP BY hour
+		ORDER BY hour
+	`
+
+	rows, err := s.conn.Query(withQueryName(ctx, "line_hourly_stats"), query, delayedThresholdMinutes, label, startDate, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("hourly stats query failed: %w", err)
+	}
+	defer rows.Close()
+
+	hourlyStats := []LineHourlyData{}
+	for rows.Next() {
+		var data LineHourlyData
+		if err := rows.Scan(&data.Hour, &data.AvgDelay, &data.Departures, &data.PunctualityPercentage); err != nil {
+			if err := skipRow(ctx, "line_hourly_stats", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		hourlyStats = append(hourlyStats, data)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating hourly stats: %w", err)
+	}
+
+	return hourlyStats, nil
+}
+
+// getWorstStations retrieves the stations of a line with the highest average delay
+func (s *LineStatsService) getWorstStations(ctx context.Context, label, startDate, endDate string) ([]StationDelayData, error) {
+	query := `
+		SELECT
+			station,
+			avg(delayInMinutes) as avgDelay,
+			count() as departures,
+			(100.0 * countIf(delayInMinutes <= ?)) / count() as punctualityPercentage
+		FROM mvg.responses_dedup
+		WHERE label = ?
+		AND plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		GROUP BY station
+		ORDER BY avgDelay DESC
+		LIMIT ?
+	`
+
+	rows, err := s.conn.Query(withQueryName(ctx, "line_worst_stations"), query, delayedThresholdMinutes, label, startDate, endDate, worstStationsLimit)
+	if err != nil {
+		return nil, fmt.Errorf("worst stations query failed: %w", err)
+	}
+	defer rows.Close()
+
+	worstStations := []StationDelayData{}
+	for rows.Next() {
+		var data StationDelayData
+		if err := rows.Scan(&data.Station, &data.AvgDelay, &data.Departures, &data.PunctualityPercentage); err != nil {
+			if err := skipRow(ctx, "line_worst_stations", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data.Name = friendlyNames[data.Station]
+		worstStations = append(worstStations, data)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating worst stations: %w", err)
+	}
+
+	return worstStations, nil
+}
+
+// getDirectionDistribution retrieves the delay distribution for both directions
+// of a line. Departures are assigned to a direction by the stop order of
+// mvg.lines as in StreamDelayForLine, so that short workings count towards the
+// direction they travel in. The northbound direction comes first.
+func (s *LineStatsService) getDirectionDistribution(ctx context.Context, label, startDate, endDate string) ([]DirectionDelayData, error) {
+	northTerminus, southTerminus, err := s.getTermini(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketExpr, bucketArgs := delayBucketExpr(defaultDelayBucketEdges)
+	query := `
+		WITH
+			? AS filterLabel,
+			(SELECT min(stop) FROM mvg.lines WHERE label = filterLabel) AS firstStop,
+			(SELECT max(stop) FROM mvg.lines WHERE label = filterLabel) AS lastStop
+		SELECT
+			toUInt8(if(destStation.stop IS NOT NULL, thisStation.stop < destStation.stop, thisStation.stop = firstStop)) AS isSouth,
+			` + bucketExpr + ` as bucketIndex,
+			count() as count,
+			toFloat64(sum(delayInMinutes)) as totalDelay
+		FROM mvg.responses_dedup
+		INNER JOIN mvg.lines as thisStation ON (
+			responses_dedup.station = thisStation.station
+			AND responses_dedup.label = thisStation.label
+		)
+		LEFT JOIN mvg.lines as destStation ON (
+			responses_dedup.destination = destStation.name
+			AND responses_dedup.label = thisStation.label
+		)
+		WHERE responses_dedup.label = filterLabel
+		AND plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		AND (
+			destStation.stop IS NOT NULL
+			OR thisStation.stop = firstStop
+			OR thisStation.stop = lastStop
+		)
+		GROUP BY isSouth, bucketIndex
+		ORDER BY isSouth, bucketIndex
+	`
+
+	args := append([]interface{}{label}, bucketArgs...)
+	args = append(args, startDate, endDate)
+	rows, err := s.conn.Query(withQueryName(ctx, "line_direction_distribution"), query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("direction distribution query failed: %w", err)
+	}
+	defer rows.Close()
+
+	labels := delayBucketLabels(defaultDelayBucketEdges)
+	directions := []DirectionDelayData{
+		{Direction: northTerminus, Distribution: []DelayBucket{}},
+		{Direction: southTerminus, Southbound: true, Distribution: []DelayBucket{}},
+	}
+	var totalDelays [2]float64
+	for rows.Next() {
+		var isSouth uint8
+		var bucketIndex uint32
+		var count uint64
+		var totalDelay float64
+
+		if err := rows.Scan(&isSouth, &bucketIndex, &count, &totalDelay); err != nil {
+			if err := skipRow(ctx, "line_direction_distribution", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if int(bucketIndex) >= len(labels) || isSouth > 1 {
+			continue
+		}
+
+		direction := &directions[isSouth]
+		direction.Departures += count
+		direction.Distribution = append(direction.Distribution, DelayBucket{
+			Range: labels[bucketIndex],
+			Count: count,
+		})
+		totalDelays[isSouth] += totalDelay
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating direction distribution: %w", err)
+	}
+
+	for i := range directions {
+		if directions[i].Departures > 0 {
+			directions[i].AvgDelay = totalDelays[i] / float64(directions[i].Departures)
+		}
+	}
+
+	return directions, nil
+}
+
+// getTermini returns the names of the first and the last stop of a line
+func (s *LineStatsService) getTermini(ctx context.Context, label string) (string, string, error) {
+	query := `SELECT argMin(name, stop), argMax(name, stop) FROM mvg.lines WHERE label = ?`
+
+	var first, last string
+	if err := s.conn.QueryRow(withQueryName(ctx, "line_termini"), query, label).Scan(&first, &last); err != nil {
+		return "", "", fmt.Errorf("termini query failed: %w", err)
+	}
+	return first, last, nil
+}
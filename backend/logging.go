@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// Loggers of the subsystems, their levels are configured separately
+var (
+	serverLog     = newSubsystemLogger("server")
+	httpLog       = newSubsystemLogger("http")
+	sseLog        = newSubsystemLogger("sse")
+	redisLog      = newSubsystemLogger("redis")
+	clickhouseLog = newSubsystemLogger("clickhouse")
+	cacheLog      = newSubsystemLogger("cache")
+)
+
+// LogConfig configures the log output. The level of a subsystem defaults to
+// Level when empty.
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" help:"text or json"`
+
+	Server     string `yaml:"server" env:"LOG_LEVEL_SERVER" help:"level of startup and shutdown logs"`
+	HTTP       string `yaml:"http" env:"LOG_LEVEL_HTTP" help:"level of API handler logs"`
+	SSE        string `yaml:"sse" env:"LOG_LEVEL_SSE" help:"level of event stream connection logs"`
+	Redis      string `yaml:"redis" env:"LOG_LEVEL_REDIS" help:"level of Redis keyevent logs, debug logs every keyevent"`
+	ClickHouse string `yaml:"clickhouse" env:"LOG_LEVEL_CLICKHOUSE" help:"level of ClickHouse connection and query logs"`
+	Cache      string `yaml:"cache" env:"LOG_LEVEL_CACHE" help:"level of query cache logs"`
+}
+
+// levels returns the level of every subsystem
+func (c LogConfig) levels() (slog.Level, map[string]slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, nil, fmt.Errorf("log.level: %w", err)
+	}
+
+	levels := make(map[string]slog.Level)
+	for subsystem, value := range map[string]string{
+		"server":     c.Server,
+		"http":       c.HTTP,
+		"sse":        c.SSE,
+		"redis":      c.Redis,
+		"clickhouse": c.ClickHouse,
+		"cache":      c.Cache,
+	} {
+		if value == "" {
+			continue
+		}
+		var subsystemLevel slog.Level
+		if err := subsystemLevel.UnmarshalText([]byte(value)); err != nil {
+			return 0, nil, fmt.Errorf("log.%s: %w", subsystem, err)
+		}
+		levels[subsystem] = subsystemLevel
+	}
+	return level, levels, nil
+}
+
+// logState is the output and the levels shared by all loggers
+type logState struct {
+	output slog.Handler
+	level  slog.Level
+	levels map[string]slog.Level // by subsystem
+}
+
+var logging atomic.Pointer[logState]
+
+func init() {
+	logging.Store(&logState{output: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	slog.SetDefault(newSubsystemLogger(""))
+}
+
+// setupLogging directs all loggers to w with the levels and format of config
+func setupLogging(w io.Writer, config LogConfig) error {
+	level, levels, err := config.levels()
+	if err != nil {
+		return err
+	}
+
+	// Filtering happens in subsystemHandler, the output takes everything
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var output slog.Handler
+	switch config.Format {
+	case "text":
+		output = slog.NewTextHandler(w, options)
+	case "json":
+		output = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("log.format must be text or json, got %q", config.Format)
+	}
+
+	logging.Store(&logState{output: output, level: level, levels: levels})
+	return nil
+}
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// subsystemHandler drops records below the level of its subsystem and tags
+// the others with the subsystem and the request ID of their context. It
+// looks up the output when handling a record, so that loggers created before
+// setupLogging follow the configuration.
+type subsystemHandler struct {
+	subsystem string
+	wrap      func(slog.Handler) slog.Handler // attributes and groups added with With
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	state := logging.Load()
+	minLevel, ok := state.levels[h.subsystem]
+	if !ok {
+		minLevel = state.level
+	}
+	return level >= minLevel
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	if h.subsystem != "" {
+		record.AddAttrs(slog.String("subsystem", h.subsystem))
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	output := logging.Load().output
+	if h.wrap != nil {
+		output = h.wrap(output)
+	}
+	return output.Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(output slog.Handler) slog.Handler { return output.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(output slog.Handler) slog.Handler { return output.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(step func(slog.Handler) slog.Handler) slog.Handler {
+	wrap := step
+	if previous := h.wrap; previous != nil {
+		wrap = func(output slog.Handler) slog.Handler { return step(previous(output)) }
+	}
+	return &subsystemHandler{subsystem: h.subsystem, wrap: wrap}
+}
+
+// fatal logs an error that prevents the server from running and exits
+func fatal(msg string, args ...any) {
+	serverLog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs directs the loggers to a buffer for the duration of the test
+func captureLogs(t *testing.T, config LogConfig) *bytes.Buffer {
+	t.Helper()
+	original := logging.Load()
+	t.Cleanup(func() { logging.Store(original) })
+
+	var out bytes.Buffer
+	require.NoError(t, setupLogging(&out, config))
+	return &out
+}
+
+func decodeLogLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	out := captureLogs(t, LogConfig{Level: "warn", Format: "json", Redis: "debug"})
+
+	redisLog.Debug("received keyevent", "key", "departures_de:09162:1")
+	httpLog.Info("dropped")
+	httpLog.Warn("kept")
+
+	records := decodeLogLines(t, out)
+	require.Len(t, records, 2)
+	assert.Equal(t, "received keyevent", records[0]["msg"])
+	assert.Equal(t, "redis", records[0]["subsystem"])
+	assert.Equal(t, "DEBUG", records[0]["level"])
+	assert.Equal(t, "kept", records[1]["msg"])
+	assert.Equal(t, "http", records[1]["subsystem"])
+}
+
+func TestKeyeventsOnlyLoggedAtDebug(t *testing.T) {
+	out := captureLogs(t, LogConfig{Level: "info", Format: "text"})
+	redisLog.Debug("received keyevent")
+	redisLog.With("stations", 3).Info("backfilled station departures")
+
+	assert.NotContains(t, out.String(), "received keyevent")
+	assert.Contains(t, out.String(), `msg="backfilled station departures" stations=3 subsystem=redis`)
+}
+
+func TestLogsTaggedWithRequestID(t *testing.T) {
+	out := captureLogs(t, LogConfig{Level: "info", Format: "json"})
+
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeInternalError(w, r, "Error getting line delay", assert.AnError)
+	}))
+	req := httptest.NewRequest("GET", "/api/line_delay", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	sseLog.InfoContext(context.WithValue(context.Background(), requestIDKey{}, "req-43"), "client connected")
+
+	records := decodeLogLines(t, out)
+	require.Len(t, records, 2)
+	assert.Equal(t, "Error getting line delay", records[0]["msg"])
+	assert.Equal(t, assert.AnError.Error(), records[0]["error"])
+	assert.Equal(t, "req-42", records[0]["request_id"])
+	assert.Equal(t, "http", records[0]["subsystem"])
+	assert.Equal(t, "req-43", records[1]["request_id"])
+	assert.Equal(t, "sse", records[1]["subsystem"])
+}
+
+func TestLogConfigValidation(t *testing.T) {
+	_, _, err := LogConfig{Level: "info", Cache: "verbose"}.levels()
+	assert.ErrorContains(t, err, "log.cache")
+
+	cfg := defaultConfig()
+	cfg.Log.Level = "loud"
+	cfg.Log.Format = "xml"
+	err = cfg.validate()
+	assert.ErrorContains(t, err, "log.level")
+	assert.ErrorContains(t, err, `log.format must be text or json, got "xml"`)
+
+	assert.Error(t, setupLogging(&bytes.Buffer{}, LogConfig{Level: "info", Format: "xml"}))
+}
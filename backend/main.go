@@ -1,20 +1,25 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
 	"context"
 	"embed"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,7 +31,8 @@ const redisStreamName = "mvg-events"
 //go:embed build
 var staticFiles embed.FS
 
-var clickhouseService *ClickHouseService
+// clickhouseService is nil until the background connector reached ClickHouse
+var clickhouseService atomic.Pointer[ClickHouseService]
 
 type Departure struct {
 	PlannedDepartureTime  int      `json:"plannedDepartureTime"`
@@ -40,83 +46,274 @@ type Departure struct {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// SIGTERM is what docker stop sends
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	eb := &EventBroadcaster{
-		mu:      new(sync.Mutex),
-		writers: make(map[string]http.ResponseWriter),
-		redisClient: redis.NewClient(&redis.Options{
-			Addr: fmt.Sprintf("%s:%s", getEnv("REDIS_HOST", "127.0.0.1"), getEnv("REDIS_PORT", "6379")),
-		}),
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	go eb.redisEventProcessor(ctx)
-
-	// Initialize ClickHouse service (will be nil if connection fails)
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Warning: ClickHouse connection failed: %v", r)
-			log.Printf("Running in static-only mode")
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if printConfig {
+		if err := writeConfig(os.Stdout, cfg); err != nil {
+			fatal("printing configuration failed", "error", err)
 		}
+		return
+	}
+	if err := setupLogging(os.Stderr, cfg.Log); err != nil {
+		fatal("invalid log configuration", "error", err)
+	}
+
+	redisClient, err := newRedisClient(cfg.Redis)
+	if err != nil {
+		fatal("invalid Redis configuration", "error", err)
+	}
+	if cfg.Redis.Mode == "cluster" {
+		redisLog.Warn("in cluster mode only the keyevents of a single node reach the event stream")
+	}
+
+	eb := newEventBroadcaster(redisClient, cfg.Redis)
+	processorCtx, stopProcessor := context.WithCancel(context.Background())
+	processorDone := make(chan struct{})
+	go func() {
+		defer close(processorDone)
+		eb.redisEventProcessor(processorCtx)
 	}()
-	clickhouseService = NewClickHouseService()
+
+	queryTimeouts = cfg.QueryTimeouts.resolve()
+
+	queryCache, err = newQueryCacheFromConfig(cfg.Cache, redisClient)
+	if err != nil {
+		fatal("invalid cache configuration", "error", err)
+	}
+
+	// Connect to ClickHouse in the background, the API answers 503 until then
+	clickhouseConnector.connect = func() (*ClickHouseService, error) {
+		return NewClickHouseService(cfg.ClickHouse)
+	}
+	go clickhouseConnector.run(ctx)
 
 	// Setup static file serving
 	setupStaticFileServer()
 
 	// API routes with /api prefix
-	http.HandleFunc("/api/line_delay", lineDelayHandler)
-	http.HandleFunc("/api/global_delay", globalDelayGHandler)
-	http.HandleFunc("/api/station_stats", stationStatsHandler)
-	http.HandleFunc("/api/events", eb.sseHandler)
-	http.HandleFunc("/api/health", healthHandler)
-	log.Println("Server started on 127.0.0.1:8080")
-	log.Fatal(http.ListenAndServe("127.0.0.1:8080", nil))
+	for path, handler := range apiRoutes(eb) {
+		http.HandleFunc(path, instrumentHandler(path, handler))
+	}
+	http.Handle("/metrics", metricsHandler())
 
-}
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           withRequestID(http.DefaultServeMux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// Shutdown waits for running handlers, event streams have to be ended
+	server.RegisterOnShutdown(eb.closeStreams)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serverLog.Info("server started", "address", cfg.Listen)
+		serveErr <- server.ListenAndServe()
+	}()
 
-func extractRequiredParams(r *http.Request, keys []string) (map[string]string, error) {
-	params := make(map[string]string, len(keys))
-	q := r.URL.Query()
-	for _, key := range keys {
-		value := q.Get(key)
-		if value == "" {
-			return nil, fmt.Errorf("missing parameter: %s", key)
+	select {
+	case err := <-serveErr:
+		fatal("server failed", "error", err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process right away
+
+	timeout := cfg.ShutdownTimeout
+	serverLog.Info("shutting down, waiting for running requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		serverLog.Warn("requests still running after the shutdown timeout", "timeout", timeout, "error", err)
+		server.Close()
+	}
+
+	stopProcessor()
+	<-processorDone
+
+	if service := clickhouseService.Load(); service != nil {
+		if err := service.Close(); err != nil {
+			clickhouseLog.Warn("closing connection failed", "error", err)
 		}
-		params[key] = value
 	}
-	return params, nil
+	if err := redisClient.Close(); err != nil {
+		redisLog.Warn("closing connection failed", "error", err)
+	}
+	serverLog.Info("server stopped")
+}
+
+// apiRoutes maps the paths of the API to their handlers. Every route must be
+// described in openapi.json.
+func apiRoutes(eb *EventBroadcaster) map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/line_delay":        lineDelayHandler,
+		"/api/global_delay":      globalDelayGHandler,
+		"/api/station_stats":     stationStatsHandler,
+		"/api/line_stats":        lineStatsHandler,
+		"/api/rankings":          rankingsHandler,
+		"/api/export/departures": exportDeparturesHandler,
+		"/api/events":            eb.sseHandler,
+		"/api/health":            healthHandler,
+		"/api/health/live":       livenessHandler,
+		"/api/health/ready":      eb.readinessHandler,
+		"/api/cache_stats":       cacheStatsHandler,
+		"/api/openapi.json":      openAPIHandler,
+	}
+}
+
+// delayParams are the parameters shared by the delay endpoints
+type delayParams struct {
+	Date      string `param:"date,required,date"`
+	Interval  int    `param:"interval,required" min:"1" max:"1440"` // bucket size in minutes
+	Threshold int    `param:"threshold,required" min:"0" max:"1440"` // delay in minutes that counts as late
+	Realtime  bool   `param:"realtime,required"`
+
+	ServiceDay bool   `param:"serviceDay"`
+	Extended   bool   `param:"extended"` // robust statistics (median, p90, p95, max, standard deviation)
+	Format     string `param:"format" enum:"json,ndjson,csv,parquet" default:"json"`
+	Stream     bool   `param:"stream"` // send the JSON array row by row, bypassing the result cache
+	Strict     bool   `param:"strict"` // fail instead of returning a partial result
+}
+
+// options returns the aggregation options requested by p
+func (p delayParams) options() DelayQueryOptions {
+	return DelayQueryOptions{
+		DayStartHour: startHourOfDay(p.ServiceDay),
+		Extended:     p.Extended,
+	}
+}
+
+// startHourOfDay returns the hour at which days begin. With serviceDay set,
+// days are cut at serviceDayStartHour instead of midnight so that night
+// departures count towards the operating day they belong to.
+func startHourOfDay(serviceDay bool) int {
+	if serviceDay {
+		return serviceDayStartHour
+	}
+	return 0
+}
+
+// defaultDateRange fills in a range ending today and starting at the given
+// offset when either date is missing
+func defaultDateRange(startDate, endDate *string, years, days int) {
+	if *startDate == "" || *endDate == "" {
+		now := time.Now()
+		*endDate = now.Format("2006-01-02")
+		*startDate = now.AddDate(-years, 0, -days).Format("2006-01-02")
+	}
+}
+
+// exposedHeaders are the response headers browsers let cross-origin scripts read
+const exposedHeaders = "X-Partial-Result, X-Result-Warning, X-Request-ID"
+
+// setCORSHeaders allows every origin to read the response and its headers
+func setCORSHeaders(h http.Header) {
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Expose-Headers", exposedHeaders)
 }
 
-func writeGzippedJSON(w http.ResponseWriter, v interface{}) error {
+// writeCompressedJSON writes v with validators and a caching policy derived
+// from dataEnd, the end of the time range the response covers. Conditional
+// requests matching the current ETag get a 304 Not Modified. The body is
+// compressed with the best coding the client accepts unless it is tiny.
+func writeCompressedJSON(w http.ResponseWriter, r *http.Request, v interface{}, dataEnd time.Time) error {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		writeInternalError(w, r, "Error encoding response", err)
+		return err
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Encoding", "gzip")
-	gz := gzip.NewWriter(w)
-	defer gz.Close()
-	return json.NewEncoder(gz).Encode(v)
+	setCORSHeaders(w.Header())
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	etag := responseETag(body.Bytes())
+	lastModified := setCacheHeaders(w.Header(), etag, dataEnd)
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	encoding := encodingIdentity
+	if body.Len() >= minCompressSize {
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+
+	encoded, err := compressBody(body.Bytes(), encoding)
+	if err != nil {
+		writeInternalError(w, r, "Error compressing response", err)
+		return err
+	}
+
+	if encoding != encodingIdentity {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	_, err = w.Write(encoded)
+	return err
 }
 
 func globalDelayGHandler(w http.ResponseWriter, r *http.Request) {
-	keys := []string{"date", "interval", "realtime", "threshold"}
-	params, err := extractRequiredParams(r, keys)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var params delayParams
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
 
-	if clickhouseService == nil {
-		http.Error(w, "Database service unavailable", http.StatusServiceUnavailable)
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
 		return
 	}
 
-	results, err := clickhouseService.LineQueries().GetGlobalDelay(params["date"], params["interval"], params["threshold"], params["realtime"])
+	opts := params.options()
+
+	ctx, cancel := queryContext(r, "global_delay")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	streamRows := func(fn func(LineDelayDay) error) error {
+		return service.LineQueries().StreamGlobalDelay(ctx, params.Date, params.Interval, params.Threshold, params.Realtime, opts, fn)
+	}
+	filename := exportFilename("global_delay", params.Date)
+
+	switch {
+	case params.Format == formatCSV || params.Format == formatParquet:
+		writeDelayExport(w, r, params.Format, filename, "Error exporting global delay", scans, streamRows)
+		return
+	case params.Format == formatNDJSON || params.Stream:
+		writeRowStream(w, r, params.Format, filename, "Error getting global delay", scans, streamRows)
+		return
+	}
+
+	key := cacheKey("global_delay",
+		"date", params.Date,
+		"interval", strconv.Itoa(params.Interval),
+		"threshold", strconv.Itoa(params.Threshold),
+		"realtime", strconv.FormatBool(params.Realtime),
+		"dayStartHour", strconv.Itoa(opts.DayStartHour),
+		"extended", strconv.FormatBool(opts.Extended),
+	)
+	dataEnd := rangeEnd(params.Date, opts.DayStartHour).AddDate(0, 0, 1)
+	ttl := queryCache.TTL(dataEnd)
+
+	results, err := cachedQuery(ctx, queryCache, key, ttl, func(ctx context.Context) ([]LineDelayDay, error) {
+		return service.LineQueries().GetGlobalDelay(ctx, params.Date, params.Interval, params.Threshold, params.Realtime, opts)
+	})
 	if err != nil {
-		http.Error(w, "Error getting global delay: "+err.Error(), http.StatusInternalServerError)
+		writeQueryError(w, r, "Error getting global delay", err)
 		return
 	}
-	if err := writeGzippedJSON(w, results); err != nil {
-		log.Printf("Error encoding JSON: %v", err)
+	setPartialResultHeaders(w.Header(), scans)
+	if err := writeCompressedJSON(w, r, results, dataEnd); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
 		return
 	}
 }
@@ -125,69 +322,321 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]CacheStats{}
+	if queryCache != nil {
+		stats = queryCache.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
+	}
+}
+
+// stationStatsParams are the parameters of the station statistics endpoint.
+// Without a date range the last year is used.
+type stationStatsParams struct {
+	Station    string      `param:"station,required"`
+	StartDate  string      `param:"startDate,date"`
+	EndDate    string      `param:"endDate,date"`
+	ServiceDay bool        `param:"serviceDay"`
+	Extended   bool        `param:"extended"`
+	Threshold  int         `param:"threshold" min:"0" max:"1440"`
+	Buckets    bucketEdges `param:"buckets"`
+	Format     string      `param:"format" enum:"json,csv,parquet" default:"json"`
+	Strict     bool        `param:"strict"`
+}
+
 func stationStatsHandler(w http.ResponseWriter, r *http.Request) {
-	if clickhouseService == nil {
-		http.Error(w, "Database service unavailable", http.StatusServiceUnavailable)
+	params := stationStatsParams{Threshold: delayedThresholdMinutes}
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
 		return
 	}
-	
-	keys := []string{"station"}
-	params, err := extractRequiredParams(r, keys)
+
+	defaultDateRange(&params.StartDate, &params.EndDate, 1, 0)
+
+	opts := DefaultStationStatsOptions()
+	opts.DayStartHour = startHourOfDay(params.ServiceDay)
+	opts.Extended = params.Extended
+	opts.Threshold = params.Threshold
+	if len(params.Buckets) > 0 {
+		opts.BucketEdges = params.Buckets
+	}
+
+	ctx, cancel := queryContext(r, "station_stats")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	key := cacheKey("station_stats",
+		"station", params.Station,
+		"startDate", params.StartDate,
+		"endDate", params.EndDate,
+		"dayStartHour", strconv.Itoa(opts.DayStartHour),
+		"threshold", strconv.Itoa(opts.Threshold),
+		"buckets", fmt.Sprint(opts.BucketEdges),
+		"extended", strconv.FormatBool(opts.Extended),
+	)
+	dataEnd := rangeEnd(params.EndDate, opts.DayStartHour)
+	ttl := queryCache.TTL(dataEnd)
+
+	results, err := cachedQuery(ctx, queryCache, key, ttl, func(ctx context.Context) (StationStats, error) {
+		return service.StationStats().GetStationStats(ctx, params.Station, params.StartDate, params.EndDate, opts)
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeQueryError(w, r, "Error getting station stats", err)
+		return
+	}
+	results.setScanReport(scans)
+	setPartialResultHeaders(w.Header(), scans)
+	if params.Format != formatJSON {
+		filename := exportFilename("station_stats", params.Station, params.StartDate, params.EndDate)
+		writeExport(w, r, params.Format, filename, "Error exporting station stats", stationStatsExportRows(results))
 		return
 	}
+	if err := writeCompressedJSON(w, r, results, dataEnd); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
+		return
+	}
+}
 
-	// Get optional date parameters, default to last year if not provided
-	q := r.URL.Query()
-	startDate := q.Get("startDate")
-	endDate := q.Get("endDate")
-	
-	// If no dates provided, default to last year
-	if startDate == "" || endDate == "" {
-		now := time.Now()
-		endDate = now.Format("2006-01-02")
-		startDate = now.AddDate(-1, 0, 0).Format("2006-01-02")
+// lineStatsParams are the parameters of the line statistics endpoint.
+// Without a date range the last year is used.
+type lineStatsParams struct {
+	Label      string `param:"label,required"`
+	StartDate  string `param:"startDate,date"`
+	EndDate    string `param:"endDate,date"`
+	ServiceDay bool   `param:"serviceDay"`
+	Strict     bool   `param:"strict"`
+}
+
+func lineStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var params lineStatsParams
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
+		return
 	}
 
-	results, err := clickhouseService.StationStats().GetStationStats(params["station"], startDate, endDate)
+	defaultDateRange(&params.StartDate, &params.EndDate, 1, 0)
+	dayStartHour := startHourOfDay(params.ServiceDay)
+
+	ctx, cancel := queryContext(r, "line_stats")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	key := cacheKey("line_stats",
+		"label", params.Label,
+		"startDate", params.StartDate,
+		"endDate", params.EndDate,
+		"dayStartHour", strconv.Itoa(dayStartHour),
+	)
+	dataEnd := rangeEnd(params.EndDate, dayStartHour)
+	ttl := queryCache.TTL(dataEnd)
+
+	results, err := cachedQuery(ctx, queryCache, key, ttl, func(ctx context.Context) (LineStatsReport, error) {
+		return service.LineStats().GetLineStats(ctx, params.Label, params.StartDate, params.EndDate, dayStartHour)
+	})
 	if err != nil {
-		http.Error(w, "Error getting station stats: "+err.Error(), http.StatusInternalServerError)
+		writeQueryError(w, r, "Error getting line stats", err)
 		return
 	}
-	if err := writeGzippedJSON(w, results); err != nil {
-		log.Printf("Error encoding JSON: %v", err)
+	results.setScanReport(scans)
+	setPartialResultHeaders(w.Header(), scans)
+	if err := writeCompressedJSON(w, r, results, dataEnd); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
 		return
 	}
 }
 
-func lineDelayHandler(w http.ResponseWriter, r *http.Request) {
-	keys := []string{"date", "south", "interval", "realtime", "label", "threshold"}
-	params, err := extractRequiredParams(r, keys)
+// rankingsParams are the parameters of the rankings endpoint. Without a date
+// range the last week is used.
+type rankingsParams struct {
+	StartDate     string `param:"startDate,date"`
+	EndDate       string `param:"endDate,date"`
+	Limit         int    `param:"limit" min:"1" max:"50" default:"10"`
+	MinDepartures uint64 `param:"minDepartures" default:"100"`
+	Strict        bool   `param:"strict"`
+}
+
+func rankingsHandler(w http.ResponseWriter, r *http.Request) {
+	var params rankingsParams
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
+		return
+	}
+
+	defaultDateRange(&params.StartDate, &params.EndDate, 0, 7)
+
+	ctx, cancel := queryContext(r, "rankings")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	key := cacheKey("rankings",
+		"startDate", params.StartDate,
+		"endDate", params.EndDate,
+		"limit", strconv.Itoa(params.Limit),
+		"minDepartures", strconv.FormatUint(params.MinDepartures, 10),
+	)
+	dataEnd := rangeEnd(params.EndDate, 0)
+	ttl := queryCache.TTL(dataEnd)
+
+	results, err := cachedQuery(ctx, queryCache, key, ttl, func(ctx context.Context) (Rankings, error) {
+		return service.StationStats().GetRankings(ctx, params.StartDate, params.EndDate, params.Limit, params.MinDepartures)
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeQueryError(w, r, "Error getting rankings", err)
+		return
+	}
+	results.setScanReport(scans)
+	setPartialResultHeaders(w.Header(), scans)
+	if err := writeCompressedJSON(w, r, results, dataEnd); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
+		return
+	}
+}
+
+// exportDeparturesParams are the parameters of the raw departures export
+type exportDeparturesParams struct {
+	StartDate string `param:"startDate,required,date"`
+	EndDate   string `param:"endDate,required,date"`
+	Station   string `param:"station"`
+	Label     string `param:"label"`
+	Limit     int    `param:"limit" min:"1" max:"1000000" default:"100000"`
+	Format    string `param:"format" enum:"csv,parquet,ndjson" default:"csv"`
+	Strict    bool   `param:"strict"`
+}
+
+func exportDeparturesHandler(w http.ResponseWriter, r *http.Request) {
+	var params exportDeparturesParams
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
 
-	if clickhouseService == nil {
-		http.Error(w, "Database service unavailable", http.StatusServiceUnavailable)
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
+		return
+	}
+
+	filter := DepartureFilter{
+		StartDate: params.StartDate,
+		EndDate:   params.EndDate,
+		Station:   params.Station,
+		Label:     params.Label,
+		Limit:     params.Limit,
+	}
+
+	ctx, cancel := queryContext(r, "export_departures")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	export := newExportWriter[DepartureRecord](w, r, params.Format, exportFilename("departures", filter.StartDate, filter.EndDate), scans)
+	err := service.Departures().StreamDepartures(ctx, filter, export.Write)
+	export.Finish("Error exporting departures", err)
+}
+
+// lineDelayParams are the parameters of the line delay endpoint
+type lineDelayParams struct {
+	delayParams
+	Label string `param:"label,required"`
+	South bool   `param:"south,required"` // direction of travel
+}
+
+func lineDelayHandler(w http.ResponseWriter, r *http.Request) {
+	var params lineDelayParams
+	if err := parseParams(r, &params); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
 
-	results, err := clickhouseService.LineQueries().GetDelayForLine(
-		params["date"],
-		params["interval"],
-		params["threshold"],
-		params["label"],
-		params["south"],
-		params["realtime"],
+	service := clickhouseService.Load()
+	if service == nil {
+		writeServiceUnavailable(w, r)
+		return
+	}
+
+	opts := params.options()
+
+	ctx, cancel := queryContext(r, "line_delay")
+	defer cancel()
+	ctx, scans := withScanReport(ctx, params.Strict)
+
+	streamRows := func(fn func(LineDelayDay) error) error {
+		return service.LineQueries().StreamDelayForLine(
+			ctx,
+			params.Date,
+			params.Interval,
+			params.Threshold,
+			params.Label,
+			params.South,
+			params.Realtime,
+			opts,
+			fn,
+		)
+	}
+	filename := exportFilename("line_delay", params.Label, params.Date)
+
+	switch {
+	case params.Format == formatCSV || params.Format == formatParquet:
+		writeDelayExport(w, r, params.Format, filename, "Error exporting line delay", scans, streamRows)
+		return
+	case params.Format == formatNDJSON || params.Stream:
+		writeRowStream(w, r, params.Format, filename, "Error getting line delay", scans, streamRows)
+		return
+	}
+
+	key := cacheKey("line_delay",
+		"date", params.Date,
+		"interval", strconv.Itoa(params.Interval),
+		"threshold", strconv.Itoa(params.Threshold),
+		"label", params.Label,
+		"south", strconv.FormatBool(params.South),
+		"realtime", strconv.FormatBool(params.Realtime),
+		"dayStartHour", strconv.Itoa(opts.DayStartHour),
+		"extended", strconv.FormatBool(opts.Extended),
 	)
+	dataEnd := rangeEnd(params.Date, opts.DayStartHour).AddDate(0, 0, 1)
+	ttl := queryCache.TTL(dataEnd)
+
+	results, err := cachedQuery(ctx, queryCache, key, ttl, func(ctx context.Context) ([]LineDelayDay, error) {
+		return service.LineQueries().GetDelayForLine(
+			ctx,
+			params.Date,
+			params.Interval,
+			params.Threshold,
+			params.Label,
+			params.South,
+			params.Realtime,
+			opts,
+		)
+	})
 	if err != nil {
-		http.Error(w, "Error getting line delay: "+err.Error(), http.StatusInternalServerError)
+		writeQueryError(w, r, "Error getting line delay", err)
 		return
 	}
-	if err := writeGzippedJSON(w, results); err != nil {
-		log.Printf("Error encoding JSON: %v", err)
+	setPartialResultHeaders(w.Header(), scans)
+	if err := writeCompressedJSON(w, r, results, dataEnd); err != nil {
+		httpLog.WarnContext(r.Context(), "encoding JSON failed", "error", err)
 		return
 	}
 }
@@ -206,65 +655,37 @@ type EventBroadcaster struct {
 	mu          *sync.Mutex
 	writers     map[string]http.ResponseWriter
 	redisClient RedisClientInterface
-}
-
-func (eb *EventBroadcaster) redisEventProcessor(ctx context.Context) {
-	sub := eb.redisClient.PSubscribe(ctx, "__keyevent*__:set")
-	defer sub.Close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-sub.Channel():
-			log.Printf("received redis keyevent %v\n", msg)
-			stationID := strings.Split(msg.Payload, "_")[1]
-			value, err := eb.redisClient.Get(ctx, msg.Payload).Result()
-			if err != nil {
-				log.Printf("failed to fetch redis key: %s\n", err)
-				continue
-			}
-
-			var departures []Departure
-			if err := json.Unmarshal([]byte(value), &departures); err != nil {
-				log.Printf("failed to unmarshal departures: %s\n", err)
-				continue
-			}
+	lastEvent   atomic.Int64 // unix nanoseconds of the last published departure update
 
-			departures = filterAndDedup(departures)
-			data := struct {
-				Station      string      `json:"station"`
-				FriendlyName string      `json:"friendlyName"`
-				Coordinates  Coordinates `json:"coordinates"`
-				Departures   []Departure `json:"departures"`
-			}{
-				Station:      stationID,
-				FriendlyName: friendlyNames[stationID],
-				Coordinates:  coordinates[stationID],
-				Departures:   departures,
-			}
+	shutdown  chan struct{} // closed when the server shuts down
+	closeOnce sync.Once
 
-			raw, err := json.Marshal(data)
-			if err != nil {
-				log.Printf("error marshal json (Call markus): %q\n", err)
-				return
-			}
-
-			err = eb.redisClient.XAdd(ctx, &redis.XAddArgs{
-				Stream: redisStreamName,
-				Values: map[string]string{"json": string(raw)},
-				ID:     "*",
-				MaxLen: 200,
-			}).Err()
+	// Keyevent subscription, see redisEventProcessor
+	config     RedisConfig
+	subscribe  func(ctx context.Context, pattern string) PubSubInterface // redisClient.PSubscribe if nil
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
 
-			if err != nil {
-				log.Printf("error sending to redis: %q", err)
-				continue
-			}
-		}
+func newEventBroadcaster(redisClient RedisClientInterface, config RedisConfig) *EventBroadcaster {
+	return &EventBroadcaster{
+		mu:          new(sync.Mutex),
+		writers:     make(map[string]http.ResponseWriter),
+		redisClient: redisClient,
+		shutdown:    make(chan struct{}),
+		config:      config,
+		minBackoff:  redisMinBackoff,
+		maxBackoff:  redisMaxBackoff,
 	}
 }
 
+// closeStreams asks every connected event stream to end
+func (eb *EventBroadcaster) closeStreams() {
+	eb.closeOnce.Do(func() {
+		close(eb.shutdown)
+	})
+}
+
 func (eb *EventBroadcaster) sseHandler(w http.ResponseWriter, r *http.Request) {
 	// Set http headers required for SSE
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -272,17 +693,28 @@ func (eb *EventBroadcaster) sseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 
 	// You may need this locally for CORS requests
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	setCORSHeaders(w.Header())
 
 	groupId := uuid.New().String()
 	err := eb.redisClient.XGroupCreate(r.Context(), redisStreamName, groupId, "0").Err()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500"))
+		writeInternalError(w, r, "Error subscribing to events", err)
 		return
 	}
-	log.Printf("added a new connection\n")
+	sseLog.InfoContext(r.Context(), "client connected", "group", groupId)
+	sseClients.Inc()
+	defer sseClients.Dec()
 	for {
+		select {
+		case <-eb.shutdown:
+			// Tell clients to reconnect to the next instance after a pause
+			fmt.Fprint(w, "event: close\nretry: 5000\ndata: shutdown\n\n")
+			w.(http.Flusher).Flush()
+			sseLog.InfoContext(r.Context(), "client disconnected for shutdown", "group", groupId)
+			return
+		default:
+		}
+
 		res, err := eb.redisClient.XReadGroup(r.Context(), &redis.XReadGroupArgs{
 			Streams:  []string{redisStreamName, ">"},
 			Group:    groupId,
@@ -294,12 +726,12 @@ func (eb *EventBroadcaster) sseHandler(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
-				log.Printf("removed connection\n")
+				sseLog.InfoContext(r.Context(), "client disconnected", "group", groupId)
 				return
 			}
 
 			if !errors.Is(err, redis.Nil) {
-				log.Printf("error reading redis stream: %q\n", err)
+				sseLog.WarnContext(r.Context(), "reading the event stream failed", "error", err)
 			}
 			continue
 		}
@@ -309,7 +741,7 @@ func (eb *EventBroadcaster) sseHandler(w http.ResponseWriter, r *http.Request) {
 
 			_, err = fmt.Fprintf(w, "data: %s\n\n", payload)
 			if err != nil {
-				log.Printf("failed to write json to response-writer: %s\n", err)
+				sseLog.WarnContext(r.Context(), "writing an event failed", "error", err)
 			}
 			w.(http.Flusher).Flush()
 		}
@@ -321,7 +753,7 @@ func setupStaticFileServer() {
 	// Get the embedded filesystem without the leading path
 	frontendFS, err := fs.Sub(staticFiles, "build/client")
 	if err != nil {
-		log.Printf("Warning: Could not setup static files: %v", err)
+		serverLog.Warn("could not set up static files", "error", err)
 		return
 	}
 
@@ -329,7 +761,7 @@ func setupStaticFileServer() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Skip API routes
 		if strings.HasPrefix(r.URL.Path, "/api/") {
-			http.NotFound(w, r)
+			writeNotFound(w, r)
 			return
 		}
 
@@ -339,30 +771,30 @@ func setupStaticFileServer() {
 		if path == "" {
 			path = "index.html"
 		}
-		
+
 		// Check if file exists in embedded filesystem
 		if fileInfo, err := fs.Stat(frontendFS, path); err == nil && !fileInfo.IsDir() {
 			// File exists, serve it
 			file, err := frontendFS.Open(path)
 			if err != nil {
-				log.Printf("Error opening file %s: %v", path, err)
+				httpLog.ErrorContext(r.Context(), "opening static file failed", "path", path, "error", err)
 				http.NotFound(w, r)
 				return
 			}
 			defer file.Close()
-			
+
 			// Set caching headers for assets
 			if strings.HasPrefix(path, "assets/") {
 				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 			} else {
 				w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
 			}
-			
+
 			// Use http.ServeContent which handles MIME type detection automatically
 			http.ServeContent(w, r, path, time.Time{}, file.(io.ReadSeeker))
 			return
 		}
-		
+
 		// For SPA routing, serve index.html for non-existent routes
 		// (except for obvious asset files that should return 404)
 		ext := filepath.Ext(path)
@@ -375,7 +807,7 @@ func setupStaticFileServer() {
 				return
 			}
 		}
-		
+
 		// For other file extensions, return 404
 		http.NotFound(w, r)
 	})
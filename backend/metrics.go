@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics served at /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mvg_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mvg_http_request_duration_seconds",
+		Help:    "Time until the response to an HTTP request was complete, by route, method and status code.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+
+	clickhouseQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mvg_clickhouse_query_duration_seconds",
+		Help:    "Time from sending a ClickHouse query until its last row was read, by query name and outcome.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"query", "outcome"})
+
+	sseConnectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mvg_sse_connection_duration_seconds",
+		Help:    "Time clients stayed connected to the live departure event stream.",
+		Buckets: []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400, 43200},
+	})
+
+	sseClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mvg_sse_clients",
+		Help: "Clients connected to the live departure event stream.",
+	})
+
+	redisKeyevents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mvg_redis_keyevents_total",
+		Help: "Redis keyspace notifications received for updated departure keys.",
+	})
+
+	redisResubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mvg_redis_resubscriptions_total",
+		Help: "Times the Redis keyevent subscription was lost and set up again.",
+	})
+
+	departuresPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mvg_departures_published_total",
+		Help: "Departure updates published to the event stream.",
+	})
+
+	departuresDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mvg_departures_dropped_total",
+		Help: "Departure updates that could not be published, by reason.",
+	}, []string{"reason"})
+
+	jsonDecodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mvg_json_decode_failures_total",
+		Help: "JSON documents that could not be decoded, by source.",
+	}, []string{"source"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		clickhouseQueryDuration,
+		sseConnectionDuration,
+		sseClients,
+		redisKeyevents,
+		redisResubscriptions,
+		departuresPublished,
+		departuresDropped,
+		jsonDecodeFailures,
+		cacheCollector{},
+	)
+}
+
+// metricsHandler serves the metrics in the Prometheus exposition format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// streamingRoutes keep their connection open for as long as the client
+// listens. Their duration goes to mvg_sse_connection_duration_seconds, so that
+// it does not distort the request latencies.
+var streamingRoutes = map[string]bool{
+	"/api/events": true,
+}
+
+// instrumentHandler counts the requests to route, measures their duration
+// and logs them at debug level. route is the registered pattern, never the raw URL path, so
+// that the number of label values stays bounded.
+func instrumentHandler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			status := strconv.Itoa(recorder.status())
+			duration := time.Since(start)
+			httpRequests.WithLabelValues(route, r.Method, status).Inc()
+			if streamingRoutes[route] {
+				sseConnectionDuration.Observe(duration.Seconds())
+			} else {
+				httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(duration.Seconds())
+			}
+			httpLog.DebugContext(r.Context(), "request", "method", r.Method, "path", r.URL.Path, "status", recorder.status(), "duration", duration)
+		}()
+		next(recorder, r)
+	}
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps the event stream working, which asserts http.Flusher
+func (s *statusRecorder) Flush() {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// status returns the status code sent to the client. Handlers that write
+// nothing, e.g. because the client went away, count as 200 like net/http
+// would send them.
+func (s *statusRecorder) status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
+
+type queryNameKey struct{}
+
+// withQueryName names the ClickHouse query run with ctx in the query metrics
+func withQueryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, queryNameKey{}, name)
+}
+
+func queryNameFrom(ctx context.Context) string {
+	if name, ok := ctx.Value(queryNameKey{}).(string); ok {
+		return name
+	}
+	return "unnamed"
+}
+
+// queryOutcome classifies the result of a query for the metrics
+func queryOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case isQueryTimeout(err):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+// metricsConn measures the duration of the queries run on a ClickHouse
+// connection. Queries are named with withQueryName.
+type metricsConn struct {
+	driver.Conn
+}
+
+// instrumentConn wraps conn to record query metrics
+func instrumentConn(conn driver.Conn) driver.Conn {
+	return &metricsConn{Conn: conn}
+}
+
+func (c *metricsConn) Query(ctx context.Context, query string, args ...interface{}) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.Conn.Query(ctx, query, args...)
+	if err != nil {
+		observeQuery(ctx, start, err)
+		return nil, err
+	}
+	// The query is only complete once all rows were read
+	return &metricsRows{Rows: rows, ctx: ctx, start: start}, nil
+}
+
+func (c *metricsConn) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	start := time.Now()
+	return &metricsRow{Row: c.Conn.QueryRow(ctx, query, args...), ctx: ctx, start: start}
+}
+
+func (c *metricsConn) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := c.Conn.Select(ctx, dest, query, args...)
+	observeQuery(ctx, start, err)
+	return err
+}
+
+func observeQuery(ctx context.Context, start time.Time, err error) {
+	clickhouseQueryDuration.WithLabelValues(queryNameFrom(ctx), queryOutcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// metricsRows records the query when the rows are closed
+type metricsRows struct {
+	driver.Rows
+	ctx   context.Context
+	start time.Time
+	once  sync.Once
+}
+
+func (r *metricsRows) Close() error {
+	err := r.Rows.Close()
+	r.once.Do(func() {
+		observeQuery(r.ctx, r.start, r.Rows.Err())
+	})
+	return err
+}
+
+// metricsRow records the query when the row is scanned
+type metricsRow struct {
+	driver.Row
+	ctx   context.Context
+	start time.Time
+}
+
+func (r *metricsRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	observeQuery(r.ctx, r.start, err)
+	return err
+}
+
+func (r *metricsRow) ScanStruct(dest interface{}) error {
+	err := r.Row.ScanStruct(dest)
+	observeQuery(r.ctx, r.start, err)
+	return err
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("mvg_query_cache_hits_total",
+		"Query results served from the cache, by endpoint.", []string{"endpoint"}, nil)
+	cacheMissesDesc = prometheus.NewDesc("mvg_query_cache_misses_total",
+		"Query results that had to be computed, by endpoint.", []string{"endpoint"}, nil)
+)
+
+// cacheCollector exposes the counters of queryCache
+type cacheCollector struct{}
+
+func (cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+}
+
+func (cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	if queryCache == nil {
+		return
+	}
+	for endpoint, stats := range queryCache.Stats() {
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), endpoint)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), endpoint)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := instrumentHandler("/api/test/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			writeValidationError(w, r, invalidParamError("fail", "is set"))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	for _, target := range []string{"/api/test/metrics", "/api/test/metrics", "/api/test/metrics?fail=1"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(httpRequests.WithLabelValues("/api/test/metrics", "GET", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("/api/test/metrics", "GET", "400")))
+}
+
+func TestInstrumentHandlerKeepsFlusher(t *testing.T) {
+	var flushed bool
+	handler := instrumentHandler("/api/test/flush", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if assert.True(t, ok, "event stream needs http.Flusher") {
+			flusher.Flush()
+			flushed = true
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/test/flush", nil))
+
+	assert.True(t, flushed)
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("/api/test/flush", "GET", "200")))
+}
+
+func TestMetricsConnObservesQueries(t *testing.T) {
+	mockConn := &MockDriver{}
+	mockRows := &MockRows{data: [][]interface{}{{"de:09162:1"}}}
+	mockConn.On("Query", mock.Anything, "SELECT ok").Return(mockRows, nil)
+	mockConn.On("Query", mock.Anything, "SELECT broken").Return((*MockRows)(nil), errors.New("syntax error"))
+	mockConn.On("Query", mock.Anything, "SELECT slow").Return((*MockRows)(nil), context.DeadlineExceeded)
+	mockRows.On("Err").Return(nil)
+	mockRows.On("Close").Return(nil)
+
+	conn := instrumentConn(mockConn)
+
+	rows, err := conn.Query(withQueryName(context.Background(), "test_ok"), "SELECT ok")
+	assert.NoError(t, err)
+	for rows.Next() {
+	}
+	// The query is observed once, no matter how often the rows are closed
+	assert.NoError(t, rows.Close())
+	assert.NoError(t, rows.Close())
+
+	_, err = conn.Query(withQueryName(context.Background(), "test_broken"), "SELECT broken")
+	assert.Error(t, err)
+
+	_, err = conn.Query(context.Background(), "SELECT slow")
+	assert.Error(t, err)
+
+	assert.Equal(t, uint64(1), queryObservations(t, "test_ok", "ok"))
+	assert.Equal(t, uint64(1), queryObservations(t, "test_broken", "error"))
+	assert.Equal(t, uint64(1), queryObservations(t, "unnamed", "timeout"))
+	mockConn.AssertExpectations(t)
+}
+
+// queryObservations returns how many queries were recorded with the labels
+func queryObservations(t *testing.T, query, outcome string) uint64 {
+	t.Helper()
+	count, _ := queryHistogram(t, query, outcome)
+	return count
+}
+
+// queryHistogram returns the number and the total duration in seconds of the
+// queries recorded with the labels
+func queryHistogram(t *testing.T, query, outcome string) (uint64, float64) {
+	t.Helper()
+
+	families, err := metricsRegistry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "mvg_clickhouse_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["query"] == query && labels["outcome"] == outcome {
+				return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0, 0
+}
+
+func TestMetricsConnObservesQueryRowLatency(t *testing.T) {
+	mockConn := &MockDriver{}
+	// The driver sends the query and waits for the response in QueryRow
+	mockConn.On("QueryRow", mock.Anything, "SELECT slow_row").Return(func(context.Context) driver.Row {
+		time.Sleep(20 * time.Millisecond)
+		return &MockRow{data: []interface{}{uint64(1)}}
+	})
+
+	conn := instrumentConn(mockConn)
+
+	var count uint64
+	assert.NoError(t, conn.QueryRow(withQueryName(context.Background(), "test_slow_row"), "SELECT slow_row").Scan(&count))
+
+	observations, seconds := queryHistogram(t, "test_slow_row", "ok")
+	assert.Equal(t, uint64(1), observations)
+	assert.GreaterOrEqual(t, seconds, 0.02)
+	mockConn.AssertExpectations(t)
+}
+
+func TestInstrumentHandlerStreamingRoute(t *testing.T) {
+	before := testutil.CollectAndCount(httpRequestDuration)
+	connections := sseConnections(t)
+	handler := instrumentHandler("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: []\n\n"))
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/events", nil))
+
+	// Long-lived connections are kept out of the request latencies
+	assert.Equal(t, before, testutil.CollectAndCount(httpRequestDuration))
+	assert.Equal(t, connections+1, sseConnections(t))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("/api/events", "GET", "200")))
+}
+
+// sseConnections returns how many event stream connections were recorded
+func sseConnections(t *testing.T) uint64 {
+	t.Helper()
+
+	families, err := metricsRegistry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "mvg_sse_connection_duration_seconds" {
+			return family.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestMetricsHandler(t *testing.T) {
+	originalCache := queryCache
+	defer func() { queryCache = originalCache }()
+
+	queryCache = NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+	compute := func(context.Context) (LineStats, error) { return LineStats{Departures: 1}, nil }
+	for i := 0; i < 2; i++ {
+		_, err := cachedQuery(context.Background(), queryCache, "line_stats?label=U1", time.Minute, compute)
+		assert.NoError(t, err)
+	}
+	redisKeyevents.Inc()
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `mvg_query_cache_hits_total{endpoint="line_stats"} 1`)
+	assert.Contains(t, body, `mvg_query_cache_misses_total{endpoint="line_stats"} 1`)
+	assert.Contains(t, body, "mvg_redis_keyevents_total")
+	assert.Contains(t, body, "mvg_sse_clients 0")
+	assert.Contains(t, body, "go_goroutines")
+}
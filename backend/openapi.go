@@ -0,0 +1,44 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// openAPISpec describes the HTTP API. openapi_test.go checks it against the
+// routes, parameter structs and response types, so update it together with them.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+var openAPIETag = responseETag(openAPISpec)
+
+// openAPIHandler serves the OpenAPI document. It only changes with a
+// deployment, so clients revalidate with the ETag after a short while.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	setCORSHeaders(w.Header())
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", formatCacheControl(maxAgeCurrent))
+	w.Header().Set("ETag", openAPIETag)
+	if notModified(r, openAPIETag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	body, err := compressBody(openAPISpec, encoding)
+	if err != nil {
+		writeInternalError(w, r, "Error compressing response", err)
+		return
+	}
+	if encoding != encodingIdentity {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if _, err := w.Write(body); err != nil {
+		httpLog.WarnContext(r.Context(), "writing OpenAPI document failed", "error", err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The subset of OpenAPI 3 used by openapi.json
+type openAPIDoc struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+		Responses  map[string]openAPIResponse  `json:"responses"`
+		Schemas    map[string]*openAPISchema   `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Parameters []openAPIParameter         `json:"parameters"`
+	Responses  map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `json:"$ref"`
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *openAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref"`
+	Type                 string                    `json:"type"`
+	Format               string                    `json:"format"`
+	Enum                 []string                  `json:"enum"`
+	Minimum              *int64                    `json:"minimum"`
+	Maximum              *int64                    `json:"maximum"`
+	Default              interface{}               `json:"default"`
+	Items                *openAPISchema            `json:"items"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties"`
+	Properties           map[string]*openAPISchema `json:"properties"`
+	Required             []string                  `json:"required"`
+}
+
+func loadOpenAPIDoc(t *testing.T) *openAPIDoc {
+	var doc openAPIDoc
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+	require.True(t, strings.HasPrefix(doc.OpenAPI, "3."))
+	return &doc
+}
+
+// parameter resolves a parameter reference
+func (d *openAPIDoc) parameter(t *testing.T, p openAPIParameter) openAPIParameter {
+	if p.Ref == "" {
+		return p
+	}
+	resolved, ok := d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	require.True(t, ok, "unknown parameter %s", p.Ref)
+	return resolved
+}
+
+// response resolves a response reference
+func (d *openAPIDoc) response(t *testing.T, r openAPIResponse) openAPIResponse {
+	if r.Ref == "" {
+		return r
+	}
+	resolved, ok := d.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	require.True(t, ok, "unknown response %s", r.Ref)
+	return resolved
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+
+	var routes, documented []string
+	for path := range apiRoutes(&EventBroadcaster{}) {
+		routes = append(routes, path)
+	}
+	for path, operations := range doc.Paths {
+		documented = append(documented, path)
+		assert.Contains(t, operations, "get", path)
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+
+	assert.Equal(t, routes, documented)
+}
+
+// openAPIEndpointParams are the parameter structs of the endpoints, nil for
+// endpoints without parameters
+var openAPIEndpointParams = map[string]interface{}{
+	"/api/line_delay":        lineDelayParams{},
+	"/api/global_delay":      delayParams{},
+	"/api/station_stats":     stationStatsParams{},
+	"/api/line_stats":        lineStatsParams{},
+	"/api/rankings":          rankingsParams{},
+	"/api/export/departures": exportDeparturesParams{},
+	"/api/events":            nil,
+	"/api/health":            nil,
+	"/api/health/live":       nil,
+	"/api/health/ready":      nil,
+	"/api/cache_stats":       nil,
+	"/api/openapi.json":      nil,
+}
+
+func TestOpenAPIParameters(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+
+	for path, operations := range doc.Paths {
+		t.Run(path, func(t *testing.T) {
+			params, ok := openAPIEndpointParams[path]
+			require.True(t, ok, "add the parameter struct of %s to openAPIEndpointParams", path)
+
+			fields := map[string]reflect.StructField{}
+			if params != nil {
+				collectParamFields(reflect.TypeOf(params), fields)
+			}
+
+			documented := map[string]bool{}
+			for _, p := range operations["get"].Parameters {
+				p = doc.parameter(t, p)
+				documented[p.Name] = true
+				assert.Equal(t, "query", p.In, p.Name)
+
+				field, ok := fields[p.Name]
+				if !assert.True(t, ok, "%s is documented but not parsed", p.Name) {
+					continue
+				}
+				checkParamSchema(t, p, field)
+			}
+
+			for name := range fields {
+				assert.True(t, documented[name], "%s is parsed but not documented", name)
+			}
+		})
+	}
+}
+
+func collectParamFields(typ reflect.Type, fields map[string]reflect.StructField) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			collectParamFields(field.Type, fields)
+			continue
+		}
+		if tag, ok := field.Tag.Lookup("param"); ok {
+			name, _, _ := strings.Cut(tag, ",")
+			fields[name] = field
+		}
+	}
+}
+
+// checkParamSchema compares a documented parameter to the tags of the field it is parsed into
+func checkParamSchema(t *testing.T, p openAPIParameter, field reflect.StructField) {
+	_, options, _ := strings.Cut(field.Tag.Get("param"), ",")
+	assert.Equal(t, hasParamOption(options, "required"), p.Required, "%s required", p.Name)
+	require.NotNil(t, p.Schema, p.Name)
+
+	expectedType := map[reflect.Kind]string{
+		reflect.String: "string",
+		reflect.Int:    "integer",
+		reflect.Uint64: "integer",
+		reflect.Bool:   "boolean",
+	}[field.Type.Kind()]
+	if reflect.PointerTo(field.Type).Implements(reflect.TypeFor[encoding.TextUnmarshaler]()) {
+		expectedType = "string"
+	}
+	assert.Equal(t, expectedType, p.Schema.Type, "%s type", p.Name)
+
+	expectedFormat := ""
+	if hasParamOption(options, "date") {
+		expectedFormat = "date"
+	}
+	assert.Equal(t, expectedFormat, p.Schema.Format, "%s format", p.Name)
+
+	var expectedEnum []string
+	if enum, ok := field.Tag.Lookup("enum"); ok {
+		expectedEnum = strings.Split(enum, ",")
+	}
+	assert.Equal(t, expectedEnum, p.Schema.Enum, "%s enum", p.Name)
+
+	for key, documented := range map[string]*int64{"min": p.Schema.Minimum, "max": p.Schema.Maximum} {
+		bound, ok := paramBound(field, key)
+		if !ok {
+			assert.Nil(t, documented, "%s %s", p.Name, key)
+		} else if assert.NotNil(t, documented, "%s %s", p.Name, key) {
+			assert.Equal(t, bound, *documented, "%s %s", p.Name, key)
+		}
+	}
+
+	def, ok := field.Tag.Lookup("default")
+	if !ok {
+		assert.Nil(t, p.Schema.Default, "%s default", p.Name)
+	} else {
+		assert.Equal(t, def, fmt.Sprint(p.Schema.Default), "%s default", p.Name)
+	}
+}
+
+// openAPIResponseTypes are the Go types of the JSON bodies of successful responses
+var openAPIResponseTypes = map[string]map[string]reflect.Type{
+	"/api/line_delay": {
+		"application/json":     reflect.TypeOf([]LineDelayDay{}),
+		"application/x-ndjson": reflect.TypeOf(LineDelayDay{}),
+	},
+	"/api/global_delay": {
+		"application/json":     reflect.TypeOf([]LineDelayDay{}),
+		"application/x-ndjson": reflect.TypeOf(LineDelayDay{}),
+	},
+	"/api/station_stats":     {"application/json": reflect.TypeOf(StationStats{})},
+	"/api/line_stats":        {"application/json": reflect.TypeOf(LineStatsReport{})},
+	"/api/rankings":          {"application/json": reflect.TypeOf(Rankings{})},
+	"/api/export/departures": {"application/x-ndjson": reflect.TypeOf(DepartureRecord{})},
+	"/api/health/live":       {"application/json": reflect.TypeOf(HealthReport{})},
+	"/api/health/ready":      {"application/json": reflect.TypeOf(HealthReport{})},
+	"/api/cache_stats":       {"application/json": reflect.TypeOf(map[string]CacheStats{})},
+}
+
+// openAPIFailureTypes are the Go types of error responses that are not an APIError
+var openAPIFailureTypes = map[string]map[string]reflect.Type{
+	"/api/health/ready": {"503": reflect.TypeOf(HealthReport{})},
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+	checked := map[string]bool{}
+
+	for path, operations := range doc.Paths {
+		for status, response := range operations["get"].Responses {
+			response = doc.response(t, response)
+			for contentType, content := range response.Content {
+				if contentType != "application/json" && contentType != "application/x-ndjson" {
+					continue
+				}
+				if path == "/api/openapi.json" && status == "200" {
+					continue
+				}
+
+				var typ reflect.Type
+				if status == "200" {
+					typ = openAPIResponseTypes[path][contentType]
+				} else if failureType, ok := openAPIFailureTypes[path][status]; ok {
+					typ = failureType
+				} else {
+					typ = reflect.TypeOf(APIError{})
+				}
+				if !assert.NotNil(t, typ, "%s %s %s has no Go type", path, status, contentType) {
+					continue
+				}
+				checkSchema(t, doc, content.Schema, typ, fmt.Sprintf("%s %s", path, status), checked)
+			}
+		}
+	}
+
+	for name := range doc.Components.Schemas {
+		assert.True(t, checked[name], "schema %s is not used by any response", name)
+	}
+}
+
+// checkSchema compares a documented schema with the JSON encoding of typ.
+// Structs must be referenced by their type name, checked tracks the
+// component schemas that have been compared.
+func checkSchema(t *testing.T, doc *openAPIDoc, schema *openAPISchema, typ reflect.Type, at string, checked map[string]bool) {
+	if !assert.NotNil(t, schema, "%s: missing schema", at) {
+		return
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if typ == reflect.TypeOf(time.Time{}) {
+		assert.Equal(t, "string", schema.Type, at)
+		assert.Equal(t, "date-time", schema.Format, at)
+		return
+	}
+
+	if typ.Kind() == reflect.Struct {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		if !assert.Equal(t, typ.Name(), name, "%s: structs must reference the schema named after their type", at) {
+			return
+		}
+		component, ok := doc.Components.Schemas[name]
+		if !assert.True(t, ok, "%s: unknown schema %s", at, name) || checked[name] {
+			return
+		}
+		checked[name] = true
+		checkStructSchema(t, doc, component, typ, name, checked)
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		assert.Equal(t, "string", schema.Type, at)
+	case reflect.Bool:
+		assert.Equal(t, "boolean", schema.Type, at)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		assert.Equal(t, "integer", schema.Type, at)
+	case reflect.Float32, reflect.Float64:
+		assert.Equal(t, "number", schema.Type, at)
+	case reflect.Slice:
+		assert.Equal(t, "array", schema.Type, at)
+		checkSchema(t, doc, schema.Items, typ.Elem(), at+"[]", checked)
+	case reflect.Map:
+		assert.Equal(t, "object", schema.Type, at)
+		checkSchema(t, doc, schema.AdditionalProperties, typ.Elem(), at+"{}", checked)
+	default:
+		t.Errorf("%s: unsupported type %s", at, typ)
+	}
+}
+
+func checkStructSchema(t *testing.T, doc *openAPIDoc, schema *openAPISchema, typ reflect.Type, at string, checked map[string]bool) {
+	assert.Equal(t, "object", schema.Type, at)
+
+	fields := map[string]reflect.Type{}
+	var required []string
+	collectJSONFields(typ, fields, &required)
+
+	var properties []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(properties)
+	sort.Strings(names)
+	assert.Equal(t, names, properties, "%s: properties", at)
+	assert.ElementsMatch(t, required, schema.Required, "%s: required properties", at)
+
+	for name, fieldType := range fields {
+		if property, ok := schema.Properties[name]; ok {
+			checkSchema(t, doc, property, fieldType, at+"."+name, checked)
+		}
+	}
+}
+
+// collectJSONFields lists the JSON properties of a struct, properties
+// without omitempty are required
+func collectJSONFields(typ reflect.Type, fields map[string]reflect.Type, required *[]string) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			collectJSONFields(field.Type, fields, required)
+			continue
+		}
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+		if !hasParamOption(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func TestOpenAPIErrorCodes(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+
+	assert.ElementsMatch(t, []string{
+		errCodeMissingParameter,
+		errCodeInvalidParameter,
+		errCodeInvalidDate,
+		errCodeInvalidDateRange,
+		errCodeNotFound,
+		errCodeServiceUnavailable,
+		errCodeQueryTimeout,
+		errCodeScanFailed,
+		errCodeInternal,
+	}, doc.Components.Schemas["APIError"].Properties["code"].Enum)
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(openAPISpec), w.Body.String())
+
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	openAPIHandler(w, req)
+
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
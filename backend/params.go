@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseParams fills dst, a pointer to a struct, from the query string of r.
+// Every field to fill declares its parameter in a param tag, optionally
+// followed by the options required (the parameter must be sent and not be
+// empty) and date (the value must be a YYYY-MM-DD date):
+//
+//	Interval int    `param:"interval,required" min:"1" max:"1440"`
+//	Date     string `param:"date,required,date"`
+//	Format   string `param:"format" enum:"json,csv" default:"json"`
+//
+// Supported field types are string, int, uint64 and bool. Booleans accept
+// 0, 1, true and false, min and max bound numbers and enum lists the allowed
+// strings. Fields implementing encoding.TextUnmarshaler parse the value
+// themselves, their error is the reason the value is rejected. Absent
+// parameters take the default tag's value or, without one, keep what dst
+// already holds. Embedded structs are parsed recursively.
+//
+// All invalid parameters are reported together in a single *ValidationError.
+func parseParams(r *http.Request, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("parseParams: dst must be a pointer to a struct, got %T", dst))
+	}
+
+	var errs paramErrors
+	parseParamFields(r.URL.Query(), v.Elem(), &errs)
+	return errs.err()
+}
+
+func parseParamFields(q map[string][]string, v reflect.Value, errs *paramErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			parseParamFields(q, v.Field(i), errs)
+			continue
+		}
+
+		tag, ok := field.Tag.Lookup("param")
+		if !ok {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		required := hasParamOption(options, "required")
+
+		var value string
+		if values := q[name]; len(values) > 0 {
+			value = values[0]
+		}
+		if value == "" {
+			if required {
+				errs.missing(name)
+				continue
+			}
+			def, ok := field.Tag.Lookup("default")
+			if !ok {
+				continue
+			}
+			value = def
+		}
+
+		if reason := setParamField(v.Field(i), field, value, options); reason != "" {
+			errs.invalid(name, reason)
+		}
+	}
+}
+
+func hasParamOption(options, option string) bool {
+	return slices.Contains(strings.Split(options, ","), option)
+}
+
+// setParamField parses value into the field. It returns why the value was
+// rejected, or an empty string on success.
+func setParamField(fv reflect.Value, field reflect.StructField, value, options string) string {
+	if unmarshaler, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalText([]byte(value)); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		if hasParamOption(options, "date") {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return "must be a date in YYYY-MM-DD format"
+			}
+		}
+		if enum, ok := field.Tag.Lookup("enum"); ok {
+			allowed := strings.Split(enum, ",")
+			if !slices.Contains(allowed, value) {
+				return "must be one of " + strings.Join(allowed, ", ")
+			}
+		}
+		fv.SetString(value)
+
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			if bounds := paramRange(field); bounds != "" {
+				return "must be" + bounds
+			}
+			return "must be an integer"
+		}
+		if reason := checkParamRange(field, int64(parsed)); reason != "" {
+			return reason
+		}
+		fv.SetInt(int64(parsed))
+
+	case reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "must be a non-negative integer"
+		}
+		if reason := checkParamRange(field, int64(min(parsed, math.MaxInt64))); reason != "" {
+			return reason
+		}
+		fv.SetUint(parsed)
+
+	case reflect.Bool:
+		switch value {
+		case "0", "false":
+			fv.SetBool(false)
+		case "1", "true":
+			fv.SetBool(true)
+		default:
+			return "must be 0, 1, true or false"
+		}
+
+	default:
+		panic(fmt.Sprintf("parseParams: unsupported type %s of field %s", fv.Type(), field.Name))
+	}
+	return ""
+}
+
+// checkParamRange enforces the min and max tags of a numeric field
+func checkParamRange(field reflect.StructField, value int64) string {
+	if lower, ok := paramBound(field, "min"); ok && value < lower {
+		return "must be" + paramRange(field)
+	}
+	if upper, ok := paramBound(field, "max"); ok && value > upper {
+		return "must be" + paramRange(field)
+	}
+	return ""
+}
+
+// paramRange describes the min and max tags of a numeric field
+func paramRange(field reflect.StructField) string {
+	lower, hasMin := paramBound(field, "min")
+	upper, hasMax := paramBound(field, "max")
+	switch {
+	case hasMin && hasMax:
+		return fmt.Sprintf(" between %d and %d", lower, upper)
+	case hasMin:
+		return fmt.Sprintf(" at least %d", lower)
+	case hasMax:
+		return fmt.Sprintf(" at most %d", upper)
+	}
+	return ""
+}
+
+func paramBound(field reflect.StructField, key string) (int64, bool) {
+	tag, ok := field.Tag.Lookup(key)
+	if !ok {
+		return 0, false
+	}
+	bound, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("parseParams: invalid %s tag %q of field %s", key, tag, field.Name))
+	}
+	return bound, true
+}
+
+// paramErrors collects the invalid parameters of a request in the order the
+// fields are declared
+type paramErrors struct {
+	reasons    map[string]string
+	messages   []string
+	hasInvalid bool
+}
+
+func (e *paramErrors) missing(name string) {
+	e.add(name, "is required", "missing parameter: "+name)
+}
+
+func (e *paramErrors) invalid(name, reason string) {
+	e.hasInvalid = true
+	e.add(name, reason, "invalid parameter: "+name+" "+reason)
+}
+
+func (e *paramErrors) add(name, reason, message string) {
+	if e.reasons == nil {
+		e.reasons = make(map[string]string)
+	}
+	e.reasons[name] = reason
+	e.messages = append(e.messages, message)
+}
+
+// err returns a *ValidationError listing every invalid parameter, or nil.
+// Requests that only lack parameters get the missing_parameter code.
+func (e *paramErrors) err() error {
+	if len(e.messages) == 0 {
+		return nil
+	}
+
+	code := errCodeMissingParameter
+	if e.hasInvalid {
+		code = errCodeInvalidParameter
+	}
+	return &ValidationError{
+		Code:    code,
+		Fields:  e.reasons,
+		Message: strings.Join(e.messages, "; "),
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testParams struct {
+	Date      string `param:"date,required,date"`
+	Interval  int    `param:"interval,required" min:"1" max:"1440"`
+	Threshold int    `param:"threshold,required" min:"0"`
+	Realtime  bool   `param:"realtime"`
+	Format    string `param:"format" enum:"json,csv" default:"json"`
+	Limit     uint64 `param:"limit" max:"100" default:"10"`
+	Label     string `param:"label"`
+}
+
+func newParamsRequest(query map[string]string) *http.Request {
+	q := url.Values{}
+	for key, value := range query {
+		q.Set(key, value)
+	}
+	return &http.Request{URL: &url.URL{RawQuery: q.Encode()}}
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name           string
+		queryParams    map[string]string
+		expectedParams testParams
+		expectedCode   string
+		expectedFields map[string]string
+	}{
+		{
+			name: "All parameters present",
+			queryParams: map[string]string{
+				"date":      "2023-12-25",
+				"interval":  "60",
+				"threshold": "5",
+				"realtime":  "true",
+				"format":    "csv",
+				"limit":     "20",
+				"label":     "U3",
+			},
+			expectedParams: testParams{Date: "2023-12-25", Interval: 60, Threshold: 5, Realtime: true, Format: "csv", Limit: 20, Label: "U3"},
+		},
+		{
+			name: "Defaults",
+			queryParams: map[string]string{
+				"date":      "2023-12-25",
+				"interval":  "60",
+				"threshold": "5",
+			},
+			expectedParams: testParams{Date: "2023-12-25", Interval: 60, Threshold: 5, Format: "json", Limit: 10},
+		},
+		{
+			name: "Missing parameter",
+			queryParams: map[string]string{
+				"date":     "2023-12-25",
+				"interval": "60",
+			},
+			expectedCode:   errCodeMissingParameter,
+			expectedFields: map[string]string{"threshold": "is required"},
+		},
+		{
+			name: "Empty parameter value",
+			queryParams: map[string]string{
+				"date":      "2023-12-25",
+				"interval":  "",
+				"threshold": "5",
+			},
+			expectedCode:   errCodeMissingParameter,
+			expectedFields: map[string]string{"interval": "is required"},
+		},
+		{
+			name: "Every invalid parameter is reported",
+			queryParams: map[string]string{
+				"date":     "25.12.2023",
+				"interval": "0",
+				"realtime": "yes",
+				"format":   "xml",
+				"limit":    "1000",
+			},
+			expectedCode: errCodeInvalidParameter,
+			expectedFields: map[string]string{
+				"date":      "must be a date in YYYY-MM-DD format",
+				"interval":  "must be between 1 and 1440",
+				"threshold": "is required",
+				"realtime":  "must be 0, 1, true or false",
+				"format":    "must be one of json, csv",
+				"limit":     "must be at most 100",
+			},
+		},
+		{
+			name: "Not a number",
+			queryParams: map[string]string{
+				"date":      "2023-12-25",
+				"interval":  "hourly",
+				"threshold": "-1",
+				"limit":     "-1",
+			},
+			expectedCode: errCodeInvalidParameter,
+			expectedFields: map[string]string{
+				"interval":  "must be between 1 and 1440",
+				"threshold": "must be at least 0",
+				"limit":     "must be a non-negative integer",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params testParams
+			err := parseParams(newParamsRequest(tt.queryParams), &params)
+
+			if tt.expectedCode == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedParams, params)
+				return
+			}
+
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, tt.expectedCode, validationErr.Code)
+				assert.Equal(t, tt.expectedFields, validationErr.Fields)
+			}
+		})
+	}
+}
+
+func TestParseParamsMessage(t *testing.T) {
+	var params testParams
+	err := parseParams(newParamsRequest(map[string]string{"interval": "100000", "threshold": "5"}), &params)
+
+	assert.EqualError(t, err, "missing parameter: date; invalid parameter: interval must be between 1 and 1440")
+}
+
+func TestParseParamsKeepsPresetValues(t *testing.T) {
+	params := stationStatsParams{Threshold: delayedThresholdMinutes}
+	err := parseParams(newParamsRequest(map[string]string{"station": "de:09162:1"}), &params)
+
+	assert.NoError(t, err)
+	assert.Equal(t, delayedThresholdMinutes, params.Threshold)
+	assert.Equal(t, formatJSON, params.Format)
+}
+
+func TestParseParamsTextUnmarshaler(t *testing.T) {
+	var params stationStatsParams
+	err := parseParams(newParamsRequest(map[string]string{"station": "de:09162:1", "buckets": "0, 3,10"}), &params)
+	assert.NoError(t, err)
+	assert.Equal(t, bucketEdges{0, 3, 10}, params.Buckets)
+
+	// Bucket edges are reported together with the other invalid parameters
+	err = parseParams(newParamsRequest(map[string]string{"station": "de:09162:1", "threshold": "two", "buckets": "5,2"}), &params)
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, map[string]string{
+			"threshold": "must be between 0 and 1440",
+			"buckets":   "bucket edges must be strictly increasing, got 2 after 5",
+		}, validationErr.Fields)
+	}
+}
+
+func TestParseParamsEmbedded(t *testing.T) {
+	var params lineDelayParams
+	err := parseParams(newParamsRequest(map[string]string{
+		"date":       "2023-12-25",
+		"interval":   "60",
+		"threshold":  "5",
+		"realtime":   "1",
+		"label":      "U1",
+		"south":      "0",
+		"serviceDay": "1",
+	}), &params)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "U1", params.Label)
+	assert.False(t, params.South)
+	assert.Equal(t, 60, params.Interval)
+	assert.Equal(t, DelayQueryOptions{DayStartHour: serviceDayStartHour}, params.options())
+}
+
+func BenchmarkParseParams(b *testing.B) {
+	u, _ := url.Parse("http://example.com?date=2023-12-25&interval=60&threshold=5&realtime=1")
+	req := &http.Request{URL: u}
+
+	for i := 0; i < b.N; i++ {
+		var params delayParams
+		parseParams(req, &params)
+	}
+}
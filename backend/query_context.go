@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// clickhouseTimeoutExceeded is the ClickHouse error code TIMEOUT_EXCEEDED,
+// raised when a query runs longer than max_execution_time
+const clickhouseTimeoutExceeded = 159
+
+// defaultQueryTimeout applies to endpoints without a specific timeout
+const defaultQueryTimeout = 30 * time.Second
+
+// defaultQueryTimeouts holds the per-endpoint query timeouts. The aggregations
+// over a full year of data need more time than the single day endpoints, and
+// raw exports stream up to a million rows.
+var defaultQueryTimeouts = map[string]time.Duration{
+	"line_delay":    30 * time.Second,
+	"global_delay":  30 * time.Second,
+	"station_stats": 60 * time.Second,
+	"line_stats":    60 * time.Second,
+	"rankings":      60 * time.Second,
+
+	"export_departures": 5 * time.Minute,
+}
+
+// queryTimeouts are the effective per-endpoint timeouts, see QueryTimeoutConfig
+var queryTimeouts = defaultQueryTimeouts
+
+// queryTimeout returns the query timeout for an endpoint
+func queryTimeout(endpoint string) time.Duration {
+	if timeout, ok := queryTimeouts[endpoint]; ok {
+		return timeout
+	}
+	return defaultQueryTimeout
+}
+
+// queryContext derives the context for the ClickHouse queries of a request.
+// It is cancelled when the client disconnects or the endpoint's timeout
+// elapses. The driver turns the deadline into a max_execution_time setting,
+// so ClickHouse aborts the query server-side as well.
+func queryContext(r *http.Request, endpoint string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), queryTimeout(endpoint))
+}
+
+// isQueryTimeout reports whether err was caused by a query running out of time,
+// either on our side (context deadline, socket deadline) or in ClickHouse
+func isQueryTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && exception.Code == clickhouseTimeoutExceeded
+}
+
+// writeQueryError reports a failed query to the client. Invalid input
+// rejected by the query services maps to 400 Bad Request, unknown stations
+// and lines to 404 Not Found and timeouts to
+// 504 Gateway Timeout; cancelled requests get no response since the client
+// is already gone. Other errors are logged and answered with a generic 500.
+func writeQueryError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	var validationErr *ValidationError
+	var notFoundErr *NotFoundError
+	var scanErr *ScanError
+	switch {
+	case errors.As(err, &validationErr):
+		writeValidationError(w, r, err)
+	case errors.As(err, &notFoundErr):
+		writeError(w, r, http.StatusNotFound, APIError{
+			Code:    errCodeNotFound,
+			Message: notFoundErr.Message,
+			Details: map[string]string{notFoundErr.Param: notFoundErr.Value},
+		})
+	case isQueryTimeout(err):
+		writeError(w, r, http.StatusGatewayTimeout, APIError{
+			Code:    errCodeQueryTimeout,
+			Message: message + ": query timed out",
+		})
+	case errors.Is(err, context.Canceled):
+		httpLog.DebugContext(r.Context(), message+": request cancelled by client")
+	case errors.As(err, &scanErr):
+		httpLog.ErrorContext(r.Context(), message, "error", err)
+		writeError(w, r, http.StatusInternalServerError, APIError{
+			Code:    errCodeScanFailed,
+			Message: message + ": result rows could not be read",
+			Details: map[string]string{"query": scanErr.Query},
+		})
+	default:
+		writeInternalError(w, r, message, err)
+	}
+}
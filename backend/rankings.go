@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// GetRankings ranks all stations and subway lines by average delay, punctuality
+// and departure count within a date range. Entries with fewer than minDepartures
+// departures are left out to keep rarely served stations from dominating the lists.
+func (s *StationStatsService) GetRankings(ctx context.Context, startDate, endDate string, limit int, minDepartures uint64) (Rankings, error) {
+	// Validate inputs
+	if err := validateDateRange(startDate, endDate); err != nil {
+		return Rankings{}, fmt.Errorf("invalid date range: %w", err)
+	}
+	if limit < 1 {
+		return Rankings{}, fmt.Errorf("invalid limit %d, must be positive", limit)
+	}
+
+	stations, err := s.getRankingEntries(ctx, "station", startDate, endDate, minDepartures)
+	if err != nil {
+		return Rankings{}, fmt.Errorf("failed to get station rankings: %w", err)
+	}
+	for i := range stations {
+		stations[i].Name = friendlyNames[stations[i].ID]
+	}
+
+	lines, err := s.getRankingEntries(ctx, "label", startDate, endDate, minDepartures)
+	if err != nil {
+		return Rankings{}, fmt.Errorf("failed to get line rankings: %w", err)
+	}
+
+	return Rankings{
+		StartDate:     startDate,
+		EndDate:       endDate,
+		MinDepartures: minDepartures,
+		Stations:      rankEntries(stations, limit),
+		Lines:         rankEntries(lines, limit),
+	}, nil
+}
+
+// getRankingEntries aggregates basic statistics grouped by groupColumn, which
+// must be either "station" or "label"
+func (s *StationStatsService) getRankingEntries(ctx context.Context, groupColumn, startDate, endDate string, minDepartures uint64) ([]RankingEntry, error) {
+	if groupColumn != "station" && groupColumn != "label" {
+		return nil, fmt.Errorf("unsupported ranking column %q", groupColumn)
+	}
+
+	query := `
+		SELECT
+			` + groupColumn + ` as id,` + basicStatsColumns + `
+		FROM mvg.responses_dedup
+		WHERE plannedDepartureTime >= ?
+		AND plannedDepartureTime < ?
+		AND startsWith(label, 'U')
+		GROUP BY id
+		HAVING totalDepartures >= ?
+	`
+
+	rows, err := s.conn.Query(withQueryName(ctx, groupColumn+"_rankings"), query, delayedThresholdMinutes, startDate, endDate, minDepartures)
+	if err != nil {
+		return nil, fmt.Errorf("%s ranking query failed: %w", groupColumn, err)
+	}
+	defer rows.Close()
+
+	var entries []RankingEntry
+	for rows.Next() {
+		var entry RankingEntry
+		var delayPercentage float64
+
+		if err := rows.Scan(&entry.ID, &entry.AvgDelay, &entry.Departures, &delayPercentage); err != nil {
+			if err := skipRow(ctx, groupColumn+"_rankings", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entry.PunctualityPercentage = 100.0 - delayPercentage
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating %s rankings: %w", groupColumn, err)
+	}
+
+	return entries, nil
+}
+
+// rankEntries builds the top and bottom lists of every ranking category
+func rankEntries(entries []RankingEntry, limit int) RankingCategories {
+	return RankingCategories{
+		AvgDelay: rankBy(entries, limit, func(e RankingEntry) float64 {
+			return e.AvgDelay
+		}),
+		Punctuality: rankBy(entries, limit, func(e RankingEntry) float64 {
+			return e.PunctualityPercentage
+		}),
+		Departures: rankBy(entries, limit, func(e RankingEntry) float64 {
+			return float64(e.Departures)
+		}),
+	}
+}
+
+// rankBy sorts entries by metric and returns the limit highest and lowest ones.
+// Ties are broken by ID to keep responses stable.
+func rankBy(entries []RankingEntry, limit int, metric func(RankingEntry) float64) RankingList {
+	sorted := make([]RankingEntry, len(entries))
+	copy(sorted, entries)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		mi, mj := metric(sorted[i]), metric(sorted[j])
+		if mi != mj {
+			return mi > mj
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	n := min(limit, len(sorted))
+	top := append([]RankingEntry{}, sorted[:n]...)
+
+	bottom := make([]RankingEntry, 0, n)
+	for i := len(sorted) - 1; i >= len(sorted)-n; i-- {
+		bottom = append(bottom, sorted[i])
+	}
+
+	return RankingList{Top: top, Bottom: bottom}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient creates the Redis client for the configured mode. In
+// sentinel mode the client follows the master through failovers.
+//
+// In cluster mode every node only publishes the keyevents of its own keys,
+// so the event stream only sees the departures stored on the node the
+// subscription landed on.
+func newRedisClient(config RedisConfig) (redis.UniversalClient, error) {
+	tlsConfig, err := config.TLS.load()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &redis.UniversalOptions{
+		DB:        config.DB,
+		Username:  config.Username,
+		Password:  config.Password,
+		TLSConfig: tlsConfig,
+	}
+	switch config.Mode {
+	case "sentinel":
+		options.Addrs = config.Addresses
+		options.MasterName = config.MasterName
+		options.SentinelPassword = config.SentinelPassword
+	case "cluster":
+		options.Addrs = config.Addresses
+		options.IsClusterMode = true
+	default:
+		options.Addrs = []string{net.JoinHostPort(config.Host, config.Port)}
+	}
+
+	return redis.NewUniversalClient(options), nil
+}
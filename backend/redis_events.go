@@ -0,0 +1,256 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// keyeventPingInterval is how long the subscription may stay silent before
+	// it is pinged. A ping that is not answered within another interval
+	// counts as a lost connection.
+	keyeventPingInterval = 30 * time.Second
+
+	// Delays between subscription attempts, doubled after every failure
+	redisMinBackoff = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+// redisEventProcessor publishes the departures of every station key set in
+// Redis to the event stream. When the subscription fails, e.g. because
+// Redis restarted, it resubscribes with exponential backoff and publishes
+// all station keys again, since keys set in between sent no keyevent.
+func (eb *EventBroadcaster) redisEventProcessor(ctx context.Context) {
+	minBackoff := cmp.Or(eb.minBackoff, redisMinBackoff)
+	maxBackoff := cmp.Or(eb.maxBackoff, redisMaxBackoff)
+
+	backoff := minBackoff
+	for {
+		err := eb.processKeyevents(ctx, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+
+		redisResubscriptions.Inc()
+		redisLog.Warn("keyevent subscription lost, resubscribing", "backoff", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// processKeyevents subscribes to the keyevents and handles them until the
+// subscription fails. subscribed is called once the subscription stands.
+func (eb *EventBroadcaster) processKeyevents(ctx context.Context, subscribed func()) error {
+	eb.ensureKeyspaceEvents(ctx)
+
+	channel := eb.config.keyPattern().channel()
+	var sub PubSubInterface
+	if eb.subscribe != nil {
+		sub = eb.subscribe(ctx, channel)
+	} else {
+		sub = eb.redisClient.PSubscribe(ctx, channel)
+	}
+	defer sub.Close()
+	// Receiving blocks without looking at ctx, closing the subscription ends it
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	// Backfill only once subscribed, so that no key set meanwhile is missed
+	msg, err := sub.ReceiveTimeout(ctx, keyeventPingInterval)
+	if err != nil {
+		return fmt.Errorf("subscribing to %s: %w", channel, err)
+	}
+	if _, ok := msg.(*redis.Subscription); !ok {
+		return fmt.Errorf("subscribing to %s: unexpected %T", channel, msg)
+	}
+	subscribed()
+
+	if err := eb.backfill(ctx); err != nil {
+		redisLog.Warn("backfilling station keys failed", "error", err)
+	}
+
+	pinged := false
+	for {
+		msg, err := sub.ReceiveTimeout(ctx, keyeventPingInterval)
+		if err != nil {
+			if !isNetTimeout(err) {
+				return err
+			}
+			if pinged {
+				return errors.New("no answer to ping")
+			}
+			if err := sub.Ping(ctx); err != nil {
+				return fmt.Errorf("ping: %w", err)
+			}
+			pinged = true
+			continue
+		}
+		pinged = false
+
+		if msg, ok := msg.(*redis.Message); ok {
+			if isCacheKey(msg.Payload) {
+				continue
+			}
+			redisLog.Debug("received keyevent", "channel", msg.Channel, "key", msg.Payload)
+			redisKeyevents.Inc()
+			eb.publishDepartures(ctx, msg.Payload)
+		}
+	}
+}
+
+// isCacheKey reports whether key holds a cached query result. The Redis cache
+// backend shares the database of the station keys, so its writes send
+// keyevents as well.
+func isCacheKey(key string) bool {
+	return strings.HasPrefix(key, redisCacheKeyPrefix)
+}
+
+func isNetTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backfill publishes the departures of every station key
+func (eb *EventBroadcaster) backfill(ctx context.Context) error {
+	var cursor uint64
+	published := 0
+	for {
+		keys, next, err := eb.redisClient.Scan(ctx, cursor, eb.config.keyPattern().scanMatch(), 100).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if isCacheKey(key) {
+				continue
+			}
+			if eb.publishDepartures(ctx, key) {
+				published++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	redisLog.Info("backfilled station departures", "stations", published)
+	return nil
+}
+
+// ensureKeyspaceEvents turns on the keyevents for string commands. A Redis
+// restarted without notify-keyspace-events in its configuration file has
+// them off, and the event stream would stay silent. Set
+// REDIS_CONFIGURE_KEYSPACE_EVENTS=false where the setting is managed
+// elsewhere.
+func (eb *EventBroadcaster) ensureKeyspaceEvents(ctx context.Context) {
+	if !eb.config.ConfigureKeyspaceEvents {
+		return
+	}
+
+	config, err := eb.redisClient.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		redisLog.Warn("cannot read notify-keyspace-events", "error", err)
+		return
+	}
+
+	flags := config["notify-keyspace-events"]
+	if keyeventsEnabled(flags) {
+		return
+	}
+
+	updated := flags
+	if !strings.Contains(updated, "E") {
+		updated += "E"
+	}
+	if !strings.ContainsAny(updated, "$A") {
+		updated += "$"
+	}
+	if err := eb.redisClient.ConfigSet(ctx, "notify-keyspace-events", updated).Err(); err != nil {
+		redisLog.Warn("cannot enable keyevents", "notify-keyspace-events", flags, "error", err)
+		return
+	}
+	redisLog.Info("changed notify-keyspace-events", "from", flags, "to", updated)
+}
+
+// keyeventsEnabled reports whether the notify-keyspace-events flags include
+// keyevents for string commands
+func keyeventsEnabled(flags string) bool {
+	return strings.Contains(flags, "E") && strings.ContainsAny(flags, "$A")
+}
+
+// publishDepartures adds the departures stored at key to the event stream
+// and reports whether it succeeded
+func (eb *EventBroadcaster) publishDepartures(ctx context.Context, key string) bool {
+	stationID, err := eb.config.keyPattern().stationID(key)
+	if err != nil {
+		redisLog.Warn("ignoring key", "error", err)
+		departuresDropped.WithLabelValues("unknown_key").Inc()
+		return false
+	}
+
+	value, err := eb.redisClient.Get(ctx, key).Result()
+	if err != nil {
+		redisLog.Warn("fetching departures failed", "key", key, "error", err)
+		departuresDropped.WithLabelValues("fetch_failed").Inc()
+		return false
+	}
+
+	var departures []Departure
+	if err := json.Unmarshal([]byte(value), &departures); err != nil {
+		redisLog.Warn("decoding departures failed", "key", key, "error", err)
+		jsonDecodeFailures.WithLabelValues("departures").Inc()
+		departuresDropped.WithLabelValues("decode_failed").Inc()
+		return false
+	}
+
+	departures = filterAndDedup(departures)
+	data := struct {
+		Station      string      `json:"station"`
+		FriendlyName string      `json:"friendlyName"`
+		Coordinates  Coordinates `json:"coordinates"`
+		Departures   []Departure `json:"departures"`
+	}{
+		Station:      stationID,
+		FriendlyName: friendlyNames[stationID],
+		Coordinates:  coordinates[stationID],
+		Departures:   departures,
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		redisLog.Error("encoding departures failed", "station", stationID, "error", err)
+		departuresDropped.WithLabelValues("encode_failed").Inc()
+		return false
+	}
+
+	err = eb.redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: redisStreamName,
+		Values: map[string]string{"json": string(raw)},
+		ID:     "*",
+		MaxLen: eb.config.StreamMaxLen,
+	}).Err()
+	if err != nil {
+		redisLog.Warn("publishing departures failed", "station", stationID, "error", err)
+		departuresDropped.WithLabelValues("publish_failed").Inc()
+		return false
+	}
+
+	departuresPublished.Inc()
+	eb.lastEvent.Store(time.Now().UnixNano())
+	return true
+}
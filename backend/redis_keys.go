@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyPattern describes the Redis keys holding the departures of a station:
+// <Prefix><Separator><station ID>, e.g. "departures_de:09162:1". Without a
+// prefix, anything up to the first separator is accepted.
+type KeyPattern struct {
+	Prefix    string
+	Separator string
+	DB        int // database of the keys, only its keyevents are processed
+}
+
+func (p KeyPattern) validate() error {
+	if p.Separator == "" {
+		return errors.New("redis.keySeparator must not be empty")
+	}
+	if strings.Contains(p.Prefix, p.Separator) {
+		return fmt.Errorf("redis.keyPrefix %q must not contain the separator %q", p.Prefix, p.Separator)
+	}
+	return nil
+}
+
+// String returns the pattern in a form fit for log messages
+func (p KeyPattern) String() string {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = "*"
+	}
+	return fmt.Sprintf("%s%s<station> in database %d", prefix, p.Separator, p.DB)
+}
+
+// channel is the keyevent channel for SET in the database of the keys
+func (p KeyPattern) channel() string {
+	return fmt.Sprintf("__keyevent@%d__:set", p.DB)
+}
+
+// scanMatch is the SCAN pattern matching the station keys
+func (p KeyPattern) scanMatch() string {
+	prefix := "*"
+	if p.Prefix != "" {
+		prefix = escapeGlob(p.Prefix)
+	}
+	return prefix + escapeGlob(p.Separator) + "*"
+}
+
+// stationID returns the station a key holds the departures of. Keys of other
+// shapes and keys naming a station outside the registry are rejected.
+func (p KeyPattern) stationID(key string) (string, error) {
+	var id string
+	var ok bool
+	if p.Prefix != "" {
+		id, ok = strings.CutPrefix(key, p.Prefix+p.Separator)
+	} else {
+		_, id, ok = strings.Cut(key, p.Separator)
+	}
+	if !ok || id == "" {
+		return "", fmt.Errorf("key %q does not match %s", key, p)
+	}
+
+	if _, known := friendlyNames[id]; !known {
+		return "", fmt.Errorf("key %q names unknown station %q", key, id)
+	}
+	return id, nil
+}
+
+// escapeGlob quotes the characters that are special in Redis glob patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\^`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
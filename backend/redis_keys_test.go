@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyPatternStationID(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern KeyPattern
+		key     string
+		station string
+		err     string
+	}{
+		{"any prefix", KeyPattern{Separator: "_"}, "departures_de:09162:1", "de:09162:1", ""},
+		{"configured prefix", KeyPattern{Prefix: "departures", Separator: "_"}, "departures_de:09162:2", "de:09162:2", ""},
+		{"other separator", KeyPattern{Prefix: "mvg", Separator: ":"}, "mvg:de:09162:1", "de:09162:1", ""},
+		{"no separator", KeyPattern{Separator: "_"}, "departures", "", `key "departures" does not match *_<station> in database 0`},
+		{"empty station", KeyPattern{Separator: "_"}, "departures_", "", `key "departures_" does not match *_<station> in database 0`},
+		{"other prefix", KeyPattern{Prefix: "departures", Separator: "_"}, "arrivals_de:09162:1", "",
+			`key "arrivals_de:09162:1" does not match departures_<station> in database 0`},
+		{"unknown station", KeyPattern{Separator: "_"}, "mvg-observer:cache:line_stats?label=U1", "",
+			`key "mvg-observer:cache:line_stats?label=U1" names unknown station "stats?label=U1"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			station, err := tt.pattern.stationID(tt.key)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.station, station)
+		})
+	}
+}
+
+func TestKeyPatternRedisPatterns(t *testing.T) {
+	assert.Equal(t, "__keyevent@0__:set", KeyPattern{Separator: "_"}.channel())
+	assert.Equal(t, "__keyevent@3__:set", KeyPattern{Separator: "_", DB: 3}.channel())
+
+	assert.Equal(t, "*_*", KeyPattern{Separator: "_"}.scanMatch())
+	assert.Equal(t, "departures_*", KeyPattern{Prefix: "departures", Separator: "_"}.scanMatch())
+	assert.Equal(t, `mvg\[live\]\*:*`, KeyPattern{Prefix: "mvg[live]*", Separator: ":"}.scanMatch())
+}
@@ -3,11 +3,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockPubSub implements redis.PubSub for testing
@@ -116,6 +124,11 @@ func (m *EnhancedMockRedisClient) Get(ctx context.Context, key string) *redis.St
 	return mockCmd.StringCmd
 }
 
+func (m *EnhancedMockRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	args := m.Called(ctx, key, value, expiration)
+	return args.Get(0).(*redis.StatusCmd)
+}
+
 func (m *EnhancedMockRedisClient) XGroupCreate(ctx context.Context, stream, group, start string) *redis.StatusCmd {
 	args := m.Called(ctx, stream, group, start)
 	return args.Get(0).(*redis.StatusCmd)
@@ -132,10 +145,217 @@ func (m *EnhancedMockRedisClient) XAdd(ctx context.Context, a *redis.XAddArgs) *
 	return mockCmd.StringCmd
 }
 
+func (m *EnhancedMockRedisClient) XLen(ctx context.Context, stream string) *redis.IntCmd {
+	args := m.Called(ctx, stream)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+func (m *EnhancedMockRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
+	args := m.Called(ctx)
+	return args.Get(0).(*redis.StatusCmd)
+}
+
+func (m *EnhancedMockRedisClient) ConfigGet(ctx context.Context, parameter string) *redis.MapStringStringCmd {
+	args := m.Called(ctx, parameter)
+	return args.Get(0).(*redis.MapStringStringCmd)
+}
+
+func (m *EnhancedMockRedisClient) ConfigSet(ctx context.Context, parameter, value string) *redis.StatusCmd {
+	args := m.Called(ctx, parameter, value)
+	return args.Get(0).(*redis.StatusCmd)
+}
+
+func (m *EnhancedMockRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	args := m.Called(ctx, cursor, match, count)
+	return args.Get(0).(*redis.ScanCmd)
+}
+
+// fakePubSub hands out scripted subscription messages and errors
+type fakePubSub struct {
+	messages  chan interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	pings     atomic.Int32
+}
+
+func newFakePubSub(messages ...interface{}) *fakePubSub {
+	sub := &fakePubSub{messages: make(chan interface{}, len(messages)), closed: make(chan struct{})}
+	for _, msg := range messages {
+		sub.messages <- msg
+	}
+	return sub
+}
+
+func (f *fakePubSub) ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error) {
+	select {
+	case msg := <-f.messages:
+		if err, ok := msg.(error); ok {
+			return nil, err
+		}
+		return msg, nil
+	case <-f.closed:
+		return nil, errors.New("redis: client is closed")
+	}
+}
+
+func (f *fakePubSub) Ping(ctx context.Context, payload ...string) error {
+	f.pings.Add(1)
+	return nil
+}
+
+func (f *fakePubSub) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
 func TestEventBroadcasterRedisEventProcessor(t *testing.T) {
-	// Skip this complex integration test for now
-	// This would require extensive Redis PubSub mocking
-	t.Skip("Skipping complex Redis PubSub test - would need real Redis instance for full integration test")
+	mockRedis := &EnhancedMockRedisClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	departures, _ := json.Marshal([]Departure{{Label: "U1"}, {Label: "S1"}})
+	mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+		Return(redis.NewMapStringStringResult(map[string]string{"notify-keyspace-events": "Ex$"}, nil))
+	mockRedis.On("Scan", mock.Anything, uint64(0), "departures_*", int64(100)).
+		Return(redis.NewScanCmdResult([]string{"departures_de:09162:1"}, 0, nil))
+	mockRedis.On("Get", mock.Anything, "departures_de:09162:1").Return(NewMockStringCmd(string(departures), nil))
+	mockRedis.On("Get", mock.Anything, "departures_de:09162:2").Return(NewMockStringCmd(string(departures), nil))
+
+	var published []string
+	mockRedis.On("XAdd", mock.Anything, mock.AnythingOfType("*redis.XAddArgs")).
+		Run(func(args mock.Arguments) {
+			published = append(published, args.Get(1).(*redis.XAddArgs).Values.(map[string]string)["json"])
+			// Backfill, backfill after resubscribing, keyevent
+			if len(published) == 3 {
+				cancel()
+			}
+		}).
+		Return(NewMockStringCmd("1-0", nil))
+
+	// The first subscription breaks like on a Redis restart
+	subs := []*fakePubSub{
+		newFakePubSub(&redis.Subscription{Kind: "psubscribe"}, io.EOF),
+		newFakePubSub(&redis.Subscription{Kind: "psubscribe"},
+			// Keys of other writers are skipped without fetching them
+			&redis.Message{Payload: "mvg-observer:cache:line_stats?label=U1"},
+			&redis.Message{Payload: "departures"},
+			&redis.Message{Payload: "departures_de:09162:2"}),
+	}
+	var subscribed int
+	config := defaultConfig().Redis
+	config.KeyPrefix = "departures"
+	eb := newEventBroadcaster(mockRedis, config)
+	eb.minBackoff = time.Millisecond
+	eb.subscribe = func(ctx context.Context, channel string) PubSubInterface {
+		assert.Equal(t, "__keyevent@0__:set", channel)
+		sub := subs[subscribed]
+		subscribed++
+		return sub
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		eb.redisEventProcessor(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("redisEventProcessor did not stop")
+	}
+
+	assert.Equal(t, 2, subscribed)
+	require.Len(t, published, 3)
+	assert.Contains(t, published[0], `"station":"de:09162:1"`)
+	assert.Contains(t, published[2], `"station":"de:09162:2"`)
+	assert.NotContains(t, published[2], "S1")
+	mockRedis.AssertNumberOfCalls(t, "Scan", 2)
+	assert.NotZero(t, eb.lastEvent.Load())
+}
+
+func TestCacheWritesPublishNoEvents(t *testing.T) {
+	mockRedis := &EnhancedMockRedisClient{}
+	mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+		Return(redis.NewMapStringStringResult(map[string]string{"notify-keyspace-events": "AKE"}, nil))
+	var cacheKey string
+	mockRedis.On("Set", mock.Anything, mock.Anything, mock.Anything, time.Minute).
+		Run(func(args mock.Arguments) { cacheKey = args.String(1) }).
+		Return(redis.NewStatusResult("OK", nil))
+
+	// A cached result is a JSON array, it would decode as departures
+	require.NoError(t, newRedisCache(mockRedis).Set(context.Background(), "line_delay?date=2025-01-01", []byte(`[{"label":"U1"}]`), time.Minute))
+	mockRedis.On("Scan", mock.Anything, uint64(0), "*_*", int64(100)).
+		Return(redis.NewScanCmdResult([]string{cacheKey}, 0, nil))
+
+	sub := newFakePubSub(&redis.Subscription{Kind: "psubscribe"}, &redis.Message{Payload: cacheKey}, io.EOF)
+	eb := newEventBroadcaster(mockRedis, defaultConfig().Redis)
+	eb.subscribe = func(context.Context, string) PubSubInterface { return sub }
+
+	dropped := testutil.ToFloat64(departuresDropped.WithLabelValues("unknown_key"))
+	keyevents := testutil.ToFloat64(redisKeyevents)
+	assert.ErrorIs(t, eb.processKeyevents(context.Background(), func() {}), io.EOF)
+
+	mockRedis.AssertNotCalled(t, "Get", mock.Anything, mock.Anything)
+	mockRedis.AssertNotCalled(t, "XAdd", mock.Anything, mock.Anything)
+	assert.Equal(t, dropped, testutil.ToFloat64(departuresDropped.WithLabelValues("unknown_key")))
+	assert.Equal(t, keyevents, testutil.ToFloat64(redisKeyevents))
+}
+
+func TestProcessKeyeventsDetectsDeadConnection(t *testing.T) {
+	mockRedis := &EnhancedMockRedisClient{}
+	mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+		Return(redis.NewMapStringStringResult(map[string]string{"notify-keyspace-events": "AKE"}, nil))
+	mockRedis.On("Scan", mock.Anything, uint64(0), "*_*", int64(100)).
+		Return(redis.NewScanCmdResult(nil, 0, nil))
+
+	// Silence, the ping goes unanswered, silence
+	sub := newFakePubSub(&redis.Subscription{Kind: "psubscribe"}, os.ErrDeadlineExceeded, os.ErrDeadlineExceeded)
+	eb := newEventBroadcaster(mockRedis, defaultConfig().Redis)
+	eb.subscribe = func(context.Context, string) PubSubInterface { return sub }
+
+	err := eb.processKeyevents(context.Background(), func() {})
+	assert.EqualError(t, err, "no answer to ping")
+	assert.Equal(t, int32(1), sub.pings.Load())
+}
+
+func TestEnsureKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		flags   string
+		updated string // empty if the flags are left alone
+	}{
+		{"", "E$"},
+		{"Kx", "KxE$"},
+		{"KA", "KAE"},
+		{"E", "E$"},
+		{"Ex$", ""},
+		{"AKE", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flags, func(t *testing.T) {
+			mockRedis := &EnhancedMockRedisClient{}
+			mockRedis.On("ConfigGet", mock.Anything, "notify-keyspace-events").
+				Return(redis.NewMapStringStringResult(map[string]string{"notify-keyspace-events": tt.flags}, nil))
+			if tt.updated != "" {
+				mockRedis.On("ConfigSet", mock.Anything, "notify-keyspace-events", tt.updated).
+					Return(redis.NewStatusResult("OK", nil))
+			}
+
+			newEventBroadcaster(mockRedis, defaultConfig().Redis).ensureKeyspaceEvents(context.Background())
+			mockRedis.AssertExpectations(t)
+			if tt.updated == "" {
+				mockRedis.AssertNotCalled(t, "ConfigSet", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		config := defaultConfig().Redis
+		config.ConfigureKeyspaceEvents = false
+		mockRedis := &EnhancedMockRedisClient{}
+		newEventBroadcaster(mockRedis, config).ensureKeyspaceEvents(context.Background())
+		mockRedis.AssertNotCalled(t, "ConfigGet", mock.Anything, mock.Anything)
+	})
 }
 
 func TestEventBroadcasterWithFilteredData(t *testing.T) {
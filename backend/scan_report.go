@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ScanReport collects the result rows of a request that could not be
+// scanned, e.g. because the table schema changed. Skipped rows make the
+// response incomplete, which is reported to the client as a partial result.
+type ScanReport struct {
+	strict bool
+
+	mu     sync.Mutex
+	issues map[string]*scanIssue // query name -> issue
+}
+
+// scanIssue counts the skipped rows of one query
+type scanIssue struct {
+	skipped int
+	err     error // first scan error
+}
+
+// ScanError aborts a query in strict mode when a row cannot be scanned
+type ScanError struct {
+	Query string
+	Err   error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("failed to scan %s row: %v", e.Query, e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+type scanReportKey struct{}
+
+// withScanReport attaches a new ScanReport to ctx. In strict mode the first
+// row that cannot be scanned fails the request.
+func withScanReport(ctx context.Context, strict bool) (context.Context, *ScanReport) {
+	report := &ScanReport{strict: strict}
+	return context.WithValue(ctx, scanReportKey{}, report), report
+}
+
+// scanReportFrom returns the ScanReport of ctx or nil
+func scanReportFrom(ctx context.Context) *ScanReport {
+	report, _ := ctx.Value(scanReportKey{}).(*ScanReport)
+	return report
+}
+
+// skipRow records that a row of the named query failed to scan with err.
+// It returns a *ScanError in strict mode, the caller must then abort the
+// query instead of skipping the row.
+func skipRow(ctx context.Context, query string, err error) error {
+	report := scanReportFrom(ctx)
+	if report == nil {
+		clickhouseLog.WarnContext(ctx, "skipping row that could not be scanned", "query", query, "error", err)
+		return nil
+	}
+
+	first := report.add(query, err)
+	if report.strict {
+		return &ScanError{Query: query, Err: err}
+	}
+	// Log once per query, a schema change usually breaks every row
+	if first {
+		clickhouseLog.WarnContext(ctx, "skipping row that could not be scanned", "query", query, "error", err)
+	}
+	return nil
+}
+
+// add records a skipped row and reports whether it is the first of its query
+func (r *ScanReport) add(query string, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.issues == nil {
+		r.issues = make(map[string]*scanIssue)
+	}
+	issue, exists := r.issues[query]
+	if !exists {
+		issue = &scanIssue{err: err}
+		r.issues[query] = issue
+	}
+	issue.skipped++
+	return !exists
+}
+
+// merge adds the skipped rows of other, which was collected while computing
+// a shared result. It returns a *ScanError if r is strict and rows were skipped.
+func (r *ScanReport) merge(other *ScanReport) error {
+	if r == nil || !other.Partial() {
+		return nil
+	}
+
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.issues == nil {
+		r.issues = make(map[string]*scanIssue)
+	}
+	var scanErr error
+	for query, issue := range other.issues {
+		if existing, ok := r.issues[query]; ok {
+			existing.skipped += issue.skipped
+		} else {
+			r.issues[query] = &scanIssue{skipped: issue.skipped, err: issue.err}
+		}
+		if r.strict && scanErr == nil {
+			scanErr = &ScanError{Query: query, Err: issue.err}
+		}
+	}
+	return scanErr
+}
+
+// Partial reports whether any rows were skipped
+func (r *ScanReport) Partial() bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.issues) > 0
+}
+
+// Warnings describes the skipped rows of every query for the client, ordered
+// by query name. The scan errors may expose driver internals, skipRow only
+// logs them.
+func (r *ScanReport) Warnings() []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var warnings []string
+	for query, issue := range r.issues {
+		warnings = append(warnings, fmt.Sprintf("%s: skipped %d rows", query, issue.skipped))
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// setPartialResultHeaders flags an incomplete response. Partial results
+// must not be cached, the next request may well succeed.
+func setPartialResultHeaders(h http.Header, report *ScanReport) {
+	if !report.Partial() {
+		return
+	}
+
+	h.Set("X-Partial-Result", "true")
+	for _, warning := range report.Warnings() {
+		h.Add("X-Result-Warning", warning)
+	}
+	h.Set("Cache-Control", "no-store")
+}
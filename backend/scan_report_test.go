@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var errColumnType = errors.New("converting UInt16 to *string is unsupported")
+
+func TestScanReport(t *testing.T) {
+	ctx, report := withScanReport(context.Background(), false)
+	assert.False(t, report.Partial())
+	assert.Empty(t, report.Warnings())
+
+	assert.NoError(t, skipRow(ctx, "station_monthly_stats", errColumnType))
+	assert.NoError(t, skipRow(ctx, "station_monthly_stats", errors.New("second error")))
+	assert.NoError(t, skipRow(ctx, "global_delay", errColumnType))
+
+	assert.True(t, report.Partial())
+	assert.Equal(t, []string{
+		"global_delay: skipped 1 rows",
+		"station_monthly_stats: skipped 2 rows",
+	}, report.Warnings())
+}
+
+func TestScanReportStrict(t *testing.T) {
+	ctx, report := withScanReport(context.Background(), true)
+
+	err := skipRow(ctx, "line_delay", errColumnType)
+
+	var scanErr *ScanError
+	assert.ErrorAs(t, err, &scanErr)
+	assert.Equal(t, "line_delay", scanErr.Query)
+	assert.ErrorIs(t, err, errColumnType)
+	assert.True(t, report.Partial())
+}
+
+func TestScanReportMerge(t *testing.T) {
+	sharedCtx, shared := withScanReport(context.Background(), false)
+	assert.NoError(t, skipRow(sharedCtx, "global_delay", errColumnType))
+
+	_, lenient := withScanReport(context.Background(), false)
+	assert.NoError(t, lenient.merge(shared))
+	assert.Equal(t, shared.Warnings(), lenient.Warnings())
+
+	_, strict := withScanReport(context.Background(), true)
+	assert.Error(t, strict.merge(shared))
+
+	// Requests without a report ignore skipped rows
+	var none *ScanReport
+	assert.NoError(t, none.merge(shared))
+	assert.False(t, none.Partial())
+}
+
+func TestSkipRowWithoutReport(t *testing.T) {
+	assert.NoError(t, skipRow(context.Background(), "departures", errColumnType))
+}
+
+func TestGetStationStatsSkippedRows(t *testing.T) {
+	data := stationStatsRows()
+	data["station_monthly_stats"] = append(data["station_monthly_stats"], []interface{}{"2024-01", "", errColumnType, uint64(10)})
+	service := NewStationStatsService(newStationStatsConn(0, data))
+
+	ctx, report := withScanReport(context.Background(), false)
+	stats, err := service.GetStationStats(ctx, "de:09162:1", "2023-11-01", "2024-01-01", DefaultStationStatsOptions())
+	assert.NoError(t, err)
+	assert.Len(t, stats.MonthlyStats, 2)
+	assert.Equal(t, []string{"station_monthly_stats: skipped 1 rows"}, report.Warnings())
+
+	ctx, _ = withScanReport(context.Background(), true)
+	_, err = service.GetStationStats(ctx, "de:09162:1", "2023-11-01", "2024-01-01", DefaultStationStatsOptions())
+	var scanErr *ScanError
+	assert.ErrorAs(t, err, &scanErr)
+	assert.Equal(t, "station_monthly_stats", scanErr.Query)
+}
+
+// newPartialGlobalDelayService returns a service whose global delay query has
+// one row that cannot be scanned. The query may run calls times.
+func newPartialGlobalDelayService(calls int) (*ClickHouseService, *MockDriver) {
+	mockConn := &MockDriver{}
+	for i := 0; i < calls; i++ {
+		mockRows := &MockRows{
+			data: [][]interface{}{
+				{"de:09162:1", []map[string]string{
+					{"bucket": "2023-12-25 10:00:00", "avgDelay": "2.5", "numDepartures": "10", "percentageThreshold": "20.0"},
+				}},
+				{"de:09162:2", errColumnType},
+			},
+		}
+		mockRows.On("Err").Return(nil)
+		mockRows.On("Close").Return(nil)
+		mockConn.On("Query", mock.Anything, mock.AnythingOfType("string"),
+			"2023-12-25", "2023-12-26", 60, 5, uint8(1)).Return(mockRows, nil).Once()
+	}
+
+	return &ClickHouseService{
+		conn:        mockConn,
+		lineQueries: NewLineQueryService(mockConn),
+	}, mockConn
+}
+
+func TestGlobalDelayHandlerPartialResult(t *testing.T) {
+	service, mockConn := newPartialGlobalDelayService(2)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(service)
+	originalCache := queryCache
+	queryCache = NewQueryCache(newMemoryCache(10), time.Hour, time.Minute)
+	defer func() {
+		clickhouseService.Store(originalService)
+		queryCache = originalCache
+	}()
+
+	// Partial results are not cached, so both requests query the database
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5", nil)
+		w := httptest.NewRecorder()
+
+		globalDelayGHandler(w, req)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get("X-Partial-Result"))
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+		assert.Equal(t, "global_delay: skipped 1 rows", resp.Header.Get("X-Result-Warning"))
+
+		var days []LineDelayDay
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&days))
+		assert.Len(t, days, 1)
+	}
+
+	mockConn.AssertExpectations(t)
+}
+
+func TestGlobalDelayHandlerStrict(t *testing.T) {
+	service, _ := newPartialGlobalDelayService(1)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(service)
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&strict=true", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+
+	var apiErr APIError
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, errCodeScanFailed, apiErr.Code)
+	assert.Equal(t, map[string]string{"query": "global_delay"}, apiErr.Details)
+	assert.NotContains(t, apiErr.Message, errColumnType.Error())
+}
+
+func TestGlobalDelayHandlerStreamPartialResult(t *testing.T) {
+	service, _ := newPartialGlobalDelayService(1)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(service)
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&format=ndjson", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Trailer.Get("X-Partial-Result"))
+}
+
+func TestGlobalDelayHandlerStreamJSONPartialResult(t *testing.T) {
+	service, _ := newPartialGlobalDelayService(1)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(service)
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/global_delay?date=2023-12-25&interval=60&realtime=1&threshold=5&stream=true", nil)
+	w := httptest.NewRecorder()
+
+	globalDelayGHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The body stays a plain array, the status follows it in the trailers
+	var days []LineDelayDay
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&days))
+	assert.Len(t, days, 1)
+	assert.Equal(t, "true", resp.Trailer.Get("X-Partial-Result"))
+	assert.Equal(t, "global_delay: skipped 1 rows", resp.Trailer.Get("X-Result-Warning"))
+}
+
+func TestStationStatsHandlerPartialResult(t *testing.T) {
+	data := stationStatsRows()
+	data["station_hourly_stats"] = append(data["station_hourly_stats"], []interface{}{uint8(8), "", errColumnType, uint64(10)})
+	conn := newStationStatsConn(0, data)
+
+	originalService := clickhouseService.Load()
+	clickhouseService.Store(&ClickHouseService{
+		conn:         conn,
+		stationStats: NewStationStatsService(conn),
+	})
+	defer func() { clickhouseService.Store(originalService) }()
+
+	req := httptest.NewRequest("GET", "/api/station_stats?station=de:09162:1&startDate=2023-11-01&endDate=2024-01-01", nil)
+	w := httptest.NewRecorder()
+
+	stationStatsHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Partial-Result"))
+
+	var stats StationStats
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.True(t, stats.Partial)
+	assert.Equal(t, []string{"station_hourly_stats: skipped 1 rows"}, stats.Warnings)
+}
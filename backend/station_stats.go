@@ -2,12 +2,45 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"sort"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"golang.org/x/sync/errgroup"
 )
 
+// delayedThresholdMinutes is the default delay above which a departure counts as delayed
+const delayedThresholdMinutes = 2
+
+// basicStatsColumns aggregates average delay, departure count and the share of
+// delayed departures. It expects the delay threshold as its only placeholder.
+const basicStatsColumns = `
+			avg(delayInMinutes) as avgDelay,
+			count() as totalDepartures,
+			CASE 
+				WHEN count() = 0 THEN 0.0
+				ELSE (100.0 * countIf(delayInMinutes > ?)) / count()
+			END as delayPercentage`
+
+// StationStatsOptions controls how station statistics are aggregated
+type StationStatsOptions struct {
+	DayStartHour int   // hour at which days begin, 0 for midnight
+	Threshold    int   // delay in minutes above which a departure counts as delayed
+	BucketEdges  []int // upper bounds of the delay distribution buckets
+	Extended     bool  // add median, p90, p95, max and standard deviation
+}
+
+// DefaultStationStatsOptions returns the options used when a request does not override them
+func DefaultStationStatsOptions() StationStatsOptions {
+	return StationStatsOptions{
+		DayStartHour: 0,
+		Threshold:    delayedThresholdMinutes,
+		BucketEdges:  defaultDelayBucketEdges,
+	}
+}
+
 // StationStatsService handles all station statistics operations
 type StationStatsService struct {
 	conn driver.Conn
@@ -18,52 +51,95 @@ func NewStationStatsService(conn driver.Conn) *StationStatsService {
 	return &StationStatsService{conn: conn}
 }
 
-// GetStationStats retrieves comprehensive statistics for a station within a date range
-func (s *StationStatsService) GetStationStats(stationID, startDate, endDate string) (StationStats, error) {
-	ctx := context.Background()
-	
+// GetStationStats retrieves comprehensive statistics for a station within a date range.
+// The underlying queries are independent and run concurrently; the first failing
+// query cancels the others.
+func (s *StationStatsService) GetStationStats(ctx context.Context, stationID, startDate, endDate string, opts StationStatsOptions) (StationStats, error) {
 	// Validate inputs
 	if err := validateDateRange(startDate, endDate); err != nil {
 		return StationStats{}, fmt.Errorf("invalid date range: %w", err)
 	}
-	
-	// Check if station has any data
-	if err := s.validateStationExists(ctx, stationID); err != nil {
-		return StationStats{}, fmt.Errorf("station validation failed: %w", err)
+	if len(opts.BucketEdges) == 0 {
+		return StationStats{}, fmt.Errorf("at least one delay bucket edge is required")
 	}
-	
-	// Get basic statistics
-	basicStats, err := s.getBasicStats(ctx, stationID, startDate, endDate)
+
+	// Move the range boundaries to the start of the service day
+	startDate, err := shiftToServiceDay(startDate, opts.DayStartHour)
 	if err != nil {
-		return StationStats{}, fmt.Errorf("failed to get basic stats: %w", err)
+		return StationStats{}, fmt.Errorf("invalid date range: %w", err)
 	}
-	
-	// Get monthly statistics
-	monthlyStats, err := s.getMonthlyStats(ctx, stationID, startDate, endDate)
+	endDate, err = shiftToServiceDay(endDate, opts.DayStartHour)
 	if err != nil {
-		return StationStats{}, fmt.Errorf("failed to get monthly stats: %w", err)
+		return StationStats{}, fmt.Errorf("invalid date range: %w", err)
 	}
-	
-	// Get hourly statistics
-	hourlyStats, err := s.getHourlyStats(ctx, stationID, startDate, endDate)
-	if err != nil {
-		return StationStats{}, fmt.Errorf("failed to get hourly stats: %w", err)
+
+	var stats StationStats
+	g, gctx := errgroup.WithContext(ctx)
+	for _, query := range s.stationStatsQueries(stationID, startDate, endDate, opts, &stats) {
+		g.Go(func() error {
+			return query(gctx)
+		})
 	}
-	
-	// Get delay distribution
-	delayDistribution, err := s.getDelayDistribution(ctx, stationID, startDate, endDate)
-	if err != nil {
-		return StationStats{}, fmt.Errorf("failed to get delay distribution: %w", err)
+	if err := g.Wait(); err != nil {
+		return StationStats{}, err
+	}
+
+	return stats, nil
+}
+
+// stationStatsQueries returns the independent queries that make up a
+// StationStats result. Every query writes to its own fields of stats, so
+// they can safely run concurrently.
+func (s *StationStatsService) stationStatsQueries(stationID, startDate, endDate string, opts StationStatsOptions, stats *StationStats) []func(context.Context) error {
+	return []func(context.Context) error{
+		// Check if station has any data
+		func(ctx context.Context) error {
+			if err := s.validateStationExists(ctx, stationID); err != nil {
+				return fmt.Errorf("station validation failed: %w", err)
+			}
+			return nil
+		},
+		// Get basic statistics
+		func(ctx context.Context) error {
+			basicStats, err := s.getBasicStats(ctx, stationID, startDate, endDate, opts.Threshold, opts.Extended)
+			if err != nil {
+				return fmt.Errorf("failed to get basic stats: %w", err)
+			}
+			stats.AvgDelay = basicStats.AvgDelay
+			stats.TotalDepartures = basicStats.TotalDepartures
+			stats.DelayPercentage = basicStats.DelayPercentage
+			stats.Percentiles = basicStats.Percentiles
+			stats.Spread = basicStats.Spread
+			return nil
+		},
+		// Get monthly statistics
+		func(ctx context.Context) error {
+			monthlyStats, err := s.getMonthlyStats(ctx, stationID, startDate, endDate, opts.DayStartHour, opts.Extended)
+			if err != nil {
+				return fmt.Errorf("failed to get monthly stats: %w", err)
+			}
+			stats.MonthlyStats = monthlyStats
+			return nil
+		},
+		// Get hourly statistics
+		func(ctx context.Context) error {
+			hourlyStats, err := s.getHourlyStats(ctx, stationID, startDate, endDate, opts.Extended)
+			if err != nil {
+				return fmt.Errorf("failed to get hourly stats: %w", err)
+			}
+			stats.HourlyStats = hourlyStats
+			return nil
+		},
+		// Get delay distribution
+		func(ctx context.Context) error {
+			delayDistribution, err := s.getDelayDistribution(ctx, stationID, startDate, endDate, opts.BucketEdges)
+			if err != nil {
+				return fmt.Errorf("failed to get delay distribution: %w", err)
+			}
+			stats.DelayDistribution = delayDistribution
+			return nil
+		},
 	}
-	
-	return StationStats{
-		AvgDelay:          basicStats.AvgDelay,
-		TotalDepartures:   basicStats.TotalDepartures,
-		DelayPercentage:   basicStats.DelayPercentage,
-		MonthlyStats:      monthlyStats,
-		HourlyStats:       hourlyStats,
-		DelayDistribution: delayDistribution,
-	}, nil
 }
 
 // basicStatsResult holds basic station statistics
@@ -71,35 +147,34 @@ type basicStatsResult struct {
 	AvgDelay        float64
 	TotalDepartures uint64
 	DelayPercentage float64
+	Percentiles     DelayPercentiles
+	Spread          *DelaySpread
 }
 
-// validateStationExists checks if a station has any data in the database
+// validateStationExists checks if a station has any data in the database.
+// LIMIT 1 lets ClickHouse stop at the first matching row instead of counting
+// the full history of the station.
 func (s *StationStatsService) validateStationExists(ctx context.Context, stationID string) error {
-	var totalCount uint64
-	query := `SELECT count() FROM mvg.responses_dedup WHERE station = ?`
+	var found uint8
+	query := `SELECT 1 FROM mvg.responses_dedup WHERE station = ? LIMIT 1`
 	
-	err := s.conn.QueryRow(ctx, query, stationID).Scan(&totalCount)
+	err := s.conn.QueryRow(withQueryName(ctx, "station_exists"), query, stationID).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &NotFoundError{Param: "station", Value: stationID, Message: "no data found for station " + stationID}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to check station existence: %w", err)
 	}
 	
-	if totalCount == 0 {
-		return fmt.Errorf("no data found for station %s", stationID)
-	}
-	
 	return nil
 }
 
-// getBasicStats retrieves basic statistics for a station
-func (s *StationStatsService) getBasicStats(ctx context.Context, stationID, startDate, endDate string) (basicStatsResult, error) {
+// getBasicStats retrieves basic statistics for a station. Departures delayed
+// by more than threshold minutes count towards the delay percentage.
+func (s *StationStatsService) getBasicStats(ctx context.Context, stationID, startDate, endDate string, threshold int, extended bool) (basicStatsResult, error) {
 	query := `
-		SELECT 
-			avg(delayInMinutes) as avgDelay,
-			count() as totalDepartures,
-			CASE 
-				WHEN count() = 0 THEN 0.0
-				ELSE (100.0 * countIf(delayInMinutes > 2)) / count()
-			END as delayPercentage
+		SELECT ` + basicStatsColumns + `,
+			quantiles(0.5, 0.9, 0.99)(delayInMinutes) as percentiles` + optionalSQL(extended, delaySpreadColumns) + `
 		FROM mvg.responses_dedup 
 		WHERE station = ? 
 		AND plannedDepartureTime >= ? 
@@ -107,39 +182,60 @@ func (s *StationStatsService) getBasicStats(ctx context.Context, stationID, star
 	`
 	
 	var result basicStatsResult
-	err := s.conn.QueryRow(ctx, query, stationID, startDate, endDate).Scan(
-		&result.AvgDelay, &result.TotalDepartures, &result.DelayPercentage)
+	var percentiles []float64
+	var spread delaySpreadScan
+	dest := []interface{}{&result.AvgDelay, &result.TotalDepartures, &result.DelayPercentage, &percentiles}
+	if extended {
+		dest = append(dest, spread.dest()...)
+	}
+	err := s.conn.QueryRow(withQueryName(ctx, "station_basic_stats"), query, threshold, stationID, startDate, endDate).Scan(dest...)
 	
 	if err != nil {
 		return basicStatsResult{}, fmt.Errorf("basic stats query failed: %w", err)
 	}
 	
-	// Handle NaN values that might still occur from avg() with no data
+	// Handle NaN values that might still occur from avg() and quantiles() with no data
 	if result.TotalDepartures == 0 {
 		result.AvgDelay = 0.0
 		result.DelayPercentage = 0.0
+		return result, nil
+	}
+
+	if extended {
+		result.Spread = spread.spread()
+	}
+
+	if len(percentiles) == 3 {
+		result.Percentiles = DelayPercentiles{
+			P50: percentiles[0],
+			P90: percentiles[1],
+			P99: percentiles[2],
+		}
 	}
 	
 	return result, nil
 }
 
-// getMonthlyStats retrieves monthly statistics with line breakdown
-func (s *StationStatsService) getMonthlyStats(ctx context.Context, stationID, startDate, endDate string) ([]MonthlyData, error) {
-	// Get overall monthly stats
+// getMonthlyStats retrieves monthly statistics with line breakdown.
+// Departures before dayStartHour are attributed to the previous day.
+// Month totals and per-line values come from a single GROUPING SETS query;
+// total rows have an empty label since label is not part of their grouping set.
+func (s *StationStatsService) getMonthlyStats(ctx context.Context, stationID, startDate, endDate string, dayStartHour int, extended bool) ([]MonthlyData, error) {
 	monthlyQuery := `
 		SELECT 
-			formatDateTime(toStartOfMonth(plannedDepartureTime), '%Y-%m') as month,
+			formatDateTime(toStartOfMonth(plannedDepartureTime - toIntervalHour(?)), '%Y-%m') as month,
+			label,
 			avg(delayInMinutes) as avgDelay,
-			count() as departures
+			count() as departures` + optionalSQL(extended, delaySpreadColumns) + `
 		FROM mvg.responses_dedup 
 		WHERE station = ? 
 		AND plannedDepartureTime >= ? 
 		AND plannedDepartureTime < ?
-		GROUP BY month
-		ORDER BY month
+		GROUP BY GROUPING SETS ((month), (month, label))
+		ORDER BY month, label
 	`
 	
-	monthlyRows, err := s.conn.Query(ctx, monthlyQuery, stationID, startDate, endDate)
+	monthlyRows, err := s.conn.Query(withQueryName(ctx, "station_monthly_stats"), monthlyQuery, dayStartHour, stationID, startDate, endDate)
 	if err != nil {
 		return nil, fmt.Errorf("monthly stats query failed: %w", err)
 	}
@@ -147,25 +243,48 @@ func (s *StationStatsService) getMonthlyStats(ctx context.Context, stationID, st
 	
 	monthlyMap := make(map[string]*MonthlyData)
 	for monthlyRows.Next() {
-		var month string
+		var month, label string
 		var avgDelay float64
 		var departures uint64
+		var spread delaySpreadScan
+		
+		dest := []interface{}{&month, &label, &avgDelay, &departures}
+		if extended {
+			dest = append(dest, spread.dest()...)
+		}
+		if err := monthlyRows.Scan(dest...); err != nil {
+			if err := skipRow(ctx, "station_monthly_stats", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		
-		if err := monthlyRows.Scan(&month, &avgDelay, &departures); err != nil {
+		monthlyData, exists := monthlyMap[month]
+		if !exists {
+			monthlyData = &MonthlyData{
+				Month:     month,
+				LineStats: make(map[string]LineStats),
+			}
+			monthlyMap[month] = monthlyData
+		}
+		
+		if label != "" {
+			monthlyData.LineStats[label] = LineStats{
+				AvgDelay:   avgDelay,
+				Departures: departures,
+			}
 			continue
 		}
 		
-		monthlyMap[month] = &MonthlyData{
-			Month:      month,
-			AvgDelay:   avgDelay,
-			Departures: departures,
-			LineStats:  make(map[string]LineStats),
+		monthlyData.AvgDelay = avgDelay
+		monthlyData.Departures = departures
+		if extended {
+			monthlyData.Spread = spread.spread()
 		}
 	}
 	
-	// Get line-specific monthly data
-	if err := s.addMonthlyLineStats(ctx, stationID, startDate, endDate, monthlyMap); err != nil {
-		return nil, fmt.Errorf("failed to add monthly line stats: %w", err)
+	if err := monthlyRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating monthly stats: %w", err)
 	}
 	
 	// Convert map to sorted slice
@@ -181,65 +300,24 @@ func (s *StationStatsService) getMonthlyStats(ctx context.Context, stationID, st
 	return monthlyStats, nil
 }
 
-// addMonthlyLineStats adds line-specific statistics to monthly data
-func (s *StationStatsService) addMonthlyLineStats(ctx context.Context, stationID, startDate, endDate string, monthlyMap map[string]*MonthlyData) error {
-	monthlyLineQuery := `
-		SELECT 
-			formatDateTime(toStartOfMonth(plannedDepartureTime), '%Y-%m') as month,
-			label,
-			avg(delayInMinutes) as avgDelay,
-			count() as departures
-		FROM mvg.responses_dedup 
-		WHERE station = ? 
-		AND plannedDepartureTime >= ? 
-		AND plannedDepartureTime < ?
-		GROUP BY month, label
-		ORDER BY month, label
-	`
-	
-	monthlyLineRows, err := s.conn.Query(ctx, monthlyLineQuery, stationID, startDate, endDate)
-	if err != nil {
-		return fmt.Errorf("monthly line stats query failed: %w", err)
-	}
-	defer monthlyLineRows.Close()
-	
-	for monthlyLineRows.Next() {
-		var month, label string
-		var avgDelay float64
-		var departures uint64
-		
-		if err := monthlyLineRows.Scan(&month, &label, &avgDelay, &departures); err != nil {
-			continue
-		}
-		
-		if monthlyData, exists := monthlyMap[month]; exists {
-			monthlyData.LineStats[label] = LineStats{
-				AvgDelay:   avgDelay,
-				Departures: departures,
-			}
-		}
-	}
-	
-	return nil
-}
-
-// getHourlyStats retrieves hourly statistics with line breakdown
-func (s *StationStatsService) getHourlyStats(ctx context.Context, stationID, startDate, endDate string) ([]HourlyData, error) {
-	// Get overall hourly stats
+// getHourlyStats retrieves hourly statistics with line breakdown.
+// Like getMonthlyStats it uses GROUPING SETS, with hour totals on empty labels.
+func (s *StationStatsService) getHourlyStats(ctx context.Context, stationID, startDate, endDate string, extended bool) ([]HourlyData, error) {
 	hourlyQuery := `
 		SELECT 
 			toHour(plannedDepartureTime) as hour,
+			label,
 			avg(delayInMinutes) as avgDelay,
-			count() as departures
+			count() as departures` + optionalSQL(extended, delaySpreadColumns) + `
 		FROM mvg.responses_dedup 
 		WHERE station = ? 
 		AND plannedDepartureTime >= ? 
 		AND plannedDepartureTime < ?
-		GROUP BY hour
-		ORDER BY hour
+		GROUP BY GROUPING SETS ((hour), (hour, label))
+		ORDER BY hour, label
 	`
 	
-	hourlyRows, err := s.conn.Query(ctx, hourlyQuery, stationID, startDate, endDate)
+	hourlyRows, err := s.conn.Query(withQueryName(ctx, "station_hourly_stats"), hourlyQuery, stationID, startDate, endDate)
 	if err != nil {
 		return nil, fmt.Errorf("hourly stats query failed: %w", err)
 	}
@@ -248,24 +326,48 @@ func (s *StationStatsService) getHourlyStats(ctx context.Context, stationID, sta
 	hourlyMap := make(map[uint8]*HourlyData)
 	for hourlyRows.Next() {
 		var hour uint8
+		var label string
 		var avgDelay float64
 		var departures uint64
+		var spread delaySpreadScan
+		
+		dest := []interface{}{&hour, &label, &avgDelay, &departures}
+		if extended {
+			dest = append(dest, spread.dest()...)
+		}
+		if err := hourlyRows.Scan(dest...); err != nil {
+			if err := skipRow(ctx, "station_hourly_stats", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		
-		if err := hourlyRows.Scan(&hour, &avgDelay, &departures); err != nil {
+		hourlyData, exists := hourlyMap[hour]
+		if !exists {
+			hourlyData = &HourlyData{
+				Hour:      hour,
+				LineStats: make(map[string]LineStats),
+			}
+			hourlyMap[hour] = hourlyData
+		}
+		
+		if label != "" {
+			hourlyData.LineStats[label] = LineStats{
+				AvgDelay:   avgDelay,
+				Departures: departures,
+			}
 			continue
 		}
 		
-		hourlyMap[hour] = &HourlyData{
-			Hour:       hour,
-			AvgDelay:   avgDelay,
-			Departures: departures,
-			LineStats:  make(map[string]LineStats),
+		hourlyData.AvgDelay = avgDelay
+		hourlyData.Departures = departures
+		if extended {
+			hourlyData.Spread = spread.spread()
 		}
 	}
 	
-	// Get line-specific hourly data
-	if err := s.addHourlyLineStats(ctx, stationID, startDate, endDate, hourlyMap); err != nil {
-		return nil, fmt.Errorf("failed to add hourly line stats: %w", err)
+	if err := hourlyRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating hourly stats: %w", err)
 	}
 	
 	// Convert map to sorted slice
@@ -281,96 +383,53 @@ func (s *StationStatsService) getHourlyStats(ctx context.Context, stationID, sta
 	return hourlyStats, nil
 }
 
-// addHourlyLineStats adds line-specific statistics to hourly data
-func (s *StationStatsService) addHourlyLineStats(ctx context.Context, stationID, startDate, endDate string, hourlyMap map[uint8]*HourlyData) error {
-	hourlyLineQuery := `
-		SELECT 
-			toHour(plannedDepartureTime) as hour,
-			label,
-			avg(delayInMinutes) as avgDelay,
-			count() as departures
-		FROM mvg.responses_dedup 
-		WHERE station = ? 
-		AND plannedDepartureTime >= ? 
-		AND plannedDepartureTime < ?
-		GROUP BY hour, label
-		ORDER BY hour, label
-	`
-	
-	hourlyLineRows, err := s.conn.Query(ctx, hourlyLineQuery, stationID, startDate, endDate)
-	if err != nil {
-		return fmt.Errorf("hourly line stats query failed: %w", err)
-	}
-	defer hourlyLineRows.Close()
-	
-	for hourlyLineRows.Next() {
-		var hour uint8
-		var label string
-		var avgDelay float64
-		var departures uint64
-		
-		if err := hourlyLineRows.Scan(&hour, &label, &avgDelay, &departures); err != nil {
-			continue
-		}
-		
-		if hourlyData, exists := hourlyMap[hour]; exists {
-			hourlyData.LineStats[label] = LineStats{
-				AvgDelay:   avgDelay,
-				Departures: departures,
-			}
-		}
-	}
-	
-	return nil
-}
-
-// getDelayDistribution retrieves delay distribution statistics
-func (s *StationStatsService) getDelayDistribution(ctx context.Context, stationID, startDate, endDate string) ([]DelayBucket, error) {
+// getDelayDistribution retrieves delay distribution statistics for the buckets
+// bounded by edges, in ascending order of delay
+func (s *StationStatsService) getDelayDistribution(ctx context.Context, stationID, startDate, endDate string, edges []int) ([]DelayBucket, error) {
+	bucketExpr, bucketArgs := delayBucketExpr(edges)
 	distributionQuery := `
 		SELECT 
-			CASE 
-				WHEN delayInMinutes <= 0 THEN 'On Time'
-				WHEN delayInMinutes <= 2 THEN '1-2 min'
-				WHEN delayInMinutes <= 5 THEN '3-5 min'
-				WHEN delayInMinutes <= 10 THEN '6-10 min'
-				ELSE '10+ min'
-			END as delayRange,
+			` + bucketExpr + ` as bucketIndex,
 			count() as count
 		FROM mvg.responses_dedup 
 		WHERE station = ? 
 		AND plannedDepartureTime >= ? 
 		AND plannedDepartureTime < ?
-		GROUP BY delayRange
-		ORDER BY 
-			CASE delayRange
-				WHEN 'On Time' THEN 1
-				WHEN '1-2 min' THEN 2
-				WHEN '3-5 min' THEN 3
-				WHEN '6-10 min' THEN 4
-				WHEN '10+ min' THEN 5
-			END
+		GROUP BY bucketIndex
+		ORDER BY bucketIndex
 	`
 	
-	distributionRows, err := s.conn.Query(ctx, distributionQuery, stationID, startDate, endDate)
+	args := append(bucketArgs, stationID, startDate, endDate)
+	distributionRows, err := s.conn.Query(withQueryName(ctx, "station_delay_distribution"), distributionQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("delay distribution query failed: %w", err)
 	}
 	defer distributionRows.Close()
 	
+	labels := delayBucketLabels(edges)
 	var delayDistribution []DelayBucket
 	for distributionRows.Next() {
-		var delayRange string
+		var bucketIndex uint32
 		var count uint64
 		
-		if err := distributionRows.Scan(&delayRange, &count); err != nil {
+		if err := distributionRows.Scan(&bucketIndex, &count); err != nil {
+			if err := skipRow(ctx, "station_delay_distribution", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if int(bucketIndex) >= len(labels) {
 			continue
 		}
 		
 		delayDistribution = append(delayDistribution, DelayBucket{
-			Range: delayRange,
+			Range: labels[bucketIndex],
 			Count: count,
 		})
 	}
+	if err := distributionRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating delay distribution: %w", err)
+	}
 	
 	// Initialize empty slice if nil to prevent frontend null errors
 	if delayDistribution == nil {
@@ -379,4 +438,3 @@ func (s *StationStatsService) getDelayDistribution(ctx context.Context, stationI
 	
 	return delayDistribution, nil
 }
-
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// stationStatsRows returns the rows of the station statistics queries for
+// de:09162:1 between 2023-11-01 and 2024-01-01, by query name
+func stationStatsRows() map[string][][]interface{} {
+	return map[string][][]interface{}{
+		"station_exists": {{uint8(1)}},
+		"station_basic_stats": {
+			{1.5, uint64(300), 12.0, []float64{1, 4, 9}},
+		},
+		"station_monthly_stats": {
+			{"2023-11", "", 1.2, uint64(100)},
+			{"2023-11", "U1", 1.0, uint64(60)},
+			{"2023-11", "U2", 1.5, uint64(40)},
+			{"2023-12", "", 1.65, uint64(200)},
+			{"2023-12", "U1", 1.65, uint64(200)},
+		},
+		"station_hourly_stats": {
+			{uint8(7), "", 2.0, uint64(120)},
+			{uint8(7), "U1", 2.0, uint64(120)},
+			{uint8(6), "", 1.0, uint64(180)},
+		},
+		"station_delay_distribution": {
+			{uint32(0), uint64(200)},
+			{uint32(1), uint64(64)},
+			{uint32(4), uint64(36)},
+		},
+	}
+}
+
+// newStationStatsConn returns a connection answering the station statistics
+// queries with data after an artificial round-trip latency, so that
+// concurrency effects become measurable. A query without rows in data fails
+// with sql.ErrNoRows for QueryRow.
+func newStationStatsConn(latency time.Duration, data map[string][][]interface{}) *MockDriver {
+	wait := func(ctx context.Context) error {
+		select {
+		case <-time.After(latency):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	row := func(name string) func(context.Context) driver.Row {
+		return func(ctx context.Context) driver.Row {
+			if err := wait(ctx); err != nil {
+				return &MockRow{err: err}
+			}
+			if len(data[name]) == 0 {
+				return &MockRow{err: sql.ErrNoRows}
+			}
+			return &MockRow{data: data[name][0]}
+		}
+	}
+	rows := func(name string) func(context.Context) (driver.Rows, error) {
+		return func(ctx context.Context) (driver.Rows, error) {
+			if err := wait(ctx); err != nil {
+				return nil, err
+			}
+			return newMockRows(data[name]...), nil
+		}
+	}
+
+	const station, start, end = "de:09162:1", "2023-11-01", "2024-01-01"
+	opts := DefaultStationStatsOptions()
+	_, bucketArgs := delayBucketExpr(opts.BucketEdges)
+	distributionArgs := append([]interface{}{queryNamed("station_delay_distribution"), mock.Anything}, bucketArgs...)
+
+	conn := &MockDriver{}
+	conn.On("QueryRow", queryNamed("station_exists"), mock.Anything, station).
+		Return(row("station_exists"))
+	conn.On("QueryRow", queryNamed("station_basic_stats"), mock.Anything, opts.Threshold, station, start, end).
+		Return(row("station_basic_stats"))
+	conn.On("Query", queryNamed("station_monthly_stats"), mock.Anything, opts.DayStartHour, station, start, end).
+		Return(rows("station_monthly_stats"), nil)
+	conn.On("Query", queryNamed("station_hourly_stats"), mock.Anything, station, start, end).
+		Return(rows("station_hourly_stats"), nil)
+	conn.On("Query", append(distributionArgs, station, start, end)...).
+		Return(rows("station_delay_distribution"), nil)
+	return conn
+}
+
+func TestGetStationStats(t *testing.T) {
+	conn := newStationStatsConn(0, stationStatsRows())
+	service := NewStationStatsService(conn)
+
+	stats, err := service.GetStationStats(context.Background(), "de:09162:1", "2023-11-01", "2024-01-01", DefaultStationStatsOptions())
+	assert.NoError(t, err)
+	conn.AssertExpectations(t)
+	assert.Len(t, conn.Calls, 5)
+
+	assert.Equal(t, 1.5, stats.AvgDelay)
+	assert.Equal(t, uint64(300), stats.TotalDepartures)
+	assert.Equal(t, DelayPercentiles{P50: 1, P90: 4, P99: 9}, stats.Percentiles)
+	assert.Nil(t, stats.Spread)
+
+	assert.Equal(t, []MonthlyData{
+		{Month: "2023-11", AvgDelay: 1.2, Departures: 100, LineStats: map[string]LineStats{
+			"U1": {AvgDelay: 1.0, Departures: 60},
+			"U2": {AvgDelay: 1.5, Departures: 40},
+		}},
+		{Month: "2023-12", AvgDelay: 1.65, Departures: 200, LineStats: map[string]LineStats{
+			"U1": {AvgDelay: 1.65, Departures: 200},
+		}},
+	}, stats.MonthlyStats)
+
+	assert.Len(t, stats.HourlyStats, 2)
+	assert.Equal(t, uint8(6), stats.HourlyStats[0].Hour)
+	assert.Empty(t, stats.HourlyStats[0].LineStats)
+	assert.Equal(t, uint8(7), stats.HourlyStats[1].Hour)
+	assert.Equal(t, uint64(120), stats.HourlyStats[1].LineStats["U1"].Departures)
+
+	assert.Equal(t, []DelayBucket{
+		{Range: "On Time", Count: 200},
+		{Range: "1-2 min", Count: 64},
+		{Range: "10+ min", Count: 36},
+	}, stats.DelayDistribution)
+}
+
+func TestGetStationStatsUnknownStation(t *testing.T) {
+	// The other queries run concurrently and still find rows
+	data := stationStatsRows()
+	delete(data, "station_exists")
+	service := NewStationStatsService(newStationStatsConn(0, data))
+
+	_, err := service.GetStationStats(context.Background(), "de:09162:1", "2023-11-01", "2024-01-01", DefaultStationStatsOptions())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no data found for station")
+}
+
+func TestGetDelayDistributionInterrupted(t *testing.T) {
+	edges := DefaultStationStatsOptions().BucketEdges
+	_, bucketArgs := delayBucketExpr(edges)
+	args := append([]interface{}{queryNamed("station_delay_distribution"), mock.Anything}, bucketArgs...)
+
+	// The first bucket arrives before the connection breaks
+	rows := &MockRows{data: stationStatsRows()["station_delay_distribution"][:1]}
+	rows.On("Err").Return(context.Canceled)
+	rows.On("Close").Return(nil)
+	conn := &MockDriver{}
+	conn.On("Query", append(args, "de:09162:1", "2023-11-01", "2024-01-01")...).Return(rows, nil)
+
+	distribution, err := NewStationStatsService(conn).getDelayDistribution(context.Background(), "de:09162:1", "2023-11-01", "2024-01-01", edges)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, distribution, "a truncated distribution is not returned")
+}
+
+// The benchmarks simulate a 2ms round trip per query. Running the queries
+// concurrently bounds the latency by the slowest query instead of their sum.
+const benchmarkQueryLatency = 2 * time.Millisecond
+
+func BenchmarkGetStationStats(b *testing.B) {
+	service := NewStationStatsService(newStationStatsConn(benchmarkQueryLatency, stationStatsRows()))
+	opts := DefaultStationStatsOptions()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := service.GetStationStats(context.Background(), "de:09162:1", "2023-11-01", "2024-01-01", opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetStationStatsSequential(b *testing.B) {
+	service := NewStationStatsService(newStationStatsConn(benchmarkQueryLatency, stationStatsRows()))
+	opts := DefaultStationStatsOptions()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var stats StationStats
+		for _, query := range service.stationStatsQueries("de:09162:1", "2023-11-01", "2024-01-01", opts, &stats) {
+			if err := query(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConfig configures TLS for a connection to ClickHouse or Redis. The env
+// tags are appended to the env prefix of the field holding the TLSConfig.
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" env:"ENABLED" help:"connect with TLS"`
+	CAFile             string `yaml:"caFile" env:"CA_FILE" help:"PEM file with the CAs that issued the server certificate, the system CAs if empty"`
+	CertFile           string `yaml:"certFile" env:"CERT_FILE" help:"PEM file with the client certificate"`
+	KeyFile            string `yaml:"keyFile" env:"KEY_FILE" help:"PEM file with the key of the client certificate"`
+	ServerName         string `yaml:"serverName" env:"SERVER_NAME" help:"name the server certificate is verified against, the host if empty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" env:"INSECURE_SKIP_VERIFY" help:"accept any server certificate, for development only"`
+}
+
+// load reads the certificates and returns the TLS configuration, nil if TLS
+// is disabled
+func (c TLSConfig) load() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("client certificate needs both certFile and keyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// validate reports settings that have no effect or cannot be loaded, path
+// is the YAML path of the configuration
+func (c TLSConfig) validate(path string) error {
+	if !c.Enabled {
+		if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify {
+			return fmt.Errorf("%s is configured but not enabled", path)
+		}
+		return nil
+	}
+	if _, err := c.load(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate, written to PEM files
+type testPKI struct {
+	caFile, certFile, keyFile string // CA and client certificate
+	server                    *tls.Config
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+		return path
+	}
+
+	client := issue(2, "mvg-observer", x509.ExtKeyUsageClientAuth)
+	clientKey, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	return testPKI{
+		caFile:   writePEM("ca.pem", "CERTIFICATE", caDER),
+		certFile: writePEM("client.pem", "CERTIFICATE", client.Certificate[0]),
+		keyFile:  writePEM("client-key.pem", "PRIVATE KEY", clientKey),
+		server: &tls.Config{
+			Certificates: []tls.Certificate{issue(3, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		},
+	}
+}
+
+func (p testPKI) clientConfig() TLSConfig {
+	return TLSConfig{Enabled: true, CAFile: p.caFile, CertFile: p.certFile, KeyFile: p.keyFile}
+}
+
+func TestTLSConfigLoad(t *testing.T) {
+	pki := newTestPKI(t)
+
+	config, err := TLSConfig{}.load()
+	assert.NoError(t, err)
+	assert.Nil(t, config, "disabled")
+
+	config, err = pki.clientConfig().load()
+	require.NoError(t, err)
+	assert.NotNil(t, config.RootCAs)
+	assert.Len(t, config.Certificates, 1)
+	assert.False(t, config.InsecureSkipVerify)
+
+	config, err = TLSConfig{Enabled: true, InsecureSkipVerify: true}.load()
+	require.NoError(t, err)
+	assert.Nil(t, config.RootCAs, "system CAs")
+	assert.True(t, config.InsecureSkipVerify)
+
+	_, err = TLSConfig{Enabled: true, CertFile: pki.certFile}.load()
+	assert.EqualError(t, err, "client certificate needs both certFile and keyFile")
+
+	_, err = TLSConfig{Enabled: true, CAFile: pki.keyFile}.load()
+	assert.EqualError(t, err, "no certificates in CA file "+pki.keyFile)
+
+	assert.NoError(t, pki.clientConfig().validate("redis.tls"))
+	assert.ErrorContains(t, TLSConfig{Enabled: true, CAFile: "missing.pem"}.validate("redis.tls"), "redis.tls: reading CA file")
+}
+
+// serveRESP is a Redis stand-in answering PING and accepting AUTH. HELLO is
+// unknown, so clients fall back to AUTH. It returns the address and the
+// commands received.
+func serveRESP(t *testing.T, config *tls.Config) (string, func() [][]string) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var commands [][]string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					command, err := readRESPCommand(reader)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					commands = append(commands, command)
+					mu.Unlock()
+
+					switch strings.ToUpper(command[0]) {
+					case "HELLO":
+						fmt.Fprint(conn, "-ERR unknown command 'HELLO'\r\n")
+					case "PING":
+						fmt.Fprint(conn, "+PONG\r\n")
+					default:
+						fmt.Fprint(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return commands
+	}
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		return strings.TrimSuffix(line, "\r\n"), err
+	}
+
+	header, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimPrefix(header, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	command := make([]string, count)
+	for i := range command {
+		if _, err := readLine(); err != nil { // $<length>
+			return nil, err
+		}
+		if command[i], err = readLine(); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+func TestRedisClientTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	address, commands := serveRESP(t, pki.server)
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+
+	config := defaultConfig().Redis
+	config.Host, config.Port = host, port
+	config.Username, config.Password = "observer", "secret"
+	config.TLS = pki.clientConfig()
+
+	client, err := newRedisClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Ping(context.Background()).Err())
+	assert.Contains(t, commands(), []string{"auth", "observer", "secret"})
+
+	// Without the client certificate the stand-in rejects the handshake
+	config.TLS.CertFile, config.TLS.KeyFile = "", ""
+	client, err = newRedisClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Error(t, client.Ping(context.Background()).Err())
+}
+
+func TestConnectClickhouseHTTPTLS(t *testing.T) {
+	pki := newTestPKI(t)
+
+	type request struct {
+		user, database, clientCert string
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{
+			user:       r.Header.Get("X-ClickHouse-User"),
+			database:   r.URL.Query().Get("database"),
+			clientCert: r.TLS.PeerCertificates[0].Subject.CommonName,
+		}
+		http.Error(w, "Code: 516. DB::Exception: stand-in", http.StatusInternalServerError)
+	}))
+	server.TLS = pki.server
+	server.StartTLS()
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	config := defaultConfig().ClickHouse
+	config.Host, config.Port = host, port
+	config.Protocol = "http"
+	config.TLS = pki.clientConfig()
+
+	_, err = connectClickhouse(config)
+	assert.ErrorContains(t, err, "stand-in")
+
+	select {
+	case r := <-requests:
+		assert.Equal(t, request{user: "mvgobserver", database: "mvg", clientCert: "mvg-observer"}, r)
+	default:
+		t.Fatal("the stand-in received no request")
+	}
+}
+
+func TestConnectClickhouseNativeTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", pki.server)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The stand-in completes the handshake and hangs up
+	clientCert := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() == nil {
+			clientCert <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	config := defaultConfig().ClickHouse
+	config.Host, config.Port = host, port
+	config.TLS = pki.clientConfig()
+
+	_, err = connectClickhouse(config)
+	assert.Error(t, err)
+
+	select {
+	case name := <-clientCert:
+		assert.Equal(t, "mvg-observer", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no TLS handshake with the stand-in")
+	}
+}
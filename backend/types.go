@@ -13,12 +13,32 @@ type LineDelayDay struct {
 
 // StationStats contains comprehensive statistics for a station
 type StationStats struct {
-	AvgDelay          float64       `json:"avgDelay"`
-	TotalDepartures   uint64        `json:"totalDepartures"`
-	DelayPercentage   float64       `json:"delayPercentage"`
-	MonthlyStats      []MonthlyData `json:"monthlyStats"`
-	HourlyStats       []HourlyData  `json:"hourlyStats"`
-	DelayDistribution []DelayBucket `json:"delayDistribution"`
+	AvgDelay          float64          `json:"avgDelay"`
+	TotalDepartures   uint64           `json:"totalDepartures"`
+	DelayPercentage   float64          `json:"delayPercentage"`
+	Percentiles       DelayPercentiles `json:"percentiles"`
+	Spread            *DelaySpread     `json:"spread,omitempty"`
+	MonthlyStats      []MonthlyData    `json:"monthlyStats"`
+	HourlyStats       []HourlyData     `json:"hourlyStats"`
+	DelayDistribution []DelayBucket    `json:"delayDistribution"`
+	ResultStatus
+}
+
+// DelayPercentiles contains delay percentiles in minutes
+type DelayPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// DelaySpread contains robust delay statistics in minutes. It is only
+// included in responses when extended statistics are requested.
+type DelaySpread struct {
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stdDev"`
 }
 
 // MonthlyData represents aggregated monthly statistics
@@ -26,6 +46,7 @@ type MonthlyData struct {
 	Month      string               `json:"month"`
 	AvgDelay   float64              `json:"avgDelay"`
 	Departures uint64               `json:"departures"`
+	Spread     *DelaySpread         `json:"spread,omitempty"`
 	LineStats  map[string]LineStats `json:"lineStats"`
 }
 
@@ -34,6 +55,7 @@ type HourlyData struct {
 	Hour       uint8                `json:"hour"`
 	AvgDelay   float64              `json:"avgDelay"`
 	Departures uint64               `json:"departures"`
+	Spread     *DelaySpread         `json:"spread,omitempty"`
 	LineStats  map[string]LineStats `json:"lineStats"`
 }
 
@@ -47,4 +69,97 @@ type LineStats struct {
 type DelayBucket struct {
 	Range string `json:"range"`
 	Count uint64 `json:"count"`
-}
\ No newline at end of file
+}
+
+// LineStatsReport contains comprehensive statistics for a subway line
+type LineStatsReport struct {
+	Label                 string               `json:"label"`
+	AvgDelay              float64              `json:"avgDelay"`
+	TotalDepartures       uint64               `json:"totalDepartures"`
+	PunctualityPercentage float64              `json:"punctualityPercentage"`
+	MonthlyStats          []LineMonthlyData    `json:"monthlyStats"`
+	HourlyStats           []LineHourlyData     `json:"hourlyStats"`
+	WorstStations         []StationDelayData   `json:"worstStations"`
+	DirectionDistribution []DirectionDelayData `json:"directionDistribution"`
+	ResultStatus
+}
+
+// LineMonthlyData represents aggregated monthly statistics for a line
+type LineMonthlyData struct {
+	Month                 string  `json:"month"`
+	AvgDelay              float64 `json:"avgDelay"`
+	Departures            uint64  `json:"departures"`
+	PunctualityPercentage float64 `json:"punctualityPercentage"`
+}
+
+// LineHourlyData represents aggregated hourly statistics for a line
+type LineHourlyData struct {
+	Hour                  uint8   `json:"hour"`
+	AvgDelay              float64 `json:"avgDelay"`
+	Departures            uint64  `json:"departures"`
+	PunctualityPercentage float64 `json:"punctualityPercentage"`
+}
+
+// StationDelayData contains delay statistics for a station on a line
+type StationDelayData struct {
+	Station               string  `json:"station"`
+	Name                  string  `json:"name"`
+	AvgDelay              float64 `json:"avgDelay"`
+	Departures            uint64  `json:"departures"`
+	PunctualityPercentage float64 `json:"punctualityPercentage"`
+}
+
+// DirectionDelayData contains the delay distribution for one direction of a line,
+// named after the terminus it travels to
+type DirectionDelayData struct {
+	Direction    string        `json:"direction"`
+	Southbound   bool          `json:"southbound"`
+	AvgDelay     float64       `json:"avgDelay"`
+	Departures   uint64        `json:"departures"`
+	Distribution []DelayBucket `json:"distribution"`
+}
+
+// Rankings contains network-wide leaderboards for stations and lines
+type Rankings struct {
+	StartDate     string            `json:"startDate"`
+	EndDate       string            `json:"endDate"`
+	MinDepartures uint64            `json:"minDepartures"`
+	Stations      RankingCategories `json:"stations"`
+	Lines         RankingCategories `json:"lines"`
+	ResultStatus
+}
+
+// RankingCategories groups leaderboards by the metric they are ranked on
+type RankingCategories struct {
+	AvgDelay    RankingList `json:"avgDelay"`
+	Punctuality RankingList `json:"punctuality"`
+	Departures  RankingList `json:"departures"`
+}
+
+// RankingList holds the entries with the highest (top) and lowest (bottom) metric values
+type RankingList struct {
+	Top    []RankingEntry `json:"top"`
+	Bottom []RankingEntry `json:"bottom"`
+}
+
+// RankingEntry contains the statistics of a single station or line
+type RankingEntry struct {
+	ID                    string  `json:"id"`
+	Name                  string  `json:"name,omitempty"`
+	AvgDelay              float64 `json:"avgDelay"`
+	Departures            uint64  `json:"departures"`
+	PunctualityPercentage float64 `json:"punctualityPercentage"`
+}
+
+// ResultStatus flags responses that are missing rows which could not be
+// read from the database, see ScanReport
+type ResultStatus struct {
+	Partial  bool     `json:"partial,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// setScanReport copies the outcome of a ScanReport into the status
+func (s *ResultStatus) setScanReport(report *ScanReport) {
+	s.Partial = report.Partial()
+	s.Warnings = report.Warnings()
+}
@@ -5,6 +5,10 @@ import (
 	"time"
 )
 
+// serviceDayStartHour is the hour at which an operating day begins in
+// service-day mode. Departures before this hour belong to the previous day.
+const serviceDayStartHour = 3
+
 // getDayRange converts a date string to start and end of day timestamps
 // Input format: "2006-01-02"
 // Returns: start and end of day in "2006-01-02" format
@@ -14,7 +18,11 @@ func getDayRange(dateStr string) (startOfDay, endOfDay string, err error) {
 	// Parse the input date
 	t, err := time.Parse(layout, dateStr)
 	if err != nil {
-		return "", "", fmt.Errorf("invalid date format '%s', expected YYYY-MM-DD: %w", dateStr, err)
+		return "", "", &ValidationError{
+			Code:    errCodeInvalidDate,
+			Message: fmt.Sprintf("invalid date format '%s', expected YYYY-MM-DD", dateStr),
+			Err:     err,
+		}
 	}
 
 	// Create start of day (midnight)
@@ -32,27 +40,87 @@ func getDayRange(dateStr string) (startOfDay, endOfDay string, err error) {
 	return startOfDay, endOfDay, nil
 }
 
-// validateDateRange checks if start and end dates are valid
+// getServiceDayRange works like getDayRange, but cuts the day at startHour
+// instead of midnight. A startHour of 0 yields plain calendar days.
+// Returns: start and end of the service day in "2006-01-02 15:04:05" format
+func getServiceDayRange(dateStr string, startHour int) (startOfDay, endOfDay string, err error) {
+	startOfDay, endOfDay, err = getDayRange(dateStr)
+	if err != nil {
+		return "", "", err
+	}
+
+	startOfDay, err = shiftToServiceDay(startOfDay, startHour)
+	if err != nil {
+		return "", "", err
+	}
+	endOfDay, err = shiftToServiceDay(endOfDay, startHour)
+	if err != nil {
+		return "", "", err
+	}
+
+	return startOfDay, endOfDay, nil
+}
+
+// shiftToServiceDay moves a "2006-01-02" day boundary to the start of the
+// service day beginning at startHour. Dates are returned unchanged for 0.
+func shiftToServiceDay(date string, startHour int) (string, error) {
+	if startHour < 0 || startHour > 23 {
+		return "", invalidParamError("serviceDay", "start hour %d must be between 0 and 23", startHour)
+	}
+	if startHour == 0 {
+		return date, nil
+	}
+
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "", &ValidationError{
+			Code:    errCodeInvalidDate,
+			Message: fmt.Sprintf("invalid date format '%s', expected YYYY-MM-DD", date),
+			Err:     err,
+		}
+	}
+
+	return t.Add(time.Duration(startHour) * time.Hour).Format("2006-01-02 15:04:05"), nil
+}
+
+// validateDateRange checks if start and end dates are valid. Invalid ranges
+// are reported as a *ValidationError.
 func validateDateRange(startDate, endDate string) error {
 	const layout = "2006-01-02"
 	
 	start, err := time.Parse(layout, startDate)
 	if err != nil {
-		return fmt.Errorf("invalid start date format: %w", err)
+		return &ValidationError{
+			Code:    errCodeInvalidDate,
+			Fields:  map[string]string{"startDate": "must be a date in YYYY-MM-DD format"},
+			Message: fmt.Sprintf("invalid start date format '%s', expected YYYY-MM-DD", startDate),
+			Err:     err,
+		}
 	}
 	
 	end, err := time.Parse(layout, endDate)
 	if err != nil {
-		return fmt.Errorf("invalid end date format: %w", err)
+		return &ValidationError{
+			Code:    errCodeInvalidDate,
+			Fields:  map[string]string{"endDate": "must be a date in YYYY-MM-DD format"},
+			Message: fmt.Sprintf("invalid end date format '%s', expected YYYY-MM-DD", endDate),
+			Err:     err,
+		}
 	}
 	
 	if start.After(end) {
-		return fmt.Errorf("start date %s is after end date %s", startDate, endDate)
+		return &ValidationError{
+			Code:    errCodeInvalidDateRange,
+			Message: fmt.Sprintf("start date %s is after end date %s", startDate, endDate),
+		}
 	}
 	
 	// Warn if date range is too large (more than 1 year)
 	if end.Sub(start) > 365*24*time.Hour {
-		return fmt.Errorf("date range too large: %v days (max 365)", int(end.Sub(start).Hours()/24))
+		return &ValidationError{
+			Code:    errCodeInvalidDateRange,
+			Message: fmt.Sprintf("date range too large: %v days (max 365)", int(end.Sub(start).Hours()/24)),
+		}
 	}
 	
 	return nil
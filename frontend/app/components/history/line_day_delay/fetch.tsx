@@ -1,5 +1,5 @@
 import { getGlobalDelayUrl, getLineDelayUrl } from "~/lib/api"
-import { ChartSettings } from "~/types/history"
+import { ChartSettings, StationBucketList } from "~/types/history"
 import { format } from "date-fns"
 
 export async function fetchLineDelay(
@@ -17,7 +17,13 @@ export async function fetchLineDelay(
   })
 
   const response = await fetch(url)
-  const data = await response.json()
+  const data: StationBucketList[] = await response.json()
+  if (response.headers.get("X-Partial-Result") === "true") {
+    console.warn(
+      "Partial line delay data:",
+      response.headers.get("X-Result-Warning")
+    )
+  }
   return data
 }
 
@@ -31,6 +37,12 @@ export async function fetchGlobalDelay(settings: ChartSettings) {
   })
 
   const response = await fetch(url)
-  const data = await response.json()
+  const data: StationBucketList[] = await response.json()
+  if (response.headers.get("X-Partial-Result") === "true") {
+    console.warn(
+      "Partial global delay data:",
+      response.headers.get("X-Result-Warning")
+    )
+  }
   return data
 }
@@ -0,0 +1,886 @@
+/**
+ * This file was auto-generated by openapi-typescript.
+ * Do not make direct changes to the file.
+ */
+
+export interface paths {
+    "/api/line_delay": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Delay buckets of every station of a line on one day */
+        get: operations["getLineDelay"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/global_delay": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Delay buckets of every station on one day */
+        get: operations["getGlobalDelay"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/station_stats": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Delay statistics of a station */
+        get: operations["getStationStats"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/line_stats": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Delay statistics of a line */
+        get: operations["getLineStats"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/rankings": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Network-wide leaderboards of stations and lines */
+        get: operations["getRankings"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/export/departures": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Raw recorded departures, ordered by planned departure time */
+        get: operations["exportDepartures"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/events": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Live departures as server-sent events */
+        get: operations["subscribeEvents"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/health": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Liveness check */
+        get: operations["getHealth"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/health/live": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Liveness check that does not depend on ClickHouse or Redis */
+        get: operations["getLiveness"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/health/ready": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /**
+         * Readiness check of ClickHouse, Redis and the live event stream
+         * @description Checks are ok, warn or fail. A warning marks the instance as degraded, a failure as not ready.
+         */
+        get: operations["getReadiness"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/cache_stats": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** Hits and misses of the query result cache per endpoint */
+        get: operations["getCacheStats"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/api/openapi.json": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** This document */
+        get: operations["getOpenAPI"];
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+}
+export type webhooks = Record<string, never>;
+export interface components {
+    schemas: {
+        APIError: {
+            /** @enum {string} */
+            code: "missing_parameter" | "invalid_parameter" | "invalid_date" | "invalid_date_range" | "not_found" | "service_unavailable" | "query_timeout" | "scan_failed" | "internal_error";
+            message: string;
+            details?: {
+                [key: string]: string;
+            };
+            requestId?: string;
+        };
+        CacheStats: {
+            hits: number;
+            misses: number;
+        };
+        HealthReport: {
+            /** @enum {string} */
+            status: "ok" | "warn" | "fail";
+            /** @description Checks by name: clickhouse, redis, keyspace_notifications, last_event and event_stream */
+            checks?: {
+                [key: string]: components["schemas"]["HealthCheck"];
+            };
+        };
+        HealthCheck: {
+            /** @enum {string} */
+            status: "ok" | "warn" | "fail";
+            message?: string;
+            latencyMs: number;
+            /** @description Time since the last departure event was published */
+            ageSeconds?: number;
+            /** @description Number of entries in the event stream */
+            length?: number;
+        };
+        Coordinates: {
+            longitude: string;
+            latitude: string;
+        };
+        LineDelayDay: {
+            station: string;
+            name: string;
+            stop: number;
+            coordinates: components["schemas"]["Coordinates"];
+            /** @description Maps bucket, avgDelay, numDepartures and percentageThreshold to their values. Extended requests add medianDelay, p90Delay, p95Delay, maxDelay and stddevDelay. */
+            buckets: {
+                [key: string]: string;
+            }[];
+        };
+        DepartureRecord: {
+            station: string;
+            label: string;
+            destination: string;
+            /** Format: date-time */
+            plannedDepartureTime: string;
+            delayInMinutes: number;
+            realtime: boolean;
+        };
+        StationStats: {
+            avgDelay: number;
+            totalDepartures: number;
+            delayPercentage: number;
+            percentiles: components["schemas"]["DelayPercentiles"];
+            spread?: components["schemas"]["DelaySpread"];
+            monthlyStats: components["schemas"]["MonthlyData"][];
+            hourlyStats: components["schemas"]["HourlyData"][];
+            delayDistribution: components["schemas"]["DelayBucket"][];
+            partial?: boolean;
+            warnings?: string[];
+        };
+        DelayPercentiles: {
+            p50: number;
+            p90: number;
+            p99: number;
+        };
+        /** @description Only included when extended statistics are requested */
+        DelaySpread: {
+            median: number;
+            p90: number;
+            p95: number;
+            max: number;
+            stdDev: number;
+        };
+        MonthlyData: {
+            month: string;
+            avgDelay: number;
+            departures: number;
+            spread?: components["schemas"]["DelaySpread"];
+            lineStats: {
+                [key: string]: components["schemas"]["LineStats"];
+            };
+        };
+        HourlyData: {
+            hour: number;
+            avgDelay: number;
+            departures: number;
+            spread?: components["schemas"]["DelaySpread"];
+            lineStats: {
+                [key: string]: components["schemas"]["LineStats"];
+            };
+        };
+        LineStats: {
+            avgDelay: number;
+            departures: number;
+        };
+        DelayBucket: {
+            range: string;
+            count: number;
+        };
+        LineStatsReport: {
+            label: string;
+            avgDelay: number;
+            totalDepartures: number;
+            punctualityPercentage: number;
+            monthlyStats: components["schemas"]["LineMonthlyData"][];
+            hourlyStats: components["schemas"]["LineHourlyData"][];
+            worstStations: components["schemas"]["StationDelayData"][];
+            directionDistribution: components["schemas"]["DirectionDelayData"][];
+            partial?: boolean;
+            warnings?: string[];
+        };
+        LineMonthlyData: {
+            month: string;
+            avgDelay: number;
+            departures: number;
+            punctualityPercentage: number;
+        };
+        LineHourlyData: {
+            hour: number;
+            avgDelay: number;
+            departures: number;
+            punctualityPercentage: number;
+        };
+        StationDelayData: {
+            station: string;
+            name: string;
+            avgDelay: number;
+            departures: number;
+            punctualityPercentage: number;
+        };
+        DirectionDelayData: {
+            /** @description Terminus the direction travels to */
+            direction: string;
+            /** @description Direction of travel, as the south parameter of the line delay */
+            southbound: boolean;
+            avgDelay: number;
+            departures: number;
+            distribution: components["schemas"]["DelayBucket"][];
+        };
+        Rankings: {
+            startDate: string;
+            endDate: string;
+            minDepartures: number;
+            stations: components["schemas"]["RankingCategories"];
+            lines: components["schemas"]["RankingCategories"];
+            partial?: boolean;
+            warnings?: string[];
+        };
+        RankingCategories: {
+            avgDelay: components["schemas"]["RankingList"];
+            punctuality: components["schemas"]["RankingList"];
+            departures: components["schemas"]["RankingList"];
+        };
+        /** @description The entries with the highest (top) and lowest (bottom) metric values */
+        RankingList: {
+            top: components["schemas"]["RankingEntry"][];
+            bottom: components["schemas"]["RankingEntry"][];
+        };
+        RankingEntry: {
+            id: string;
+            name?: string;
+            avgDelay: number;
+            departures: number;
+            punctualityPercentage: number;
+        };
+    };
+    responses: {
+        /** @description Delay buckets per station */
+        LineDelayDays: {
+            headers: {
+                "X-Partial-Result"?: components["headers"]["X-Partial-Result"];
+                "X-Result-Warning"?: components["headers"]["X-Result-Warning"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["LineDelayDay"][];
+                "application/x-ndjson": components["schemas"]["LineDelayDay"];
+                "text/csv": string;
+                "application/vnd.apache.parquet": string;
+            };
+        };
+        /** @description The response matches the validators of a conditional request */
+        NotModified: {
+            headers: {
+                [name: string]: unknown;
+            };
+            content?: never;
+        };
+        /** @description Invalid parameters, details maps every offending parameter to the reason */
+        BadRequest: {
+            headers: {
+                "X-Request-ID"?: components["headers"]["X-Request-ID"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["APIError"];
+            };
+        };
+        /** @description The station or line does not exist, details maps the parameter to its value */
+        NotFound: {
+            headers: {
+                "X-Request-ID"?: components["headers"]["X-Request-ID"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["APIError"];
+            };
+        };
+        /** @description The query failed */
+        InternalError: {
+            headers: {
+                "X-Request-ID"?: components["headers"]["X-Request-ID"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["APIError"];
+            };
+        };
+        /** @description The database is not connected */
+        ServiceUnavailable: {
+            headers: {
+                "X-Request-ID"?: components["headers"]["X-Request-ID"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["APIError"];
+            };
+        };
+        /** @description The query ran longer than the endpoint's timeout */
+        QueryTimeout: {
+            headers: {
+                "X-Request-ID"?: components["headers"]["X-Request-ID"];
+                [name: string]: unknown;
+            };
+            content: {
+                "application/json": components["schemas"]["APIError"];
+            };
+        };
+    };
+    parameters: {
+        /**
+         * Format: date
+         * @description Day to aggregate
+         */
+        date: string;
+        /** @description Bucket size in minutes */
+        interval: number;
+        /** @description Delay in minutes above which a departure counts towards percentageThreshold */
+        threshold: number;
+        /** @description Only count departures with realtime data */
+        realtime: boolean;
+        /** @description Cut days at 03:00 instead of midnight, so that night departures count towards the operating day they belong to */
+        serviceDay: boolean;
+        /** @description Add robust statistics (median, p90, p95, max, standard deviation) */
+        extended: boolean;
+        /**
+         * @default json
+         * @enum {string}
+         */
+        delayFormat: "json" | "ndjson" | "csv" | "parquet";
+        /** @description Send the JSON array row by row as the query produces it, bypassing the result cache */
+        stream: boolean;
+        /** @description Fail with scan_failed instead of returning a partial result when rows cannot be read */
+        strict: boolean;
+        /**
+         * Format: date
+         * @description First day of the range, defaults to a year ago
+         */
+        startDate: string;
+        /**
+         * Format: date
+         * @description Last day of the range, defaults to today
+         */
+        endDate: string;
+    };
+    requestBodies: never;
+    headers: {
+        /** @description Set to true when rows could not be read and are missing from the response */
+        "X-Partial-Result": boolean;
+        /** @description Describes the rows missing from a partial result, repeated once per query */
+        "X-Result-Warning": string;
+        /** @description Identifies the request in the server logs */
+        "X-Request-ID": string;
+    };
+    pathItems: never;
+}
+export type $defs = Record<string, never>;
+export interface operations {
+    getLineDelay: {
+        parameters: {
+            query: {
+                date: components["parameters"]["date"];
+                interval: components["parameters"]["interval"];
+                threshold: components["parameters"]["threshold"];
+                realtime: components["parameters"]["realtime"];
+                serviceDay?: components["parameters"]["serviceDay"];
+                extended?: components["parameters"]["extended"];
+                format?: components["parameters"]["delayFormat"];
+                stream?: components["parameters"]["stream"];
+                strict?: components["parameters"]["strict"];
+                /** @description Line label, e.g. U3 */
+                label: string;
+                /** @description Direction of travel, true for southbound departures */
+                south: boolean;
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            200: components["responses"]["LineDelayDays"];
+            304: components["responses"]["NotModified"];
+            400: components["responses"]["BadRequest"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    getGlobalDelay: {
+        parameters: {
+            query: {
+                date: components["parameters"]["date"];
+                interval: components["parameters"]["interval"];
+                threshold: components["parameters"]["threshold"];
+                realtime: components["parameters"]["realtime"];
+                serviceDay?: components["parameters"]["serviceDay"];
+                extended?: components["parameters"]["extended"];
+                format?: components["parameters"]["delayFormat"];
+                stream?: components["parameters"]["stream"];
+                strict?: components["parameters"]["strict"];
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            200: components["responses"]["LineDelayDays"];
+            304: components["responses"]["NotModified"];
+            400: components["responses"]["BadRequest"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    getStationStats: {
+        parameters: {
+            query: {
+                /** @description Station ID, e.g. de:09162:1 */
+                station: string;
+                startDate?: components["parameters"]["startDate"];
+                endDate?: components["parameters"]["endDate"];
+                serviceDay?: components["parameters"]["serviceDay"];
+                extended?: components["parameters"]["extended"];
+                /** @description Delay in minutes above which a departure counts as delayed, defaults to 2 */
+                threshold?: number;
+                /** @description Comma separated, ascending edges of the delay distribution buckets in minutes */
+                buckets?: string;
+                /**
+                 * @default json
+                 * @enum {string}
+                 */
+                format?: "json" | "csv" | "parquet";
+                strict?: components["parameters"]["strict"];
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Station statistics */
+            200: {
+                headers: {
+                    "X-Partial-Result"?: components["headers"]["X-Partial-Result"];
+                    "X-Result-Warning"?: components["headers"]["X-Result-Warning"];
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["StationStats"];
+                    "text/csv": string;
+                    "application/vnd.apache.parquet": string;
+                };
+            };
+            304: components["responses"]["NotModified"];
+            400: components["responses"]["BadRequest"];
+            404: components["responses"]["NotFound"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    getLineStats: {
+        parameters: {
+            query: {
+                /** @description Line label, e.g. U3 */
+                label: string;
+                startDate?: components["parameters"]["startDate"];
+                endDate?: components["parameters"]["endDate"];
+                serviceDay?: components["parameters"]["serviceDay"];
+                strict?: components["parameters"]["strict"];
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Line statistics */
+            200: {
+                headers: {
+                    "X-Partial-Result"?: components["headers"]["X-Partial-Result"];
+                    "X-Result-Warning"?: components["headers"]["X-Result-Warning"];
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["LineStatsReport"];
+                };
+            };
+            304: components["responses"]["NotModified"];
+            400: components["responses"]["BadRequest"];
+            404: components["responses"]["NotFound"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    getRankings: {
+        parameters: {
+            query?: {
+                /**
+                 * Format: date
+                 * @description First day of the range, defaults to a week ago
+                 */
+                startDate?: string;
+                /**
+                 * Format: date
+                 * @description Last day of the range, defaults to today
+                 */
+                endDate?: string;
+                /**
+                 * @description Number of entries per leaderboard
+                 * @default 10
+                 */
+                limit?: number;
+                /**
+                 * @description Minimum number of departures for a station or line to be ranked
+                 * @default 100
+                 */
+                minDepartures?: number;
+                strict?: components["parameters"]["strict"];
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Rankings */
+            200: {
+                headers: {
+                    "X-Partial-Result"?: components["headers"]["X-Partial-Result"];
+                    "X-Result-Warning"?: components["headers"]["X-Result-Warning"];
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["Rankings"];
+                };
+            };
+            304: components["responses"]["NotModified"];
+            400: components["responses"]["BadRequest"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    exportDepartures: {
+        parameters: {
+            query: {
+                /**
+                 * Format: date
+                 * @description First day of the export
+                 */
+                startDate: string;
+                /**
+                 * Format: date
+                 * @description Day after the last day of the export
+                 */
+                endDate: string;
+                /** @description Only export departures from this station */
+                station?: string;
+                /** @description Only export departures of this line */
+                label?: string;
+                /**
+                 * @description Maximum number of rows
+                 * @default 100000
+                 */
+                limit?: number;
+                /**
+                 * @default csv
+                 * @enum {string}
+                 */
+                format?: "csv" | "parquet" | "ndjson";
+                strict?: components["parameters"]["strict"];
+            };
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Departures, streamed as they are read. A partial result is flagged in the X-Partial-Result trailer. */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "text/csv": string;
+                    "application/vnd.apache.parquet": string;
+                    "application/x-ndjson": components["schemas"]["DepartureRecord"];
+                };
+            };
+            400: components["responses"]["BadRequest"];
+            500: components["responses"]["InternalError"];
+            503: components["responses"]["ServiceUnavailable"];
+            504: components["responses"]["QueryTimeout"];
+        };
+    };
+    subscribeEvents: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Event stream, the data of every event is a JSON encoded list of departures */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "text/event-stream": string;
+                };
+            };
+            500: components["responses"]["InternalError"];
+        };
+    };
+    getHealth: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description The server is running */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "text/plain": string;
+                };
+            };
+        };
+    };
+    getLiveness: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description The server is running */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["HealthReport"];
+                };
+            };
+        };
+    };
+    getReadiness: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description All dependencies are usable, status is ok or warn */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["HealthReport"];
+                };
+            };
+            /** @description A dependency failed */
+            503: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": components["schemas"]["HealthReport"];
+                };
+            };
+        };
+    };
+    getCacheStats: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description Cache statistics by endpoint */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": {
+                        [key: string]: components["schemas"]["CacheStats"];
+                    };
+                };
+            };
+        };
+    };
+    getOpenAPI: {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        requestBody?: never;
+        responses: {
+            /** @description OpenAPI document */
+            200: {
+                headers: {
+                    [name: string]: unknown;
+                };
+                content: {
+                    "application/json": Record<string, never>;
+                };
+            };
+            304: components["responses"]["NotModified"];
+        };
+    };
+}
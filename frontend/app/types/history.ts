@@ -1,19 +1,12 @@
-import { Coordinates, SubwayLine } from "./departures"
+import { components } from "./api"
+import { SubwayLine } from "./departures"
 
-export type StationBucketList = {
-  station: string
-  name: string
-  stop: number
-  buckets: Bucket[]
-  coordinates: Coordinates
-}
+export type StationBucketList = components["schemas"]["LineDelayDay"]
 
-export type Bucket = {
-  avgDelay: string
-  bucket: string
-  numDepartures: string
-  percentageThreshold: string
-}
+// Maps bucket, avgDelay, numDepartures and percentageThreshold to their
+// values, extended=true adds medianDelay, p90Delay, p95Delay, maxDelay and
+// stddevDelay
+export type Bucket = StationBucketList["buckets"][number]
 
 export interface ChartSettings {
   chartDate: Date
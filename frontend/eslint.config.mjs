@@ -20,7 +20,7 @@ const compat = new FlatCompat({
 
 export default [
   {
-    ignores: ["!**/.server", "!**/.client", "app/components/ui/", "build/"],
+    ignores: ["!**/.server", "!**/.client", "app/components/ui/", "app/types/api.d.ts", "build/"],
   },
   ...compat.extends(
     "eslint:recommended",